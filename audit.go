@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// One line in the audit log. It must never contain personal data like names
+// or dates of birth.
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	PDFHash         string    `json:"pdf_sha256,omitempty"`
+	CredentialTypes []string  `json:"credential_types,omitempty"` // of the credentials to issue
+	Institutes      []string  `json:"institutes,omitempty"`
+	Error           string    `json:"error,omitempty"`
+
+	// HMAC-SHA256 with the audit_key of the previous line (without the
+	// newline), or of nothing for the first line. This chains the records
+	// together, so removing or changing a record breaks the chain from there
+	// on, and without the key the chain cannot be recomputed.
+	Prev string `json:"prev"`
+}
+
+// Append-only log of issuance attempts, one JSON object per line.
+type auditLogger struct {
+	lock sync.Mutex
+	file *os.File
+	key  []byte
+	prev string // HMAC of the last line written
+}
+
+// Maximum length of a line in the audit log, to find the last line of an
+// existing log without reading all of it.
+const maxAuditLine = 64 * 1024
+
+// Minimum length of the audit_key.
+const minAuditKeyLength = 32
+
+// HMAC of a line in the audit log, for the prev field of the next record.
+func hashAuditLine(key, line []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(line)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The audit log, or nil when disabled. It is opened once at startup and isn't
+// affected by config reloads.
+var auditLog *auditLogger
+
+// Open the audit log at the given path, chaining the records with the given
+// key.
+func openAuditLog(path string, key []byte) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Continue the chain of an existing log.
+	last, err := lastAuditLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &auditLogger{file: file, key: key, prev: hashAuditLine(key, last)}, nil
+}
+
+// Read the last line of the audit log, or nothing when it is empty.
+func lastAuditLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - maxAuditLine
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if data[len(data)-1] == '\n' {
+		return nil, errors.New("audit log ends with an empty line")
+	}
+	start := bytes.LastIndexByte(data, '\n')
+	if start < 0 && offset != 0 {
+		return nil, errors.New("last line of audit log is too long")
+	}
+	return data[start+1:], nil
+}
+
+// Write a record to the audit log. Every record is synced to disk so that
+// nothing is lost when the process is killed.
+func (l *auditLogger) write(record *auditRecord) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		log.Println("audit log already closed, dropping record")
+		return
+	}
+	record.Prev = l.prev
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("cannot encode audit record:", err)
+		return
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Println("cannot write audit record:", err)
+		return
+	}
+	l.prev = hashAuditLine(l.key, line)
+	if err := l.file.Sync(); err != nil {
+		log.Println("cannot sync audit log:", err)
+	}
+}
+
+func (l *auditLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Check the chain of the audit log read from r, written with the given key.
+// Returns the number of records, or the line number where the chain is broken.
+func verifyAuditLog(r io.Reader, key []byte) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAuditLine)
+	prev := hashAuditLine(key, nil)
+	n := 0
+	for scanner.Scan() {
+		n++
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return n, fmt.Errorf("line %d: %w", n, err)
+		}
+		if !hmac.Equal([]byte(record.Prev), []byte(prev)) {
+			return n, fmt.Errorf("line %d: chain is broken, previous line was changed or removed", n)
+		}
+		prev = hashAuditLine(key, scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		return n, fmt.Errorf("line %d: %w", n+1, err)
+	}
+	return n, nil
+}
+
+// Check the chain of the audit log at the given path with the audit_key of the
+// config file, printing the result. Returns whether the chain is intact.
+func cmdAuditVerify(path string) bool {
+	if err := readConfig(); err != nil {
+		fmt.Println("FAIL: cannot read config file:", err)
+		return false
+	}
+	if config.AuditKey == "" {
+		fmt.Println("FAIL: no audit_key in the config file")
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		return false
+	}
+	defer file.Close()
+	n, err := verifyAuditLog(file, []byte(config.AuditKey))
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		return false
+	}
+	fmt.Printf("OK (%d records)\n", n)
+	return true
+}
+
+// How long to wait for requests in flight when the server is stopped. This
+// includes running pdf2htmlEX, like the write timeout.
+const shutdownTimeout = 2 * time.Minute
+
+// Stop the server on SIGINT or SIGTERM: let the requests in flight finish, so
+// their audit records are written, and close the audit log. Closes done when
+// finished.
+func handleShutdownSignal(server *http.Server, done chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Println("received", sig, "- shutting down")
+	if err := shutdownServer(server, shutdownTimeout); err != nil {
+		log.Println("cannot shut down cleanly:", err)
+		os.Exit(1)
+	}
+	close(done)
+}
+
+// Shut down the server within the given timeout, then close the audit log.
+func shutdownServer(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if closeErr := auditLog.close(); closeErr != nil {
+		log.Println("cannot close audit log:", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ResponseWriter that remembers the error code sent by sendErrorResponse, so
+// it ends up in the audit record.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	record *auditRecord
+}
+
+func hashPDF(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("test audit key of at least 32 characters")
+
+// Write n records to the audit log at path, reopening it like a restart.
+func writeAuditRecords(t *testing.T, path string, key []byte, n int) {
+	l, err := openAuditLog(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		l.write(&auditRecord{Time: time.Unix(int64(i), 0), CredentialTypes: []string{"pbdf.pbdf.diploma"}})
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, path, testAuditKey, 3)
+	writeAuditRecords(t, path, testAuditKey, 2) // the chain continues after a restart
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verifyAuditLog(bytes.NewReader(data), testAuditKey); n != 5 || err != nil {
+		t.Fatalf("got %d records, error %v", n, err)
+	}
+	if _, err := verifyAuditLog(bytes.NewReader(data), []byte("another key")); err == nil {
+		t.Error("chain verified with another key")
+	}
+
+	// A log rewritten without the key, e.g. with a record removed.
+	forged := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, forged, []byte("guessed key"), 4)
+	forgedData, err := ioutil.ReadFile(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	tests := []struct {
+		name string
+		log  string
+	}{
+		{"changed record", lines[0] + strings.Replace(lines[1], "1970", "1971", 1) + strings.Join(lines[2:], "")},
+		{"changed first record", strings.Replace(lines[0], "1970", "1971", 1) + strings.Join(lines[1:], "")},
+		{"removed record", lines[0] + strings.Join(lines[2:], "")},
+		{"removed first record", strings.Join(lines[1:], "")},
+		{"swapped records", lines[1] + lines[0] + strings.Join(lines[2:], "")},
+		{"not JSON", lines[0] + "garbage\n"},
+		{"rechained with another key", string(forgedData)},
+	}
+	for _, tc := range tests {
+		if _, err := verifyAuditLog(strings.NewReader(tc.log), testAuditKey); err == nil {
+			t.Errorf("%s: chain not broken", tc.name)
+		}
+	}
+}
+
+// Shutting down lets requests in flight finish and write their audit record
+// before the audit log is closed.
+func TestShutdownServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	oldAuditLog := auditLog
+	defer func() { auditLog = oldAuditLog }()
+	var err error
+	if auditLog, err = openAuditLog(path, testAuditKey); err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		auditLog.write(&auditRecord{Time: time.Now(), CredentialTypes: []string{"pbdf.pbdf.diploma"}})
+		w.Write([]byte("ok"))
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	response := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		response <- string(body)
+	}()
+	<-started
+	shutdown := make(chan error)
+	go func() { shutdown <- shutdownServer(server, 10*time.Second) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown finished before the request: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if body := <-response; body != "ok" {
+		t.Errorf("request in flight got %q", body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verifyAuditLog(bytes.NewReader(data), testAuditKey); n != 1 || err != nil {
+		t.Errorf("got %d records, error %v", n, err)
+	}
+}
+
+func TestAuditKeyRequired(t *testing.T) {
+	tests := []struct {
+		log, key string
+		valid    bool
+	}{
+		{"", "", true},
+		{"audit.log", "", false},
+		{"audit.log", "too short", false},
+		{"audit.log", string(testAuditKey), true},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.AuditLog, c.AuditKey = tc.log, tc.key
+		if err := c.validate(); (err == nil) != tc.valid {
+			t.Errorf("audit_log %q, audit_key %q: got %v", tc.log, tc.key, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// This file contains the certs check command, which checks the parent
+// certificates before deploying them: whether they can be loaded and whether
+// they are (about to be) expired.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+// Result of checking a single certificate file.
+type certCheck struct {
+	Path      string     `json:"path"`
+	Subject   string     `json:"subject,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Status    string     `json:"status"` // ok, expiring, expired, not-yet-valid or invalid
+	Error     string     `json:"error,omitempty"`
+}
+
+// Check all certificates (*.pem) in the certDir directories, printing a line
+// per certificate or, with -json, a JSON list. Certificates expiring within
+// -days days are flagged but don't fail the check. Returns whether all
+// certificates can be loaded and are currently valid.
+func cmdCertsCheck(args []string) bool {
+	flags := flag.NewFlagSet("certs check", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Print the results as JSON")
+	days := flags.Int("days", 30, "Flag certificates expiring within this many days")
+	flags.Parse(args)
+
+	var results []certCheck
+	now := clock()
+	for _, dir := range strings.Split(certDir, ",") {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot list certificates:", err)
+			return false
+		}
+		for _, path := range paths {
+			results = append(results, checkCertificate(path, now, time.Duration(*days)*24*time.Hour))
+		}
+	}
+
+	ok := len(results) != 0
+	for _, result := range results {
+		if result.Status != "ok" && result.Status != "expiring" {
+			ok = false
+		}
+	}
+
+	if *jsonOutput {
+		if results == nil {
+			results = []certCheck{}
+		}
+		data, _ := json.MarshalIndent(results, "", "\t")
+		fmt.Println(string(data))
+		return ok
+	}
+	if len(results) == 0 {
+		fmt.Println("FAIL: no certificates found in", certDir)
+	}
+	for _, result := range results {
+		if result.Status == "invalid" {
+			fmt.Printf("%-13s %s: %s\n", result.Status, result.Path, result.Error)
+			continue
+		}
+		fmt.Printf("%-13s %s: %s (valid %s to %s)\n", result.Status, result.Path, result.Subject,
+			result.NotBefore.Format("2006-01-02"), result.NotAfter.Format("2006-01-02"))
+	}
+	return ok
+}
+
+func checkCertificate(path string, now time.Time, warnPeriod time.Duration) certCheck {
+	cert, err := duo.LoadCertificate(path)
+	if err != nil {
+		return certCheck{Path: path, Status: "invalid", Error: err.Error()}
+	}
+	result := certCheck{
+		Path:      path,
+		Subject:   cert.Subject.String(),
+		NotBefore: &cert.NotBefore,
+		NotAfter:  &cert.NotAfter,
+		Status:    "ok",
+	}
+	switch {
+	case now.Before(cert.NotBefore):
+		result.Status = "not-yet-valid"
+	case now.After(cert.NotAfter):
+		result.Status = "expired"
+	case now.Add(warnPeriod).After(cert.NotAfter):
+		result.Status = "expiring"
+	}
+	return result
+}
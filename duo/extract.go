@@ -0,0 +1,2074 @@
+// Package duo verifies signed PDF extracts from the Dutch diploma register
+// (DUO) and extracts the diploma attributes from them.
+package duo
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/anaskhan96/soup"
+	"github.com/mastahyeti/cms"
+	"golang.org/x/net/html"
+	"rsc.io/pdf"
+)
+
+// This file contains code that reads a given PDF diploma file, verifies it, and
+// extracts all of its attributes.
+
+// Defaults for Options fields that are left zero.
+const (
+	DefaultMaxHTMLSize = 50 * 1024 * 1024
+	DefaultMaxPages    = 20
+	DefaultRetries     = 1
+	DefaultMinKeyBits  = 2048
+)
+
+// DefaultSignatureLocations is the default for Options.SignatureLocations.
+var DefaultSignatureLocations = []string{"docmdp", "acroform"}
+
+// DefaultSubFilters is the default for Options.SubFilters: all signature
+// formats that can be verified.
+var DefaultSubFilters = []string{"adbe.pkcs7.sha1", "adbe.pkcs7.detached", "ETSI.CAdES.detached", "ETSI.RFC3161"}
+
+// ValidSubFilter returns whether the given signature format can be used in
+// Options.SubFilters.
+func ValidSubFilter(subfilter string) bool {
+	for _, valid := range DefaultSubFilters {
+		if subfilter == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultContinuationLabels is the default for Options.ContinuationLabels.
+var DefaultContinuationLabels = []string{"Instelling"}
+
+// AttributeNames lists the IRMA attribute names of all attributes that can be
+// read from a diploma page.
+var AttributeNames = []string{
+	"familyname", "prefix", "firstname", "gender", "dateofbirth", "education",
+	"degree", "profile", "achieved", "institute", "city",
+}
+
+// DefaultDegreeNormalization maps the common values of "Aard van het examen"
+// to a normalized degree, see Options.NormalizeDegree.
+var DefaultDegreeNormalization = map[string]string{
+	"WO Bachelor":          "wo-bachelor",
+	"WO Master":            "wo-master",
+	"WO Doctoraal":         "wo-master", // before the bachelor-master system
+	"HBO Associate degree": "hbo-associate",
+	"HBO Bachelor":         "hbo-bachelor",
+	"HBO Master":           "hbo-master",
+}
+
+// DefaultRequiredAttributes is the default for Options.RequiredAttributes.
+var DefaultRequiredAttributes = []string{
+	"familyname", "firstname", "gender", "dateofbirth", "education",
+	"achieved", "institute", "city",
+}
+
+// Options for a Verifier.
+type Options struct {
+	TmpDir      string // where to put temporary files for pdf2htmlEX
+	KeepOutput  bool   // do not remove temporary files
+	Debug       bool   // print debugging information to stdout
+	MaxHTMLSize int64  // maximum size in bytes of the HTML produced by pdf2htmlEX
+	MaxPages    int    // maximum number of pages to process in a PDF
+
+	// Tolerance when checking the signing time against the current time and
+	// the validity of certificates.
+	ClockSkew time.Duration
+
+	// Intermediate certificates to build chains from the signing certificate
+	// to a trusted (pinned) certificate. May be nil.
+	Intermediates *x509.CertPool
+
+	// Also extract the field of study (EducationField) from the education name
+	// when it has a recognizable level prefix or suffix.
+	ParseEducationField bool
+
+	// Also set a normalized degree (NormalizedDegree), by looking up the
+	// degree in DefaultDegreeNormalization extended with DegreeNormalization
+	// (raw to normalized value). Raw values are compared ignoring case and
+	// whitespace. Degrees not in the table are passed through as-is, with a
+	// warning.
+	NormalizeDegree     bool
+	DegreeNormalization map[string]string
+
+	// Also extract the type of document (DocumentType).
+	IncludeDocumentType bool
+
+	// Also set the language of the extract (Language).
+	IncludeLanguage bool
+
+	// Also extract the distinction (Distinction), e.g. cum laude.
+	IncludeDistinction bool
+
+	// Also extract the grades on transcript (cijferlijst) pages into the
+	// diploma on the preceding page (Transcript).
+	IncludeTranscript bool
+
+	// Separator to join institutes and cities with when a diploma lists more
+	// than one (joint degrees). Only the first is used when empty.
+	InstituteSeparator string
+
+	// Labels of which the value may wrap to the next row on a diploma page.
+	// Defaults to DefaultContinuationLabels.
+	ContinuationLabels []string
+
+	// Attributes (from AttributeNames) that must be present and non-empty on
+	// a diploma page. Defaults to DefaultRequiredAttributes.
+	RequiredAttributes []string
+
+	// How often to retry running pdf2htmlEX when it fails, with fresh
+	// temporary files. Defaults to DefaultRetries, negative to not retry.
+	Retries int
+
+	// Where to look for the signature dictionary in a PDF, in order:
+	//   - "docmdp": the certification signature at Root/Perms/DocMDP
+	//   - "acroform": the first signed signature field in Root/AcroForm
+	//   - "acroform:<name>": the signed signature field with the given name
+	// Defaults to DefaultSignatureLocations.
+	SignatureLocations []string
+
+	// Signature formats (the SubFilter of the signature dictionary) to
+	// accept, e.g. to phase out adbe.pkcs7.sha1. Defaults to
+	// DefaultSubFilters.
+	SubFilters []string
+
+	// Trusted roots of timestamping authorities. When set, signatures must
+	// have an RFC 3161 signature timestamp from one of them, and its time is
+	// used as the signing time. May be nil.
+	TSARoots *x509.CertPool
+
+	// Minimum size of the RSA key of the signing certificate. Defaults to
+	// DefaultMinKeyBits, negative for no minimum.
+	MinKeyBits int
+
+	// Refuse SHA-1 (adbe.pkcs7.sha1) signatures and signing certificates
+	// signed with SHA-1. MD5 is always refused.
+	RejectSHA1 bool
+
+	// Fail extraction when a diploma page has labels that aren't recognized,
+	// as the format may have changed and fields would be ignored.
+	StrictLabels bool
+
+	// Extracts the diplomas from verified PDFs. Defaults to a DUOExtractor,
+	// which uses the options above.
+	Extractor Extractor
+
+	// Returns the current time, to check signing times against. Defaults to
+	// time.Now, but can be replaced by a fixed clock in tests.
+	Now func() time.Time
+
+	// Do not verify the PDF signature at all. Only for development!
+	SkipVerification bool
+}
+
+// Verifier verifies PDF extracts against a pool of pinned DUO certificates
+// and extracts the diplomas in them. It is safe for concurrent use, as long as
+// the pool and Options.Intermediates aren't modified after New: to trust other
+// certificates, create a new Verifier and swap it in instead.
+type Verifier struct {
+	pool               *x509.CertPool
+	opts               Options
+	continuationLabels map[string]bool
+	requiredAttributes map[string]bool
+	degrees            map[string]string // normalized key -> normalized degree
+	extractor          Extractor
+	checkVersion       sync.Once
+}
+
+// New returns a Verifier that trusts the certificates in the given pool.
+func New(pool *x509.CertPool, opts Options) *Verifier {
+	if opts.MaxHTMLSize == 0 {
+		opts.MaxHTMLSize = DefaultMaxHTMLSize
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = DefaultMaxPages
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.MinKeyBits == 0 {
+		opts.MinKeyBits = DefaultMinKeyBits
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.SignatureLocations == nil {
+		opts.SignatureLocations = DefaultSignatureLocations
+	}
+	if opts.SubFilters == nil {
+		opts.SubFilters = DefaultSubFilters
+	}
+	if opts.ContinuationLabels == nil {
+		opts.ContinuationLabels = DefaultContinuationLabels
+	}
+	if opts.RequiredAttributes == nil {
+		opts.RequiredAttributes = DefaultRequiredAttributes
+	}
+	requiredAttributes := make(map[string]bool, len(opts.RequiredAttributes))
+	for _, name := range opts.RequiredAttributes {
+		requiredAttributes[name] = true
+	}
+	continuationLabels := make(map[string]bool, len(opts.ContinuationLabels))
+	for _, label := range opts.ContinuationLabels {
+		if label != "" {
+			continuationLabels[label] = true
+		}
+	}
+	var degrees map[string]string
+	if opts.NormalizeDegree {
+		degrees = make(map[string]string)
+		for raw, degree := range DefaultDegreeNormalization {
+			degrees[degreeKey(raw)] = degree
+		}
+		for raw, degree := range opts.DegreeNormalization {
+			degrees[degreeKey(raw)] = degree
+		}
+	}
+	v := &Verifier{
+		pool:               pool,
+		opts:               opts,
+		continuationLabels: continuationLabels,
+		requiredAttributes: requiredAttributes,
+		degrees:            degrees,
+		extractor:          opts.Extractor,
+	}
+	if v.extractor == nil {
+		v.extractor = DUOExtractor{v}
+	}
+	return v
+}
+
+// Diploma contains the attributes of a single diploma in an extract.
+type Diploma struct {
+	FamilyName  string
+	Prefix      string // optional, see PrefixPresent
+	FirstName   string
+	Gender      string // "male", "female" or "unknown"
+	DateOfBirth string // DD-MM-YYYY
+	Education   string
+	Degree      string // optional, e.g. "WO Master" for universities
+	Profile     string // optional, e.g. "Nieuw Profiel Natuur en Techniek" for high schools
+	Achieved    string // DD-MM-YYYY
+	Institute   string
+	City        string // all uppercase
+	BSN         string // optional, only for matching and never issued
+
+	// Optional, field of study without level (e.g. "Informatica" for
+	// "B Informatica"), only set with Options.ParseEducationField.
+	EducationField string
+
+	// Optional, normalized degree (e.g. "wo-master" for "WO Master"), only
+	// set with Options.NormalizeDegree and when the diploma has a degree.
+	NormalizedDegree string
+
+	// Optional, "original", "duplicate", "statement" or "other", only set
+	// with Options.IncludeDocumentType.
+	DocumentType string
+
+	// All institutes and their cities, in order. Institute and City hold the
+	// first one, or all of them joined with Options.InstituteSeparator.
+	Institutes []string
+	Cities     []string
+
+	// Optional, "summa-cum-laude", "cum-laude", "with-merit" or "other", only
+	// set with Options.IncludeDistinction and when the diploma mentions one.
+	Distinction string
+
+	// Optional, the courses and grades on the transcript (cijferlijst)
+	// following the diploma, in order. Only set with
+	// Options.IncludeTranscript.
+	Transcript []Course
+
+	// Optional, language of the extract as detected from the marker text,
+	// e.g. "nl". Only set with Options.IncludeLanguage.
+	Language string
+
+	// Whether the diploma has a prefix (tussenvoegsel) row, which may be
+	// empty. An empty or absent prefix is treated the same everywhere else:
+	// it isn't issued and isn't part of the full family name.
+	PrefixPresent bool
+}
+
+// Course is a row on a transcript (cijferlijst): the name of the course or
+// exam subject and the grade as written on the transcript, e.g. "7,5" or
+// "voldoende".
+type Course struct {
+	Name  string `json:"course"`
+	Grade string `json:"grade"`
+}
+
+// FullFamilyName returns the family name including the prefix, if any, e.g.
+// "de Vries".
+func (d *Diploma) FullFamilyName() string {
+	if d.Prefix == "" {
+		return d.FamilyName
+	}
+	return d.Prefix + " " + d.FamilyName
+}
+
+// Attributes returns the attributes of this diploma to issue in a credential,
+// keyed by IRMA attribute name. Attributes without a value are left out.
+func (d *Diploma) Attributes() map[string]string {
+	attributes := make(map[string]string)
+	for key, value := range d.values() {
+		if value != "" {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
+
+// All attributes that may be issued, keyed by IRMA attribute name.
+func (d *Diploma) values() map[string]string {
+	return map[string]string{
+		"familyname":       d.FamilyName,
+		"prefix":           d.Prefix,
+		"firstname":        d.FirstName,
+		"gender":           d.Gender,
+		"dateofbirth":      d.DateOfBirth,
+		"education":        d.Education,
+		"degree":           d.Degree,
+		"profile":          d.Profile,
+		"achieved":         d.Achieved,
+		"institute":        d.Institute,
+		"city":             d.City,
+		"educationfield":   d.EducationField,
+		"normalizeddegree": d.NormalizedDegree,
+		"documenttype":     d.DocumentType,
+		"language":         d.Language,
+		"distinction":      d.Distinction,
+		"transcript":       d.transcript(),
+	}
+}
+
+// The transcript as issued: a JSON list of objects with a course and grade,
+// e.g. [{"course":"Nederlands","grade":"7"}], or "" when there is none.
+func (d *Diploma) transcript() string {
+	if len(d.Transcript) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(d.Transcript)
+	if err != nil {
+		return "" // cannot happen for strings
+	}
+	return string(data)
+}
+
+// Check that all required attributes have a value. An attribute can be found
+// on the page but still be empty, e.g. when the value is blank or cannot be
+// parsed.
+func (v *Verifier) validate(d *Diploma) error {
+	values := d.values()
+	var empty EmptyAttributesError
+	for key := range v.requiredAttributes {
+		if strings.TrimSpace(values[key]) == "" {
+			empty = append(empty, key)
+		}
+	}
+	if len(empty) != 0 {
+		sort.Strings(empty)
+		return &ExtractError{"empty attributes", empty}
+	}
+	return nil
+}
+
+type ExtractError struct {
+	Op  string
+	Err error
+}
+
+func (e ExtractError) Error() string {
+	if e.Err == nil {
+		return e.Op
+	}
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e ExtractError) Unwrap() error {
+	return e.Err
+}
+
+// ErrExtractorUnavailable is returned (wrapped) when pdf2htmlEX cannot be run
+// at all, e.g. because it isn't installed. This is a problem with the server,
+// not with the PDF.
+var ErrExtractorUnavailable = errors.New("pdf2htmlEX is unavailable")
+
+// ErrEncryptedPDF is returned (wrapped) for password-protected PDFs, which
+// cannot be verified. DUO extracts are never encrypted.
+var ErrEncryptedPDF = errors.New("PDF is encrypted")
+
+// ErrTruncatedPDF is returned (wrapped) when a PDF doesn't end with an end of
+// file marker, e.g. because the upload or download was cut off.
+var ErrTruncatedPDF = errors.New("PDF is truncated")
+
+// ErrHybridPDF is returned for hybrid-reference files (with both a
+// cross-reference table and a cross-reference stream given by XRefStm), when
+// the signature cannot be found without the cross-reference stream. These are
+// not supported.
+var ErrHybridPDF = errors.New("hybrid cross-reference files are not supported")
+
+// ErrWeakSignature is returned (wrapped) when a signature verifies, but uses a
+// key smaller than Options.MinKeyBits or a deprecated algorithm.
+var ErrWeakSignature = errors.New("signature is too weak")
+
+// CertificateError is returned (wrapped) when the certificate chain of a
+// signature or timestamp cannot be verified. Reason is one of
+// "unknown-authority" (not issued by a trusted certificate), "expired" (not
+// valid at the signing time), "usage" (not valid for signing, see
+// checkSigningUsage) or "invalid".
+type CertificateError struct {
+	Reason string
+	Err    error // the error from crypto/x509
+}
+
+func (e CertificateError) Error() string {
+	return "certificate " + e.Reason + ": " + e.Err.Error()
+}
+
+func (e CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap an error from crypto/x509 chain verification in a CertificateError.
+// Other errors are returned as-is.
+func certificateError(err error) error {
+	var authorityErr x509.UnknownAuthorityError
+	if errors.As(err, &authorityErr) {
+		return CertificateError{"unknown-authority", err}
+	}
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &invalidErr) {
+		switch invalidErr.Reason {
+		case x509.Expired:
+			return CertificateError{"expired", err}
+		case x509.IncompatibleUsage:
+			return CertificateError{"usage", err}
+		default:
+			return CertificateError{"invalid", err}
+		}
+	}
+	return err
+}
+
+// MissingAttributesError lists all required attributes that could not be found
+// on a diploma page.
+type MissingAttributesError []string
+
+func (e MissingAttributesError) Error() string {
+	return strings.Join(e, ", ")
+}
+
+// UnknownLabelsError lists the labels on a diploma page that aren't
+// recognized, with Options.StrictLabels.
+type UnknownLabelsError []string
+
+func (e UnknownLabelsError) Error() string {
+	return strings.Join(e, ", ")
+}
+
+// EmptyAttributesError lists all required attributes that were found on a
+// diploma page but have no value.
+type EmptyAttributesError []string
+
+func (e EmptyAttributesError) Error() string {
+	return strings.Join(e, ", ")
+}
+
+// Warning is a soft issue found during extraction, e.g. a date that cannot be
+// parsed or a page that was skipped. It doesn't contain values from the
+// diploma, so it can be logged.
+type Warning struct {
+	Page    int // 1-based, 0 when not about a specific page
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Page == 0 {
+		return w.Message
+	}
+	return "page " + strconv.Itoa(w.Page) + ": " + w.Message
+}
+
+// Accumulator for the warnings of an extraction, tracking the current page.
+type warningList struct {
+	page     int
+	warnings []Warning
+}
+
+func (l *warningList) add(message string) {
+	l.warnings = append(l.warnings, Warning{Page: l.page, Message: message})
+}
+
+// DumpTree writes the object tree of a PDF document, starting at the trailer,
+// up to the given depth. Very useful for debugging.
+func DumpTree(w io.Writer, pdfData []byte, maxDepth int) error {
+	doc, err := pdf.NewReader(bytes.NewReader(pdfData), int64(len(pdfData)))
+	if err != nil {
+		return err
+	}
+	printTree(w, doc.Trailer(), 0, maxDepth)
+	return nil
+}
+
+// Utility function to dump the structure of a PDF value.
+func printTree(w io.Writer, v pdf.Value, indent, maxDepth int) {
+	// Avoid too much recursion.
+	if indent > maxDepth {
+		fmt.Fprintln(w, "<max depth exceeded>")
+		return
+	}
+
+	switch v.Kind() {
+	case pdf.Dict:
+		fmt.Fprintln(w)
+		for _, key := range v.Keys() {
+			for i := 0; i < indent; i++ {
+				fmt.Fprintf(w, "  ")
+			}
+			fmt.Fprintf(w, "%s: ", key)
+			printTree(w, v.Key(key), indent+1, maxDepth)
+		}
+	case pdf.Array:
+		fmt.Fprintln(w)
+		for i := 0; i < v.Len(); i++ {
+			for i := 0; i < indent; i++ {
+				fmt.Fprintf(w, "  ")
+			}
+			fmt.Fprintf(w, "- ")
+			printTree(w, v.Index(i), indent+1, maxDepth)
+		}
+	case pdf.Integer:
+		fmt.Fprintln(w, v.Int64())
+	case pdf.String:
+		fmt.Fprintf(w, "%#v\n", v.Text())
+	case pdf.Name:
+		fmt.Fprintln(w, v.Name())
+	default:
+		fmt.Fprintln(w, "??")
+	}
+}
+
+// Find the signature dictionary of a PDF document, trying the configured
+// signature locations in order. See Options.SignatureLocations.
+func (v *Verifier) findSignature(root pdf.Value) pdf.Value {
+	for _, location := range v.opts.SignatureLocations {
+		var sigValue pdf.Value
+		switch {
+		case location == "docmdp":
+			sigValue = root.Key("Perms").Key("DocMDP")
+		case location == "acroform":
+			sigValue = findSignatureField(root.Key("AcroForm").Key("Fields"), "", 0)
+		case strings.HasPrefix(location, "acroform:"):
+			name := strings.TrimPrefix(location, "acroform:")
+			sigValue = findSignatureField(root.Key("AcroForm").Key("Fields"), name, 0)
+		}
+		if !sigValue.IsNull() {
+			return sigValue
+		}
+	}
+	return pdf.Value{}
+}
+
+// ValidSignatureLocation returns whether the given location can be used in
+// Options.SignatureLocations.
+func ValidSignatureLocation(location string) bool {
+	return location == "docmdp" || location == "acroform" ||
+		(strings.HasPrefix(location, "acroform:") && len(location) > len("acroform:"))
+}
+
+// Search (nested) form fields for a signed signature field with the given
+// name (any name when empty) and return its signature dictionary, or a null
+// value when there is none.
+func findSignatureField(fields pdf.Value, name string, depth int) pdf.Value {
+	// Avoid too much recursion on crafted PDFs.
+	if depth > 7 || fields.Kind() != pdf.Array {
+		return pdf.Value{}
+	}
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Index(i)
+		if field.Key("FT").Name() == "Sig" && field.Key("V").Kind() == pdf.Dict &&
+			(name == "" || field.Key("T").Text() == name) {
+			return field.Key("V")
+		}
+		if sigValue := findSignatureField(field.Key("Kids"), name, depth+1); !sigValue.IsNull() {
+			return sigValue
+		}
+	}
+	return pdf.Value{}
+}
+
+// Whether signatures with the given SubFilter are accepted, see
+// Options.SubFilters.
+func (v *Verifier) acceptSubFilter(subfilter string) bool {
+	for _, accepted := range v.opts.SubFilters {
+		if subfilter == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// The values from the signature dictionary of a PDF that are needed to verify
+// it, read by readSignature.
+type signatureDict struct {
+	contents    []byte // PKCS#7 signature
+	subfilter   string
+	byteRange   []int64 // four non-negative values
+	signingTime time.Time
+}
+
+// Read the signature dictionary of a PDF, containing the byte ranges, hashing
+// method (subfilter), and the signature itself.
+func (v *Verifier) readSignature(inputPDF []byte) (sig *signatureDict, err error) {
+	// The PDF library resolves indirect objects lazily, including objects in
+	// object streams (as used with cross-reference streams), and panics when
+	// such a stream is malformed. Only the PDF library is used here, so that
+	// panics in the rest of verifyPDF aren't hidden.
+	defer func() {
+		if e := recover(); e != nil {
+			sig, err = nil, fmt.Errorf("verifyPDF: malformed PDF: %v", e)
+		}
+	}()
+
+	// Open the PDF file.
+	r := bytes.NewReader(inputPDF)
+	doc, err := pdf.NewReader(r, int64(len(inputPDF)))
+	if err == pdf.ErrInvalidPassword || err != nil && bytes.Contains(inputPDF, []byte("/Encrypt")) {
+		// Either it needs a password, or the encryption isn't supported
+		// by the PDF library.
+		return nil, fmt.Errorf("%w: %v", ErrEncryptedPDF, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the signature element.
+	sigValue := v.findSignature(doc.Trailer().Key("Root"))
+	if sigValue.IsNull() && !doc.Trailer().Key("XRefStm").IsNull() {
+		// A hybrid-reference file: the objects in object streams are only
+		// listed in the cross-reference stream given by XRefStm, which the
+		// PDF library ignores.
+		return nil, ErrHybridPDF
+	}
+	if sigValue.IsNull() {
+		return nil, errors.New("verifyPDF: could not find signature")
+	}
+	sigDataValue := sigValue.Key("Contents") // PKCS#7 signature
+	subfilter := sigValue.Key("SubFilter")
+	if sigDataValue.IsNull() || sigDataValue.Kind() != pdf.String || subfilter.IsNull() || subfilter.Kind() != pdf.Name {
+		return nil, errors.New("verifyPDF: could not extract signature")
+	}
+	if !v.acceptSubFilter(subfilter.Name()) {
+		return nil, errors.New("verifyPDF: subfilter not accepted: " + subfilter.Name())
+	}
+	signingTime, err := v.signingTime(sigValue)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read signed ranges. This is very likely the range from the start of the
+	// document until the signature, and then from the end of the signature to
+	// the end of the document. But we can't be sure of it (it might have been
+	// tampered with), so we'll calculate the hash, validate it in a later step,
+	// and only continue working with the parts that were included in the hash.
+	byteRangeValue := sigValue.Key("ByteRange")
+	if byteRangeValue.IsNull() || byteRangeValue.Kind() != pdf.Array || byteRangeValue.Len() != 4 {
+		return nil, errors.New("verifyPDF: could not find ByteRange")
+	}
+	byteRange := make([]int64, 4)
+	for i := range byteRange {
+		if byteRangeValue.Index(i).Kind() != pdf.Integer {
+			return nil, errors.New("verifyPDF: invalid ByteRange type")
+		}
+		byteRange[i] = byteRangeValue.Index(i).Int64()
+		if byteRange[i] < 0 {
+			return nil, errors.New("verifyPDF: negative ByteRange value")
+		}
+	}
+
+	return &signatureDict{
+		contents:    []byte(sigDataValue.RawString()),
+		subfilter:   subfilter.Name(),
+		byteRange:   byteRange,
+		signingTime: signingTime,
+	}, nil
+}
+
+// Verify the signature contained in a PDF and return the verified PDF as a byte
+// slice.
+//
+// This function follows the signed PDF specification that you can read here:
+// https://www.adobe.com/devnet-docs/acrobatetk/tools/DigSig/Acrobat_DigitalSignatures_in_PDF.pdf
+func (v *Verifier) verifyPDF(inputPDF []byte) ([]byte, *Signature, error) {
+	// A PDF ends with %%EOF, possibly followed by some whitespace (or, in
+	// practice, a little garbage).
+	tail := inputPDF
+	if len(tail) > 1024 {
+		tail = tail[len(tail)-1024:]
+	}
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return nil, nil, ErrTruncatedPDF
+	}
+
+	sig, err := v.readSignature(inputPDF)
+	if err != nil {
+		return nil, nil, err
+	}
+	signingTime := sig.signingTime
+	if v.opts.TSARoots != nil && sig.subfilter != "ETSI.RFC3161" {
+		// Don't trust the signing time claimed by the signer, but use the
+		// time from the timestamp over the signature.
+		signingTime, err = v.signatureTimestamp(sig.contents)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	byteRange := sig.byteRange
+
+	// Are these byteRange values somewhat sane?
+	// Note that this is just a quick and small (incomplete) sanity check for
+	// the input byte ranges. The real check is below when the verified (and
+	// thus trusted) byte ranges are copied and put in a new PDF.
+	// Some producers pad the file with whitespace after the signed data,
+	// which is tolerated up to maxTrailingPadding bytes. The padding is
+	// dropped from the trusted PDF built below, like anything else outside
+	// the byte ranges.
+	size := int64(len(inputPDF))
+	if byteRange[0] != 0 || byteRange[2] > size || byteRange[3] > size-byteRange[2] ||
+		!isPadding(inputPDF[byteRange[2]+byteRange[3]:]) {
+		return nil, nil, errors.New("verifyPDF: byte ranges don't cover the entire PDF")
+	}
+	// Make sure the slicing below cannot panic on a crafted PDF. The values
+	// are all non-negative, so checking that the first range ends before the
+	// second starts (which in turn ends within the PDF) means all
+	// indices lie within the PDF. This also rejects overlapping ranges.
+	if byteRange[1] > byteRange[2] {
+		return nil, nil, errors.New("verifyPDF: invalid byte ranges")
+	}
+
+	// Get the hashed data blocks.
+	before := inputPDF[byteRange[0] : byteRange[0]+byteRange[1]]
+	after := inputPDF[byteRange[2] : byteRange[2]+byteRange[3]]
+
+	// Check for supported hash functions.
+	var signer *x509.Certificate
+	if sig.subfilter == "adbe.pkcs7.sha1" {
+		// This is an old PDF, which is signed with SHA1. Unfortunately, we will
+		// need to support this version for a while.
+		if v.opts.RejectSHA1 {
+			return nil, nil, fmt.Errorf("%w: SHA-1 signature", ErrWeakSignature)
+		}
+		// Let's do the hashing!
+		hashInst := sha1.New()
+		hashInst.Write(before)
+		hashInst.Write(after)
+		hash := hashInst.Sum(nil)
+
+		// And verify the signature over the hash we just calculated.
+		signer, err = v.verifySignature(sig.contents, hash, signingTime)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	} else if sig.subfilter == "adbe.pkcs7.detached" || sig.subfilter == "ETSI.CAdES.detached" {
+		// This is a newer PDF, which uses a more modern "detached" signature.
+		// PAdES signatures (ETSI.CAdES.detached) are CMS detached signatures
+		// as well, with some extra signed attributes.
+		// The signed data from the PDF is inserted into a buffer which is then
+		// verified.
+		data := make([]byte, len(before)+len(after))
+		copy(data[:len(before)], before)
+		copy(data[len(before):], after)
+		signer, err = v.verifyDetachedSignature(sig.contents, data, signingTime)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	} else if sig.subfilter == "ETSI.RFC3161" {
+		// A PAdES document timestamp: the signature is an RFC 3161 timestamp
+		// token over the signed data.
+		data := make([]byte, len(before)+len(after))
+		copy(data[:len(before)], before)
+		copy(data[len(before):], after)
+		signer, err = v.verifyTimestampToken(sig.contents, data, signingTime)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	} else {
+		return nil, nil, errors.New("verifyPDF: unimplemented subfilter: " + sig.subfilter)
+	}
+
+	// At this point, the data in "before" and "after" is verified so we can
+	// trust it. But we can't trust the original PDF, because it might contain unsigned data -
+	// so we'll build a new one from only the signed, trusted data.
+
+	// Build a new PDF with only trusted data.
+	// It would be more efficient to zero out the untrusted parts, but copying
+	// the trusted parts is a bit more resistant against mistakes.
+	trustedPDF := make([]byte, byteRange[2]+byteRange[3])
+	copy(trustedPDF[byteRange[0]:byteRange[0]+byteRange[1]], before)
+	copy(trustedPDF[byteRange[2]:byteRange[2]+byteRange[3]], after)
+
+	return trustedPDF, &Signature{Signer: signer, SigningTime: signingTime}, nil
+}
+
+// Maximum number of whitespace bytes after the last signed byte range. The
+// PDF library requires the %%EOF marker within the last 100 bytes anyway.
+const maxTrailingPadding = 64
+
+// Whether data is empty or consists of at most maxTrailingPadding bytes of
+// spaces, tabs and line endings.
+func isPadding(data []byte) bool {
+	if len(data) > maxTrailingPadding {
+		return false
+	}
+	for _, c := range data {
+		switch c {
+		case '\t', '\n', '\r', ' ':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// signingTime returns the time the PDF was signed according to the signature
+// dictionary, or the current time when it has no signing time. This time is
+// asserted by the signer (and covered by the signature), and certificates must
+// be valid at that time.
+func (v *Verifier) signingTime(sigValue pdf.Value) (time.Time, error) {
+	now := v.opts.Now()
+	m := sigValue.Key("M")
+	if m.Kind() != pdf.String {
+		return now, nil
+	}
+	signingTime, err := parsePDFDate(m.Text())
+	if err != nil {
+		return time.Time{}, errors.New("verifyPDF: invalid signing time: " + err.Error())
+	}
+	if signingTime.After(now.Add(v.opts.ClockSkew)) {
+		return time.Time{}, errors.New("verifyPDF: signing time is in the future")
+	}
+	return signingTime, nil
+}
+
+// verifyChain verifies the certificate chain of a signature with the given
+// verify function (which should wrap e.g. cms.SignedData.Verify), checking
+// that the certificates were valid at the signing time. Certificates that are
+// only valid within the allowed clock skew of the signing time are accepted as
+// well. Errors from crypto/x509 are wrapped in a CertificateError.
+func (v *Verifier) verifyChain(verify func(x509.VerifyOptions) error, roots *x509.CertPool, keyUsage x509.ExtKeyUsage, signingTime time.Time) error {
+	// The pinned certificates are used as root certificates: these may be the
+	// signing certificates themselves, or a DUO intermediate or root when the
+	// chain can be built via the configured intermediates.
+	verifyAt := func(t time.Time) error {
+		// cms adds the certificates embedded in the signature to the
+		// intermediates pool, so every attempt gets its own copy: the
+		// configured pool is shared by all concurrent verifications.
+		intermediates := x509.NewCertPool()
+		if v.opts.Intermediates != nil {
+			intermediates = v.opts.Intermediates.Clone()
+		}
+		cmsLock.Lock()
+		defer cmsLock.Unlock()
+		return verify(x509.VerifyOptions{
+			Intermediates: intermediates,
+			Roots:         roots,
+			KeyUsages: []x509.ExtKeyUsage{
+				keyUsage,
+			},
+			CurrentTime: t,
+		})
+	}
+	err := verifyAt(signingTime)
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) && certErr.Reason == x509.Expired && v.opts.ClockSkew != 0 {
+		// Expired also means "not yet valid". Try again at both edges of the
+		// allowed clock skew.
+		for _, t := range []time.Time{signingTime.Add(-v.opts.ClockSkew), signingTime.Add(v.opts.ClockSkew)} {
+			if verifyAt(t) == nil {
+				return nil
+			}
+		}
+	}
+	return certificateError(err)
+}
+
+// The BER decoder of the cms package updates a package-level variable without
+// synchronization, so all parsing and verification of CMS structures (which
+// may decode embedded timestamps) is done one at a time.
+var cmsLock sync.Mutex
+
+func parseSignedData(ber []byte) (*cms.SignedData, error) {
+	cmsLock.Lock()
+	defer cmsLock.Unlock()
+	return cms.ParseSignedData(ber)
+}
+
+// Parse the CMS signature of a PDF, see withoutSignatureTimestamps.
+func parseSignature(sigData []byte) (*cms.SignedData, error) {
+	sigData, err := withoutSignatureTimestamps(sigData)
+	if err != nil {
+		return nil, err
+	}
+	return parseSignedData(sigData)
+}
+
+// Return the signing certificate from the chains returned when verifying a
+// signature, or nil when there are none.
+func signerCertificate(chains [][][]*x509.Certificate) *x509.Certificate {
+	if len(chains) == 0 || len(chains[0]) == 0 || len(chains[0][0]) == 0 {
+		return nil
+	}
+	return chains[0][0][0]
+}
+
+// Extended key usages of certificates used to sign documents, next to
+// x509.ExtKeyUsageEmailProtection: id-kp-documentSigning (RFC 9336), Adobe
+// Authentic Documents Trust and Microsoft Document Signing.
+var documentSigningUsages = []asn1.ObjectIdentifier{
+	{1, 3, 6, 1, 5, 5, 7, 3, 36},
+	{1, 2, 840, 113583, 1, 1, 5},
+	{1, 3, 6, 1, 4, 1, 311, 10, 3, 12},
+}
+
+// Check whether a signing certificate may be used to sign documents: without
+// extended key usages, or with one for any usage, email protection or document
+// signing. The chain itself is verified for any usage, as crypto/x509 doesn't
+// know about the document signing usages.
+func checkSigningUsage(cert *x509.Certificate) bool {
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageAny || usage == x509.ExtKeyUsageEmailProtection {
+			return true
+		}
+	}
+	for _, usage := range cert.UnknownExtKeyUsage {
+		for _, documentSigning := range documentSigningUsages {
+			if usage.Equal(documentSigning) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the usage, key size and signature algorithm of a verified signing
+// certificate against the options.
+func (v *Verifier) checkSigningCertificate(cert *x509.Certificate) error {
+	if cert == nil {
+		return nil
+	}
+	if !checkSigningUsage(cert) {
+		return CertificateError{"usage", x509.CertificateInvalidError{Cert: cert, Reason: x509.IncompatibleUsage, Detail: "not valid for signing documents"}}
+	}
+	if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && v.opts.MinKeyBits > 0 && key.N.BitLen() < v.opts.MinKeyBits {
+		return fmt.Errorf("%w: %d-bit RSA key", ErrWeakSignature, key.N.BitLen())
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA:
+		return fmt.Errorf("%w: certificate signed with %s", ErrWeakSignature, cert.SignatureAlgorithm)
+	case x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		if v.opts.RejectSHA1 {
+			return fmt.Errorf("%w: certificate signed with %s", ErrWeakSignature, cert.SignatureAlgorithm)
+		}
+	}
+	return nil
+}
+
+// verifySignature verifies the given signature over the specified hash,
+// returning the signing certificate, or an error on any error (including
+// verification failure).
+func (v *Verifier) verifySignature(sigData []byte, foundHash []byte, signingTime time.Time) (*x509.Certificate, error) {
+	// Parse the PKCS#7 signature object.
+	sig, err := parseSignature(sigData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the loaded signature.
+	var chains [][][]*x509.Certificate
+	err = v.verifyChain(func(verifyOpts x509.VerifyOptions) error {
+		var err error
+		chains, err = sig.Verify(verifyOpts)
+		return err
+	}, v.pool, x509.ExtKeyUsageAny, signingTime)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := sig.GetData() // hash of signed parts of the PDF
+	if err != nil {
+		return nil, err
+	}
+
+	// Check whether the signed hash matches the hash we calculated ourselves.
+	if bytes.Compare(foundHash, data) != 0 {
+		return nil, errors.New("verifySignature: could not verify signature: hash doesn't match")
+	}
+	cert := signerCertificate(chains)
+	if err := v.checkSigningCertificate(cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// verifyDetachedSignature verifies the given message with the given message,
+// returning the signing certificate, or an error on any error (including
+// verification failure).
+func (v *Verifier) verifyDetachedSignature(sigData []byte, msg []byte, signingTime time.Time) (*x509.Certificate, error) {
+	// Parse the PKCS#7 signature object.
+	sig, err := parseSignature(sigData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the loaded signature.
+	var chains [][][]*x509.Certificate
+	err = v.verifyChain(func(verifyOpts x509.VerifyOptions) error {
+		var err error
+		chains, err = sig.VerifyDetached(msg, verifyOpts)
+		return err
+	}, v.pool, x509.ExtKeyUsageAny, signingTime)
+	if err != nil {
+		return nil, err
+	}
+	cert := signerCertificate(chains)
+	if err := v.checkSigningCertificate(cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Extracts all diplomas from a PDF file for use by IRMA, by first converting
+// to HTML and then parsing it.
+func (v *Verifier) extractAttributes(pdfData []byte) ([]Diploma, []Warning, error) {
+	// pdf2htmlEX sometimes fails under memory pressure, and then usually
+	// succeeds when run again. Only retry when it has run and failed, not when
+	// it couldn't be run at all.
+	var htmlData []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		htmlData, err = v.convertToHTML(pdfData)
+		var exitErr *exec.ExitError
+		if err == nil || attempt >= v.opts.Retries || !errors.As(err, &exitErr) {
+			break
+		}
+		log.Printf("pdf2htmlEX failed (attempt %d of %d), retrying: %v", attempt+1, v.opts.Retries+1, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return v.extractHTML(htmlData)
+}
+
+// Convert a PDF file to HTML with pdf2htmlEX.
+func (v *Verifier) convertToHTML(pdfData []byte) ([]byte, error) {
+	// Sadly we have to write temporary files:
+	// https://github.com/coolwanglu/pdf2htmlEX/issues/638
+	//
+	// Every extraction gets its own temporary directory, so concurrent
+	// extractions can never collide. pdf2htmlEX (tested with 0.14.6) writes
+	// its output inside --dest-dir when given a relative output file name,
+	// and doesn't add an extension when one is given explicitly. To not
+	// depend on that, the output name already has the .html extension.
+	dir, err := ioutil.TempDir(v.opts.TmpDir, "duo-verified-")
+	if err != nil {
+		return nil, err
+	}
+	if !v.opts.KeepOutput {
+		// Remove temporary files after we're done with them (or at least try
+		// to).
+		defer os.RemoveAll(dir)
+	}
+	inpath := filepath.Join(dir, "input.pdf")
+	outname := "output.html"
+
+	err = ioutil.WriteFile(inpath, pdfData, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse documents with too many pages before converting them.
+	// Converting one page more than allowed is enough to notice when the
+	// page count in the PDF is wrong.
+	if pages, err := countPages(pdfData); err == nil && pages > v.opts.MaxPages {
+		return nil, &ExtractError{"too many pages in PDF", nil}
+	}
+	cmd := exec.Command("pdf2htmlEX",
+		"--process-nontext", "0", // don't extract images (faster!)
+		"--last-page", strconv.Itoa(v.opts.MaxPages+1),
+		"--dest-dir", dir,
+		inpath,  // input
+		outname) // output, relative to --dest-dir
+	// Always capture stderr, so failures can be diagnosed without debugging
+	// enabled.
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	if v.opts.Debug {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	}
+	v.checkVersion.Do(checkPDF2HTMLVersion)
+	start := time.Now()
+	err = cmd.Run()
+	v.logDuration("pdf2htmlEX", start)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			// Not an error exit status, so it couldn't be started.
+			err = fmt.Errorf("%w: %v", ErrExtractorUnavailable, err)
+		} else if summary := stderrSummary(stderr.buf.Bytes()); summary != "" {
+			err = fmt.Errorf("%w (stderr: %s)", err, summary)
+		}
+		return nil, &ExtractError{"run pdf2htmlEX", err}
+	}
+
+	outfile, err := os.Open(filepath.Join(dir, outname))
+	if err != nil {
+		return nil, &ExtractError{"read pdf2htmlEX output", err}
+	}
+	defer outfile.Close()
+
+	// Read at most MaxHTMLSize bytes: a small PDF may still expand to a huge
+	// HTML document. Read one byte more to detect whether the limit has been
+	// exceeded.
+	htmlData, err := ioutil.ReadAll(io.LimitReader(outfile, v.opts.MaxHTMLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(htmlData)) > v.opts.MaxHTMLSize {
+		return nil, &ExtractError{"pdf2htmlEX output exceeds maximum HTML size", nil}
+	}
+	return htmlData, nil
+}
+
+// Return the number of pages of a PDF document, as listed in its page tree.
+// Documents the PDF library can't read are left to pdf2htmlEX.
+func countPages(pdfData []byte) (pages int, err error) {
+	// The PDF library panics on some malformed documents.
+	defer func() {
+		if e := recover(); e != nil {
+			pages, err = 0, fmt.Errorf("malformed PDF: %v", e)
+		}
+	}()
+	doc, err := pdf.NewReader(bytes.NewReader(pdfData), int64(len(pdfData)))
+	if err != nil {
+		return 0, err
+	}
+	return doc.NumPage(), nil
+}
+
+// Maximum number of bytes of pdf2htmlEX stderr to capture, and to include in
+// errors.
+const (
+	maxStderr        = 64 * 1024
+	maxStderrSummary = 256
+)
+
+// A writer that keeps the first max bytes written to it and discards the rest.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.buf.Write(p[:remaining])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Summarize the stderr of a failed pdf2htmlEX run for an error message: the
+// last lines, which contain the actual error, truncated to maxStderrSummary
+// bytes. pdf2htmlEX and poppler report errors about the PDF structure, not its
+// text, but may quote raw bytes from the PDF, so anything but printable ASCII
+// is replaced to keep binary data out of logs.
+func stderrSummary(data []byte) string {
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > 3 {
+		lines = lines[len(lines)-3:]
+	}
+	summary := []byte(strings.Join(lines, "; "))
+	for i, c := range summary {
+		if c < ' ' || c > '~' {
+			summary[i] = '?'
+		}
+	}
+	if len(summary) > maxStderrSummary {
+		summary = append(summary[:maxStderrSummary], "..."...)
+	}
+	return string(summary)
+}
+
+// Extract the diplomas from the HTML produced by pdf2htmlEX.
+func (v *Verifier) extractHTML(htmlData []byte) ([]Diploma, []Warning, error) {
+	// Extract raw attributes from the HTML. These are the keys as used in the
+	// PDF document.
+	start := time.Now()
+	doc := soup.HTMLParse(string(htmlData))
+	v.logDuration("parse HTML", start)
+
+	// All pages are enclosed in an element with ID "page-container". The page
+	// container contains the individual PDF pages. It is a direct child of
+	// <body> in the tested pdf2htmlEX version, but newer versions may wrap it
+	// in other elements, so search the whole document.
+	container := doc.Find("div", "id", "page-container")
+	if container.Pointer == nil {
+		return nil, nil, &ExtractError{"cannot parse HTML: cannot find page container", nil}
+	}
+
+	defer v.logDuration("extract pages", time.Now())
+	diplomas := make([]Diploma, 0, 1)
+	var warnings warningList
+	numPages := 0
+	for _, page := range container.Children() {
+		if page.Pointer.Type != html.ElementNode {
+			continue
+		}
+		numPages++
+		if numPages > v.opts.MaxPages {
+			return nil, nil, &ExtractError{"too many pages in PDF", nil}
+		}
+		var previous *Diploma
+		if len(diplomas) != 0 {
+			previous = &diplomas[len(diplomas)-1]
+		}
+		warnings.page = numPages
+		diploma, err := v.extractSinglePage(page, previous, &warnings)
+		if err != nil {
+			return nil, nil, err
+		}
+		if diploma == nil {
+			continue // e.g. last page of a list of marks where no attributes exist
+		}
+		diplomas = append(diplomas, *diploma)
+	}
+	if v.degrees != nil {
+		// Only now, as the degree may come from an additional
+		// qualifications page.
+		warnings.page = 0
+		for i := range diplomas {
+			v.normalizeDegree(&diplomas[i], &warnings)
+		}
+	}
+	return diplomas, warnings.warnings, nil
+}
+
+// Labels that are present on every diploma page, used to recognize pages that
+// look like a diploma.
+var diplomaLabels = []string{"Achternaam", "Voorna(a)m(en)", "Geboortedatum", "Opleiding"}
+
+// Headings of pages with additional qualifications, which belong to the
+// diploma on the preceding page.
+var companionMarkers = map[string]bool{
+	"Aanvullende kwalificaties": true,
+	"Overige kwalificaties":     true,
+	"Additional qualifications": true,
+	"Other qualifications":      true,
+}
+
+// Headings of transcript pages, which belong to the diploma on the preceding
+// page.
+var transcriptMarkers = map[string]bool{
+	"Cijferlijst": true,
+}
+
+// Column headings on transcript pages, which aren't courses.
+var transcriptHeadings = map[string]bool{
+	"Vak":        true,
+	"Vakken":     true,
+	"Onderdeel":  true,
+	"Examenvak":  true,
+	"Cijfer":     true,
+	"Eindcijfer": true,
+	"Resultaat":  true,
+}
+
+// Marker text present on every diploma page, with the language of the extract
+// it appears in.
+var diplomaMarkers = map[string]string{
+	"Uittreksel uit het diplomaregister": "nl",
+	"Extract from the diploma register":  "en",
+}
+
+// Labels of English extracts, with the Dutch label they correspond to. Labels
+// are translated when the page is read, so everything else (including
+// Options.ContinuationLabels) only deals with the Dutch labels.
+var englishLabels = map[string]string{
+	"Surname":                "Achternaam",
+	"Prefix":                 "Tussenvoegsel",
+	"First name(s)":          "Voorna(a)m(en)",
+	"Gender":                 "Geslacht",
+	"Date of birth":          "Geboortedatum",
+	"Citizen service number": "Burgerservicenummer",
+	"Distinction":            "Judicium",
+	"Type of document":       "Soort waardedocument",
+	"Programme":              "Opleiding",
+	"Type of examination":    "Aard van het examen",
+	"Profile":                "Profiel",
+	"Obtained in":            "Behaald in",
+	"Obtained on":            "Behaald op",
+	"Institution":            "Instelling",
+}
+
+// Extract the diploma on a page. A page with additional qualifications is
+// merged into the previous diploma (if any) instead, see mergeCompanionPage.
+// Soft issues that don't prevent extraction are added to warnings.
+func (v *Verifier) extractSinglePage(page soup.Root, previous *Diploma, warnings *warningList) (*Diploma, error) {
+	validPage := false
+	language := ""
+	companionPage := false
+	transcriptPage := false
+	var rows [][]string // text of every row, for transcript pages
+	lastKey := ""
+	rawAttributes := make(map[string]string)
+	var institutes []string // all Instelling values, for joint degrees
+	for _, el := range page.FindAll("div") {
+		children := el.Children()
+		if texts := rowTexts(children); len(texts) != 0 {
+			rows = append(rows, texts)
+		}
+		if v.continuationLabels[lastKey] && len(children) == 1 && children[0].Pointer.Type == html.TextNode {
+			// Sometimes, a property continues on the next line.
+			// This is a heuristic to determine this case: when the previous row
+			// was a valid row of a property that is known to wrap and this row
+			// contains just a single value, it's probably a continuation. A
+			// value may span more than two rows.
+			rawAttributes[lastKey] += " " + strings.TrimSpace(children[0].NodeValue)
+			if lastKey == "Instelling" {
+				institutes[len(institutes)-1] = rawAttributes[lastKey]
+			}
+			continue
+		}
+		lastKey = "" // not a continuation
+
+		if len(children) == 1 && children[0].Pointer.Type == html.TextNode {
+			if lang, ok := diplomaMarkers[children[0].NodeValue]; ok {
+				validPage = true
+				language = lang
+			}
+			if companionMarkers[strings.TrimSpace(children[0].NodeValue)] {
+				companionPage = true
+			}
+			if transcriptMarkers[strings.TrimSpace(children[0].NodeValue)] {
+				transcriptPage = true
+			}
+		}
+
+		// A row has the key and value as outer text nodes, with one or more
+		// (spacing) elements in between.
+		if len(children) < 3 {
+			continue
+		}
+		last := children[len(children)-1]
+		if children[0].Pointer.Type != html.TextNode || last.Pointer.Type != html.TextNode {
+			continue
+		}
+
+		// This appears to be a valid property key
+		key := strings.TrimSpace(children[0].NodeValue)
+		if dutch, ok := englishLabels[key]; ok {
+			key = dutch
+		}
+		value := strings.TrimSpace(last.NodeValue)
+		rawAttributes[key] = value
+		lastKey = key
+		if key == "Instelling" {
+			institutes = append(institutes, value)
+		}
+	}
+
+	if !validPage && transcriptPage && v.opts.IncludeTranscript {
+		if previous == nil {
+			warnings.add("skipping transcript page without preceding diploma")
+			return nil, nil
+		}
+		previous.Transcript = append(previous.Transcript, parseTranscript(rows)...)
+		return nil, nil
+	}
+
+	if !validPage && companionPage {
+		if previous == nil {
+			warnings.add("skipping additional qualifications page without preceding diploma")
+			return nil, nil
+		}
+		mergeCompanionPage(previous, rawAttributes)
+		return nil, nil
+	}
+
+	if !validPage {
+		// No attributes found on this page. This is expected for e.g. the last
+		// page of a list of marks, but when the page has the structure of a
+		// diploma the marker text has probably changed and we'd silently drop
+		// the diploma.
+		for _, key := range diplomaLabels {
+			if _, ok := rawAttributes[key]; ok {
+				warnings.add("skipping page with diploma labels but without diploma marker")
+				break
+			}
+		}
+		return nil, nil
+	}
+
+	defer v.logDuration("map attributes", time.Now())
+
+	// Transform raw attributes in IRMA attributes, with standard names and
+	// value formatting.
+	diploma := &Diploma{}
+	if v.opts.IncludeLanguage {
+		diploma.Language = language
+	}
+	found := make(map[string]bool) // IRMA attribute names found on this page
+	var unknown UnknownLabelsError
+	set := func(name string, field *string, value string) {
+		*field = value
+		found[name] = true
+	}
+	for key, value := range rawAttributes {
+		switch key {
+		case "Achternaam":
+			set("familyname", &diploma.FamilyName, value)
+		case "Tussenvoegsel":
+			set("prefix", &diploma.Prefix, value)
+			diploma.PrefixPresent = true
+		case "Voorna(a)m(en)":
+			set("firstname", &diploma.FirstName, value)
+		case "Geslacht":
+			switch value {
+			case "Man", "Male":
+				set("gender", &diploma.Gender, "male")
+			case "Vrouw", "Female":
+				set("gender", &diploma.Gender, "female")
+			default:
+				set("gender", &diploma.Gender, "unknown")
+			}
+		case "Geboortedatum":
+			set("dateofbirth", &diploma.DateOfBirth, parseDutchDate(value)) // "" if parse error
+		case "Burgerservicenummer", "BSN":
+			// Only used to match against a disclosed identifier, not issued.
+			set("bsn", &diploma.BSN, value)
+		case "Judicium", "Predicaat":
+			if v.opts.IncludeDistinction {
+				diploma.Distinction = parseDistinction(value)
+			}
+		case "Soort waardedocument":
+			if v.opts.IncludeDocumentType {
+				diploma.DocumentType = parseDocumentType(value)
+			}
+		case "Opleiding":
+			set("education", &diploma.Education, value)
+			if v.opts.ParseEducationField {
+				diploma.EducationField = parseEducationField(value)
+			}
+		case "Aard van het examen":
+			// university etc. (e.g. WO Master)
+			set("degree", &diploma.Degree, value)
+		case "Profiel":
+			// high school (e.g. Nieuw Profiel Natuur en Techniek)
+			set("profile", &diploma.Profile, value)
+		case "Behaald in", "Behaald op":
+			date := parseDutchDate(value)
+			if date == "" {
+				date = parseDutchMonth(value)
+			}
+			if date == "" {
+				date = parseDutchPeriod(value)
+			}
+			if date == "" {
+				warnings.add("cannot parse date in " + key)
+				if v.opts.Debug {
+					fmt.Printf("Cannot parse date: %s\n", value)
+				}
+			}
+			set("achieved", &diploma.Achieved, date) // "" if parse error
+		case "Instelling":
+			// Handled below, as there may be more than one.
+		default:
+			if key != "" {
+				warnings.add("unknown label " + strconv.Quote(key))
+				unknown = append(unknown, key)
+			}
+			if v.opts.Debug && key != "" {
+				fmt.Printf("Unknown property: %s = %s\n", key, value)
+			}
+		}
+	}
+
+	for _, value := range institutes {
+		// Format: <name> in <city>
+		// where <city> is in all caps.
+		in := strings.LastIndex(value, " in ")
+		if in < 0 {
+			warnings.add("cannot parse institute")
+			continue
+		}
+		diploma.Institutes = append(diploma.Institutes, strings.TrimSpace(value[:in]))
+		diploma.Cities = append(diploma.Cities, strings.TrimSpace(value[in+4:])) // all uppercase
+	}
+	if len(diploma.Institutes) != 0 {
+		// A joint degree lists multiple institutes. Issue the first one
+		// (usually the awarding institute), or all of them when configured.
+		institute, city := diploma.Institutes[0], diploma.Cities[0]
+		if v.opts.InstituteSeparator != "" {
+			institute = strings.Join(diploma.Institutes, v.opts.InstituteSeparator)
+			city = strings.Join(diploma.Cities, v.opts.InstituteSeparator)
+		}
+		set("institute", &diploma.Institute, institute)
+		set("city", &diploma.City, city)
+	}
+
+	if v.opts.StrictLabels && len(unknown) != 0 {
+		sort.Strings(unknown)
+		return nil, &ExtractError{"unknown labels", unknown}
+	}
+
+	var missing MissingAttributesError
+	for key := range v.requiredAttributes {
+		if !found[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, &ExtractError{"cannot find attributes", missing}
+	}
+
+	return diploma, nil
+}
+
+// Return the non-empty text nodes of a row, in order.
+func rowTexts(children []soup.Root) []string {
+	var texts []string
+	for _, child := range children {
+		if child.Pointer.Type != html.TextNode {
+			continue
+		}
+		if text := strings.TrimSpace(child.NodeValue); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+// Parse the rows of a transcript page into courses. A course row has the
+// course name as first and the grade as last text, possibly with other
+// columns (e.g. the year) in between. Headings and other rows with a single
+// text are skipped.
+func parseTranscript(rows [][]string) []Course {
+	var courses []Course
+	for _, texts := range rows {
+		if len(texts) < 2 || transcriptHeadings[texts[0]] || transcriptHeadings[texts[len(texts)-1]] {
+			continue
+		}
+		courses = append(courses, Course{Name: texts[0], Grade: texts[len(texts)-1]})
+	}
+	return courses
+}
+
+// Merge the rows of an additional qualifications page into the diploma it
+// belongs to. Only the optional degree and profile are taken from such a page,
+// and only when the diploma doesn't have them yet: the diploma page itself is
+// always leading, and other rows (e.g. endorsements) aren't issued.
+func mergeCompanionPage(diploma *Diploma, rawAttributes map[string]string) {
+	for key, value := range rawAttributes {
+		switch key {
+		case "Aard van het examen":
+			if diploma.Degree == "" {
+				diploma.Degree = value
+			}
+		case "Profiel":
+			if diploma.Profile == "" {
+				diploma.Profile = value
+			}
+		}
+	}
+}
+
+// List of Dutch months, as used in diploma dates.
+var dutchMonths = map[string]int{
+	"januari":   1,
+	"februari":  2,
+	"maart":     3,
+	"april":     4,
+	"mei":       5,
+	"juni":      6,
+	"juli":      7,
+	"augustus":  8,
+	"september": 9,
+	"oktober":   10,
+	"november":  11,
+	"december":  12,
+}
+
+// List of English months, as used in dates on English extracts.
+var englishMonths = map[string]int{
+	"january":   1,
+	"february":  2,
+	"march":     3,
+	"april":     4,
+	"may":       5,
+	"june":      6,
+	"july":      7,
+	"august":    8,
+	"september": 9,
+	"october":   10,
+	"november":  11,
+	"december":  12,
+}
+
+// Return the number of a Dutch or English month name in any case, or 0 when
+// it isn't a month.
+func monthNumber(name string) int {
+	name = strings.ToLower(name)
+	if month, ok := dutchMonths[name]; ok {
+		return month
+	}
+	return englishMonths[name]
+}
+
+// Parse a Dutch date in the form "3 maart 1990", or the English "3 March
+// 1990".
+func parseDutchDate(indate string) string {
+	parts := strings.Fields(indate)
+	if len(parts) != 3 {
+		return ""
+	}
+	day, _ := strconv.Atoi(parts[0])
+	month := monthNumber(parts[1])
+	year, _ := strconv.Atoi(parts[2])
+	if day == 0 || month == 0 || year == 0 {
+		return "" // something went wrong
+	}
+	return fmt.Sprintf("%02d-%02d-%04d", day, month, year)
+}
+
+// Parse a Dutch month in the form "Augustus 2016", or the English "August
+// 2016".
+func parseDutchMonth(indate string) string {
+	parts := strings.Fields(indate)
+	if len(parts) != 2 {
+		return ""
+	}
+	month := monthNumber(parts[0])
+	year, _ := strconv.Atoi(parts[1])
+	if month == 0 || year == 0 {
+		return "" // something went wrong
+	}
+	// Pick the first day of the month.
+	return fmt.Sprintf("01-%02d-%04d", month, year)
+}
+
+// First month of the seasons, using the meteorological seasons.
+var dutchSeasons = map[string]int{
+	"voorjaar": 3,
+	"lente":    3,
+	"zomer":    6,
+	"najaar":   9,
+	"herfst":   9,
+	"winter":   12,
+}
+
+// Dutch ordinals as used in "1e semester" or "derde kwartaal".
+var dutchOrdinals = map[string]int{
+	"1e": 1, "1ste": 1, "eerste": 1,
+	"2e": 2, "2de": 2, "tweede": 2,
+	"3e": 3, "3de": 3, "derde": 3,
+	"4e": 4, "4de": 4, "vierde": 4,
+}
+
+// Parse a Dutch period in the form "najaar 2016", "1e semester 2017" or
+// "3e kwartaal 2017". Like parseDutchMonth, this picks the first day of the
+// period. Semesters and quarters are halves and quarters of the calendar year,
+// as the extract doesn't say whether an academic year is meant.
+func parseDutchPeriod(indate string) string {
+	parts := strings.Fields(strings.ToLower(indate))
+	var month int
+	switch len(parts) {
+	case 2:
+		month = dutchSeasons[parts[0]]
+	case 3:
+		n := dutchOrdinals[parts[0]]
+		switch {
+		case n == 0:
+		case parts[1] == "semester" && n <= 2:
+			month = 1 + (n-1)*6
+		case parts[1] == "kwartaal":
+			month = 1 + (n-1)*3
+		}
+	}
+	if month == 0 {
+		return ""
+	}
+	year, _ := strconv.Atoi(parts[len(parts)-1])
+	if year == 0 {
+		return "" // something went wrong
+	}
+	return fmt.Sprintf("01-%02d-%04d", month, year)
+}
+
+// Set the normalized degree of a diploma from its degree. Unknown degrees are
+// passed through as-is.
+func (v *Verifier) normalizeDegree(diploma *Diploma, warnings *warningList) {
+	if diploma.Degree == "" {
+		return
+	}
+	degree, ok := v.degrees[degreeKey(diploma.Degree)]
+	if !ok {
+		warnings.add("unknown degree " + strconv.Quote(diploma.Degree))
+		degree = diploma.Degree
+	}
+	diploma.NormalizedDegree = degree
+}
+
+// Key to look up a degree in the normalization table.
+func degreeKey(degree string) string {
+	return strings.ToLower(strings.Join(strings.Fields(degree), " "))
+}
+
+// Normalize the type of document ("Soort waardedocument", or "Type of
+// document" on English extracts) to a small vocabulary: "original",
+// "duplicate", "statement" or "other".
+func parseDocumentType(value string) string {
+	value = strings.ToLower(value)
+	switch {
+	case strings.Contains(value, "duplica"): // duplicaat, duplicate
+		return "duplicate"
+	case strings.Contains(value, "verklaring"), strings.Contains(value, "statement"), strings.Contains(value, "declaration"):
+		return "statement"
+	case strings.Contains(value, "diploma"), strings.Contains(value, "getuigschrift"), strings.Contains(value, "certifica"): // certificaat, certificate
+		return "original"
+	default:
+		return "other"
+	}
+}
+
+// Normalize a distinction ("Judicium" or "Predicaat") to a small vocabulary:
+// "summa-cum-laude", "cum-laude", "with-merit" or "other". Returns "" when the
+// diploma has no distinction, including "met goed gevolg", which only means
+// the exam was passed.
+func parseDistinction(value string) string {
+	value = strings.ToLower(strings.Join(strings.Fields(value), " "))
+	switch {
+	case value == "", value == "geen", value == "-", strings.HasPrefix(value, "met goed gevolg"):
+		return ""
+	case strings.Contains(value, "summa cum laude"), strings.Contains(value, "met de hoogste lof"):
+		return "summa-cum-laude"
+	case strings.Contains(value, "cum laude"), strings.Contains(value, "met lof"):
+		return "cum-laude"
+	case strings.Contains(value, "met genoegen"):
+		return "with-merit"
+	default:
+		return "other"
+	}
+}
+
+// Level prefixes in education names, e.g. "B Informatica" or "Master Rechten".
+var educationLevelPrefixes = []string{
+	"associate degree ",
+	"bachelor ",
+	"master ",
+	"ad ",
+	"ba ",
+	"ma ",
+	"b ",
+	"m ",
+}
+
+// Matches a level suffix in (MBO) education names, e.g. "Kok (niveau 2)".
+var educationLevelSuffix = regexp.MustCompile(`\s*\(niveau \d\)$`)
+
+// Parse the field of study from an education name by removing a level prefix
+// or suffix, e.g. "B Technische Informatica" becomes "Technische Informatica".
+// Returns "" if there is no recognizable level.
+func parseEducationField(education string) string {
+	lower := strings.ToLower(education)
+	for _, prefix := range educationLevelPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return strings.TrimSpace(education[len(prefix):])
+		}
+	}
+	if loc := educationLevelSuffix.FindStringIndex(lower); loc != nil {
+		return strings.TrimSpace(education[:loc[0]])
+	}
+	return ""
+}
+
+// Words that are not capitalized in Dutch place names, unless they're the
+// first word (e.g. "Bergen op Zoom", but "Den Haag").
+var dutchParticles = map[string]bool{
+	"aan":   true,
+	"bij":   true,
+	"de":    true,
+	"den":   true,
+	"der":   true,
+	"en":    true,
+	"het":   true,
+	"in":    true,
+	"onder": true,
+	"op":    true,
+	"over":  true,
+	"ten":   true,
+	"ter":   true,
+	"van":   true,
+}
+
+// TitleCase converts an (all uppercase) Dutch name, like a city on a diploma,
+// to title case: "DEN HAAG" becomes "Den Haag", "'S-HERTOGENBOSCH" becomes
+// "'s-Hertogenbosch" and "IJMUIDEN" becomes "IJmuiden".
+func TitleCase(name string) string {
+	words := strings.Fields(strings.ToLower(name))
+	for i, word := range words {
+		parts := strings.Split(word, "-")
+		for j, part := range parts {
+			if (i != 0 || j != 0) && dutchParticles[part] ||
+				part == "'s" || part == "'t" {
+				continue
+			}
+			if strings.HasPrefix(part, "ij") {
+				parts[j] = "IJ" + part[2:]
+				continue
+			}
+			runes := []rune(part)
+			if len(runes) != 0 {
+				runes[0] = unicode.ToUpper(runes[0])
+			}
+			parts[j] = string(runes)
+		}
+		words[i] = strings.Join(parts, "-")
+	}
+	return strings.Join(words, " ")
+}
+
+// Parse a PDF date in the form "D:YYYYMMDDHHmmSSOHH'mm'", where all parts
+// after the year are optional.
+func parsePDFDate(s string) (time.Time, error) {
+	s = strings.TrimPrefix(s, "D:")
+	date, zone := s, ""
+	if i := strings.IndexAny(s, "Z+-"); i >= 0 {
+		date, zone = s[:i], s[i:]
+	}
+	if len(date) < 4 || len(date) > 14 || len(date)%2 != 0 {
+		return time.Time{}, errors.New("cannot parse date: " + s)
+	}
+	date += "0101000000"[len(date)-4:] // fill in defaults for missing parts
+
+	location := time.UTC
+	if zone != "" && zone != "Z" {
+		offset := strings.Replace(zone[1:], "'", "", -1)
+		if len(offset) == 2 {
+			offset += "00"
+		}
+		if len(offset) != 4 {
+			return time.Time{}, errors.New("cannot parse time zone: " + zone)
+		}
+		hours, err1 := strconv.Atoi(offset[:2])
+		minutes, err2 := strconv.Atoi(offset[2:])
+		if err1 != nil || err2 != nil {
+			return time.Time{}, errors.New("cannot parse time zone: " + zone)
+		}
+		seconds := (hours*60 + minutes) * 60
+		if zone[0] == '-' {
+			seconds = -seconds
+		}
+		location = time.FixedZone("", seconds)
+	}
+	return time.ParseInLocation("20060102150405", date, location)
+}
+
+// LoadCertificate loads an X.509 certificate from a file in PEM format.
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	intermediaryData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(intermediaryData)
+	if block == nil {
+		return nil, errors.New("failed to read PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// The pdf2htmlEX version the HTML parsing was tested with. Other versions may
+// produce different markup.
+const testedPDF2HTMLVersion = "0.14.6"
+
+var pdf2htmlVersionRegexp = regexp.MustCompile(`pdf2htmlEX version (\S+)`)
+
+// Warn when pdf2htmlEX is a different version than the one the HTML parsing
+// was tested with, as extraction may then fail or miss attributes.
+func checkPDF2HTMLVersion() {
+	output, err := exec.Command("pdf2htmlEX", "--version").CombinedOutput()
+	if err != nil {
+		return // running pdf2htmlEX itself will report the problem
+	}
+	match := pdf2htmlVersionRegexp.FindSubmatch(output)
+	if match == nil {
+		log.Println("WARNING: cannot determine pdf2htmlEX version, tested with", testedPDF2HTMLVersion)
+		return
+	}
+	if string(match[1]) != testedPDF2HTMLVersion {
+		log.Printf("WARNING: pdf2htmlEX version %s is untested, extraction was tested with %s", match[1], testedPDF2HTMLVersion)
+	}
+}
+
+// Load all parent certificates from DUO in the given directories. Multiple
+// directories can be used to trust both the current and the upcoming
+// certificates while they are being rotated. Certificates present in more than
+// one directory are only added once.
+func LoadCertPool(dirs ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	seen := make(map[[sha256.Size]byte]bool)
+	for _, dir := range dirs {
+		pattern := dir + "/*.pem"
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, &ExtractError{"read certificate dir", err}
+		}
+		for _, path := range paths {
+			parentCert, err := LoadCertificate(path)
+			if err != nil {
+				return nil, &ExtractError{"load parent certificate at " + path, err}
+			}
+			hash := sha256.Sum256(parentCert.Raw)
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+
+			// Use these certificates as root (really, pinned) certificates.
+			pool.AddCert(parentCert)
+		}
+	}
+	if len(seen) == 0 {
+		return nil, &ExtractError{"no certificates found in " + strings.Join(dirs, ", "), nil}
+	}
+	return pool, nil
+}
+
+// Print how long a phase of the verification and extraction took, in debug
+// mode.
+func (v *Verifier) logDuration(phase string, start time.Time) {
+	if v.opts.Debug {
+		fmt.Printf("timing: %s took %s\n", phase, time.Since(start))
+	}
+}
+
+// Signature describes the verified signature of a PDF extract.
+type Signature struct {
+	// Certificate the PDF is signed with, or of the timestamping authority
+	// for a document timestamp. May be nil when it cannot be determined.
+	Signer *x509.Certificate
+
+	// Time the PDF was signed at, as used to check the certificates: from the
+	// signature timestamp with Options.TSARoots, otherwise as asserted by the
+	// signer, or the time of verification when the signature has none.
+	SigningTime time.Time
+}
+
+// Result of verifying and extracting a PDF extract.
+type Result struct {
+	Diplomas  []Diploma
+	Warnings  []Warning  // about anything that looked off during extraction
+	Signature *Signature // nil with Options.SkipVerification
+}
+
+// VerifyAndExtract takes PDF data in as a byte array, verifies it, and returns
+// the diplomas in it, together with warnings about anything that looked off
+// during extraction. A verification failure will result in an error.
+func (v *Verifier) VerifyAndExtract(pdfData []byte) ([]Diploma, []Warning, error) {
+	result, err := v.VerifyAndExtractResult(pdfData)
+	if result == nil {
+		return nil, nil, err
+	}
+	return result.Diplomas, result.Warnings, err
+}
+
+// VerifyAndExtractResult is like VerifyAndExtract, but also returns the
+// verified signature. When the extracted diplomas are invalid, the result with
+// only the warnings is returned together with the error.
+func (v *Verifier) VerifyAndExtractResult(pdfData []byte) (*Result, error) {
+	defer v.logDuration("verify and extract", time.Now())
+	verifiedData := pdfData
+	var signature *Signature
+	if v.opts.SkipVerification {
+		log.Println("WARNING: not verifying PDF signature, extracted attributes cannot be trusted!")
+	} else {
+		var err error
+		start := time.Now()
+		verifiedData, signature, err = v.verifyPDF(pdfData)
+		v.logDuration("verify PDF", start)
+		if err != nil {
+			return nil, &ExtractError{"verify PDF", err}
+		}
+	}
+
+	diplomas, warnings, err := v.extractor.Extract(verifiedData)
+	if err != nil {
+		return nil, &ExtractError{"extract attributes", err}
+	}
+	diplomas, err = v.validateAll(diplomas)
+	if err != nil {
+		return &Result{Warnings: warnings}, err
+	}
+	return &Result{Diplomas: diplomas, Warnings: warnings, Signature: signature}, nil
+}
+
+// ExtractHTML returns the diplomas in HTML as produced by pdf2htmlEX from a PDF
+// extract. The PDF signature is not verified at all, so this must only be used
+// for testing the extraction, e.g. with synthetic fixtures.
+func (v *Verifier) ExtractHTML(htmlData []byte) ([]Diploma, []Warning, error) {
+	diplomas, warnings, err := v.extractHTML(htmlData)
+	if err != nil {
+		return nil, nil, &ExtractError{"extract attributes", err}
+	}
+	diplomas, err = v.validateAll(diplomas)
+	return diplomas, warnings, err
+}
+
+// Validate all extracted diplomas, returning them when they are valid.
+func (v *Verifier) validateAll(diplomas []Diploma) ([]Diploma, error) {
+	for i := range diplomas {
+		if err := v.validate(&diplomas[i]); err != nil {
+			return nil, err
+		}
+	}
+	return diplomas, nil
+}
@@ -0,0 +1,653 @@
+package duo
+
+import (
+	"crypto/x509"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Build pdf2htmlEX-like HTML with a page for each of the given pages. Each
+// page is a list of rows: a single string is a line of text, two strings are
+// a label and its value, and more strings are the columns of a table row.
+func testHTML(pages ...[][]string) []byte {
+	var b strings.Builder
+	b.WriteString(`<html><body><div id="page-container">`)
+	for _, page := range pages {
+		b.WriteString(`<div class="pf">`)
+		for _, row := range page {
+			b.WriteString("<div>" + strings.Join(row, `<span class="_"> </span>`) + "</div>")
+		}
+		b.WriteString("</div>")
+	}
+	b.WriteString("</div></body></html>")
+	return []byte(b.String())
+}
+
+// Rows of a Dutch diploma page, extracted as testPageDiploma.
+var testPageRows = [][]string{
+	{"Uittreksel uit het diplomaregister"},
+	{"Achternaam", "Jansen"},
+	{"Voorna(a)m(en)", "Jan"},
+	{"Geslacht", "Man"},
+	{"Geboortedatum", "3 maart 1990"},
+	{"Opleiding", "M Informatica"},
+	{"Aard van het examen", "WO Master"},
+	{"Behaald op", "31 augustus 2016"},
+	{"Instelling", "Radboud Universiteit in NIJMEGEN"},
+}
+
+// Build the rows of a diploma page from testPageRows. A row with a label on
+// the page replaces it, with any further strings as continuation rows after
+// it, a label alone removes its row, and other rows are appended.
+func diplomaPage(rows ...[]string) [][]string {
+	page := append([][]string{}, testPageRows...)
+	for _, row := range rows {
+		i := 1
+		for i < len(page) && page[i][0] != row[0] {
+			i++
+		}
+		switch {
+		case i == len(page):
+			page = append(page, row)
+		case len(row) == 1:
+			page = append(page[:i], page[i+1:]...)
+		default:
+			replaced := [][]string{row[:2]}
+			for _, text := range row[2:] {
+				replaced = append(replaced, []string{text})
+			}
+			page = append(page[:i], append(replaced, page[i+1:]...)...)
+		}
+	}
+	return page
+}
+
+// The diploma on a page from diplomaPage, after applying modify (if any).
+func testPageDiploma(modify func(d *Diploma)) Diploma {
+	d := Diploma{
+		FamilyName:  "Jansen",
+		FirstName:   "Jan",
+		Gender:      "male",
+		DateOfBirth: "03-03-1990",
+		Education:   "M Informatica",
+		Degree:      "WO Master",
+		Achieved:    "31-08-2016",
+		Institute:   "Radboud Universiteit",
+		City:        "NIJMEGEN",
+		Institutes:  []string{"Radboud Universiteit"},
+		Cities:      []string{"NIJMEGEN"},
+	}
+	if modify != nil {
+		modify(&d)
+	}
+	return d
+}
+
+// Rows of a transcript page, extracted as testTranscript.
+var testTranscriptPage = [][]string{
+	{"Cijferlijst"},
+	{"Vak", "Jaar", "Cijfer"},
+	{"Nederlands", "2015", "7"},
+	{"Wiskunde B", "2016", "8,5"},
+	{"Profielwerkstuk", "voldoende"},
+	{"Gemiddeld cijfer"},
+}
+
+var testTranscript = []Course{
+	{"Nederlands", "7"},
+	{"Wiskunde B", "8,5"},
+	{"Profielwerkstuk", "voldoende"},
+}
+
+// The heuristics used to read diploma pages.
+func TestExtractSinglePage(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		pages    [][][]string
+		want     []Diploma
+		warnings []string // messages, without the page
+		err      string   // when extraction fails, the error
+	}{
+		{"plain", Options{}, [][][]string{diplomaPage()}, []Diploma{testPageDiploma(nil)}, nil, ""},
+		{"wrapped institute", Options{},
+			[][][]string{diplomaPage([]string{"Instelling", "Hogeschool van Arnhem en", "Nijmegen in NIJMEGEN"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) {
+				d.Institute, d.Institutes = "Hogeschool van Arnhem en Nijmegen", []string{"Hogeschool van Arnhem en Nijmegen"}
+			})}, nil, ""},
+		{"institute wrapped twice", Options{},
+			[][][]string{diplomaPage([]string{"Instelling", "Stichting Hogeschool", "van Arnhem en Nijmegen", "in NIJMEGEN"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) {
+				d.Institute, d.Institutes = "Stichting Hogeschool van Arnhem en Nijmegen", []string{"Stichting Hogeschool van Arnhem en Nijmegen"}
+			})}, nil, ""},
+		{"wrapped education", Options{ContinuationLabels: []string{"Opleiding", "Instelling"}},
+			[][][]string{diplomaPage([]string{"Opleiding", "M Informatica en", "Informatiekunde"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Education = "M Informatica en Informatiekunde" })}, nil, ""},
+		{"wrapped education, not configured", Options{},
+			[][][]string{diplomaPage([]string{"Opleiding", "M Informatica en", "Informatiekunde"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Education = "M Informatica en" })}, nil, ""},
+		{"no continuation labels", Options{ContinuationLabels: []string{}},
+			[][][]string{diplomaPage([]string{"Instelling", "Radboud Universiteit", "in NIJMEGEN"})},
+			nil, []string{"cannot parse institute"}, "cannot find attributes: city, institute"},
+		{"blank family name", Options{}, [][][]string{diplomaPage([]string{"Achternaam", " "})},
+			nil, nil, "empty attributes: familyname"},
+		{"blank fields", Options{}, [][][]string{diplomaPage([]string{"Voorna(a)m(en)", " "}, []string{"Opleiding", " "})},
+			nil, nil, "empty attributes: education, firstname"},
+		{"unparseable date of birth", Options{}, [][][]string{diplomaPage([]string{"Geboortedatum", "3 brumaire 1990"})},
+			nil, nil, "empty attributes: dateofbirth"},
+		{"blank optional degree", Options{}, [][][]string{diplomaPage([]string{"Aard van het examen", " "})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Degree = "" })}, nil, ""},
+		{"blank degree, required", Options{RequiredAttributes: append([]string{"degree"}, DefaultRequiredAttributes...)},
+			[][][]string{diplomaPage([]string{"Aard van het examen", " "})},
+			nil, nil, "empty attributes: degree"},
+		{"missing gender", Options{}, [][][]string{diplomaPage([]string{"Geslacht"})},
+			nil, nil, "cannot find attributes: gender"},
+		{"missing gender, not required", Options{RequiredAttributes: []string{"familyname", "firstname", "dateofbirth", "education", "achieved"}},
+			[][][]string{diplomaPage([]string{"Geslacht"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Gender = "" })}, nil, ""},
+		{"blank institute, not required", Options{RequiredAttributes: []string{"familyname", "firstname", "dateofbirth", "education", "achieved"}},
+			[][][]string{diplomaPage([]string{"Instelling", " "})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Institute, d.City, d.Institutes, d.Cities = "", "", nil, nil })},
+			[]string{"cannot parse institute"}, ""},
+		{"nothing required", Options{RequiredAttributes: []string{}},
+			[][][]string{diplomaPage([]string{"Geslacht"}, []string{"Behaald op", " "})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Gender, d.Achieved = "", "" })},
+			[]string{"cannot parse date in Behaald op"}, ""},
+		{"same diploma on two pages", Options{}, [][][]string{diplomaPage(), diplomaPage()},
+			[]Diploma{testPageDiploma(nil), testPageDiploma(nil)}, nil, ""},
+		{"two diplomas", Options{}, [][][]string{diplomaPage(), diplomaPage([]string{"Opleiding", "B Informatica"}, []string{"Aard van het examen", "WO Bachelor"})},
+			[]Diploma{testPageDiploma(nil), testPageDiploma(func(d *Diploma) { d.Education, d.Degree = "B Informatica", "WO Bachelor" })}, nil, ""},
+		{"additional qualifications page", Options{},
+			[][][]string{diplomaPage([]string{"Aard van het examen"}), {
+				{"Aanvullende kwalificaties"},
+				{"Aard van het examen", "WO Master"},
+				{"Profiel", "Onderzoek"},
+				{"Aantekening", "Eerstegraads lesbevoegdheid"},
+			}},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Profile = "Onderzoek" })}, nil, ""},
+		{"additional qualifications page, diploma leading", Options{},
+			[][][]string{diplomaPage(), {{"Overige kwalificaties"}, {"Aard van het examen", "WO Bachelor"}}},
+			[]Diploma{testPageDiploma(nil)}, nil, ""},
+		{"English additional qualifications page", Options{},
+			[][][]string{diplomaPage([]string{"Aard van het examen"}), {{"Additional qualifications"}, {"Aard van het examen", "WO Master"}}},
+			[]Diploma{testPageDiploma(nil)}, nil, ""},
+		{"additional qualifications pages for two diplomas", Options{},
+			[][][]string{
+				diplomaPage([]string{"Aard van het examen"}), {{"Aanvullende kwalificaties"}, {"Aard van het examen", "WO Master"}},
+				diplomaPage([]string{"Opleiding", "B Informatica"}, []string{"Aard van het examen"}), {{"Aanvullende kwalificaties"}, {"Aard van het examen", "WO Bachelor"}},
+			},
+			[]Diploma{testPageDiploma(nil), testPageDiploma(func(d *Diploma) { d.Education, d.Degree = "B Informatica", "WO Bachelor" })}, nil, ""},
+		{"additional qualifications page without diploma", Options{},
+			[][][]string{{{"Aanvullende kwalificaties"}, {"Aard van het examen", "WO Master"}}, diplomaPage()},
+			[]Diploma{testPageDiploma(nil)}, []string{"skipping additional qualifications page without preceding diploma"}, ""},
+		{"prefix", Options{}, [][][]string{diplomaPage([]string{"Tussenvoegsel", "de"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Prefix, d.PrefixPresent = "de", true })}, nil, ""},
+		{"empty prefix", Options{}, [][][]string{diplomaPage([]string{"Tussenvoegsel", " "})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.PrefixPresent = true })}, nil, ""},
+		{"no diploma pages", Options{},
+			[][][]string{{{"Uittreksel uit het register onderwijsdeelnemers"}, {"Naam", "J. Jansen"}, {"Inschrijving", "Radboud Universiteit"}}, {{"Pagina 2 van 2"}}},
+			[]Diploma{}, nil, ""},
+		{"no pages", Options{}, nil, []Diploma{}, nil, ""},
+		{"city kept as written", Options{}, [][][]string{diplomaPage([]string{"Instelling", "De Haagse Hogeschool in 'S-GRAVENHAGE"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) {
+				d.Institute, d.City = "De Haagse Hogeschool", "'S-GRAVENHAGE"
+				d.Institutes, d.Cities = []string{d.Institute}, []string{d.City}
+			})}, nil, ""},
+		{"joint degree", Options{},
+			[][][]string{append(diplomaPage(), []string{"Instelling", "Universiteit Utrecht in UTRECHT"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) {
+				d.Institutes, d.Cities = []string{"Radboud Universiteit", "Universiteit Utrecht"}, []string{"NIJMEGEN", "UTRECHT"}
+			})}, nil, ""},
+		{"joint degree, joined", Options{InstituteSeparator: "; "},
+			[][][]string{append(diplomaPage(), []string{"Instelling", "Universiteit Utrecht in UTRECHT"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) {
+				d.Institute, d.City = "Radboud Universiteit; Universiteit Utrecht", "NIJMEGEN; UTRECHT"
+				d.Institutes, d.Cities = []string{"Radboud Universiteit", "Universiteit Utrecht"}, []string{"NIJMEGEN", "UTRECHT"}
+			})}, nil, ""},
+		{"joint degree, wrapped", Options{InstituteSeparator: "; "},
+			[][][]string{append(diplomaPage(), []string{"Instelling", "Technische Universiteit"}, []string{"Eindhoven in EINDHOVEN"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) {
+				d.Institute, d.City = "Radboud Universiteit; Technische Universiteit Eindhoven", "NIJMEGEN; EINDHOVEN"
+				d.Institutes, d.Cities = []string{"Radboud Universiteit", "Technische Universiteit Eindhoven"}, []string{"NIJMEGEN", "EINDHOVEN"}
+			})}, nil, ""},
+		{"joint degree, unparseable", Options{InstituteSeparator: "; "},
+			[][][]string{append(diplomaPage(), []string{"Instelling", "Universiteit Utrecht"})},
+			[]Diploma{testPageDiploma(nil)}, []string{"cannot parse institute"}, ""},
+		{"unknown label", Options{}, [][][]string{diplomaPage([]string{"Handtekening", "J. de Directeur"})},
+			[]Diploma{testPageDiploma(nil)}, []string{`unknown label "Handtekening"`}, ""},
+		{"unknown labels, strict", Options{StrictLabels: true},
+			[][][]string{diplomaPage([]string{"Stempel", "Radboud Universiteit"}, []string{"Handtekening", "J. de Directeur"})},
+			nil, nil, "unknown labels: Handtekening, Stempel"},
+		{"known optional labels, strict", Options{StrictLabels: true},
+			[][][]string{diplomaPage([]string{"Judicium", "cum laude"}, []string{"Soort waardedocument", "Diploma"}, []string{"Profiel", "Onderzoek"})},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Profile = "Onderzoek" })}, nil, ""},
+		{"transcript", Options{IncludeTranscript: true}, [][][]string{diplomaPage(), testTranscriptPage},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Transcript = testTranscript })}, nil, ""},
+		{"transcript over two pages", Options{IncludeTranscript: true}, [][][]string{diplomaPage(), testTranscriptPage[:4], append([][]string{{"Cijferlijst"}}, testTranscriptPage[4:]...)},
+			[]Diploma{testPageDiploma(func(d *Diploma) { d.Transcript = testTranscript })}, nil, ""},
+		{"transcript, not configured", Options{}, [][][]string{diplomaPage(), testTranscriptPage},
+			[]Diploma{testPageDiploma(nil)}, nil, ""},
+		{"transcript without diploma", Options{IncludeTranscript: true}, [][][]string{testTranscriptPage, diplomaPage()},
+			[]Diploma{testPageDiploma(nil)}, []string{"skipping transcript page without preceding diploma"}, ""},
+	}
+	for _, tc := range tests {
+		v := New(x509.NewCertPool(), tc.opts)
+		diplomas, warnings, err := v.ExtractHTML(testHTML(tc.pages...))
+		if tc.err != "" {
+			if err == nil || !strings.HasSuffix(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(diplomas, tc.want) {
+			t.Errorf("%s: got diplomas\n%+v\nwant\n%+v", tc.name, diplomas, tc.want)
+		}
+		var messages []string
+		for _, warning := range warnings {
+			messages = append(messages, warning.Message)
+		}
+		if !reflect.DeepEqual(messages, tc.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", tc.name, messages, tc.warnings)
+		}
+	}
+}
+
+func TestExtractLanguages(t *testing.T) {
+	want := Diploma{
+		FamilyName:  "Jansen",
+		FirstName:   "Jan",
+		Gender:      "male",
+		DateOfBirth: "03-03-1990",
+		Education:   "M Informatica",
+		Degree:      "WO Master",
+		Achieved:    "31-08-2016",
+		Institute:   "Radboud Universiteit",
+		City:        "NIJMEGEN",
+	}
+	tests := []struct {
+		language string
+		page     [][]string
+	}{
+		{"nl", [][]string{
+			{"Uittreksel uit het diplomaregister"},
+			{"Achternaam", "Jansen"},
+			{"Voorna(a)m(en)", "Jan"},
+			{"Geslacht", "Man"},
+			{"Geboortedatum", "3 maart 1990"},
+			{"Opleiding", "M Informatica"},
+			{"Aard van het examen", "WO Master"},
+			{"Behaald op", "31 augustus 2016"},
+			{"Instelling", "Radboud Universiteit in NIJMEGEN"},
+		}},
+		{"en", [][]string{
+			{"Extract from the diploma register"},
+			{"Surname", "Jansen"},
+			{"First name(s)", "Jan"},
+			{"Gender", "Male"},
+			{"Date of birth", "3 March 1990"},
+			{"Programme", "M Informatica"},
+			{"Type of examination", "WO Master"},
+			{"Obtained on", "31 August 2016"},
+			{"Institution", "Radboud Universiteit"},
+			{"in NIJMEGEN"},
+		}},
+	}
+	v := New(x509.NewCertPool(), Options{IncludeLanguage: true})
+	for _, tc := range tests {
+		diplomas, warnings, err := v.extractHTML(testHTML(tc.page))
+		if err != nil {
+			t.Errorf("%s: %v", tc.language, err)
+			continue
+		}
+		if len(warnings) != 0 {
+			t.Errorf("%s: unexpected warnings %v", tc.language, warnings)
+		}
+		if len(diplomas) != 1 {
+			t.Errorf("%s: got %d diplomas, want 1", tc.language, len(diplomas))
+			continue
+		}
+		got := diplomas[0]
+		if got.Language != tc.language {
+			t.Errorf("%s: got language %q", tc.language, got.Language)
+		}
+		gotAttributes, wantAttributes := got.Attributes(), want.Attributes()
+		wantAttributes["language"] = tc.language
+		for name, value := range wantAttributes {
+			if gotAttributes[name] != value {
+				t.Errorf("%s: got %s %q, want %q", tc.language, name, gotAttributes[name], value)
+			}
+		}
+		for name := range gotAttributes {
+			if _, ok := wantAttributes[name]; !ok {
+				t.Errorf("%s: unexpected attribute %s", tc.language, name)
+			}
+		}
+	}
+}
+
+// A page with diploma labels but without a known marker is skipped with a
+// warning, in either language.
+func TestExtractWithoutMarker(t *testing.T) {
+	v := New(x509.NewCertPool(), Options{})
+	for _, label := range []string{"Achternaam", "Surname"} {
+		diplomas, warnings, err := v.extractHTML(testHTML([][]string{{label, "Jansen"}}))
+		if err != nil || len(diplomas) != 0 || len(warnings) != 1 {
+			t.Errorf("%s: got %d diplomas, warnings %v, error %v", label, len(diplomas), warnings, err)
+		}
+	}
+}
+
+func TestTitleCase(t *testing.T) {
+	tests := []struct {
+		city, want string
+	}{
+		{"NIJMEGEN", "Nijmegen"},
+		{"DEN HAAG", "Den Haag"},
+		{"DE BILT", "De Bilt"},
+		{"BERGEN OP ZOOM", "Bergen op Zoom"},
+		{"ALPHEN AAN DEN RIJN", "Alphen aan den Rijn"},
+		{"WIJK BIJ DUURSTEDE", "Wijk bij Duurstede"},
+		{"KRIMPEN AAN DEN IJSSEL", "Krimpen aan den IJssel"},
+		{"IJMUIDEN", "IJmuiden"},
+		{"'S-HERTOGENBOSCH", "'s-Hertogenbosch"},
+		{"'S GRAVENHAGE", "'s Gravenhage"},
+		{"'T ZANDT", "'t Zandt"},
+		{"HENDRIK-IDO-AMBACHT", "Hendrik-Ido-Ambacht"},
+		{"OUD-BEIJERLAND", "Oud-Beijerland"},
+		{"ÜBACH OVER WORMS", "Übach over Worms"},
+		{"  NIJMEGEN  ", "Nijmegen"},
+		{"Nijmegen", "Nijmegen"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		if got := TitleCase(tc.city); got != tc.want {
+			t.Errorf("TitleCase(%q) = %q, want %q", tc.city, got, tc.want)
+		}
+	}
+}
+
+func TestParseDutchDates(t *testing.T) {
+	tests := []struct {
+		parse func(string) string
+		value string
+		want  string
+	}{
+		{parseDutchMonth, "augustus 2016", "01-08-2016"},
+		{parseDutchMonth, "Augustus 2016", "01-08-2016"},
+		{parseDutchMonth, "AUGUSTUS 2016", "01-08-2016"},
+		{parseDutchMonth, "Mei 2010", "01-05-2010"},
+		{parseDutchMonth, "August 2016", "01-08-2016"},
+		{parseDutchMonth, "  juli   2010 ", "01-07-2010"},
+		{parseDutchMonth, "Augustu 2016", ""},
+		{parseDutchMonth, "augustus", ""},
+		{parseDutchMonth, "augustus twee", ""},
+		{parseDutchMonth, "31 augustus 2016", ""},
+		{parseDutchDate, "3 maart 1990", "03-03-1990"},
+		{parseDutchDate, "3 Maart 1990", "03-03-1990"},
+		{parseDutchDate, "31 DECEMBER 1999", "31-12-1999"},
+		{parseDutchDate, "3 March 1990", "03-03-1990"},
+		{parseDutchDate, "3 maart", ""},
+		{parseDutchDate, "drie maart 1990", ""},
+		{parseDutchPeriod, "najaar 2016", "01-09-2016"},
+		{parseDutchPeriod, "Najaar 2016", "01-09-2016"},
+		{parseDutchPeriod, "2e Semester 2017", "01-07-2017"},
+		{parseDutchPeriod, "Derde Kwartaal 2017", "01-07-2017"},
+		{parseDutchPeriod, "3e semester 2017", ""},
+	}
+	for _, tc := range tests {
+		if got := tc.parse(tc.value); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.value, got, tc.want)
+		}
+	}
+}
+
+// The field of study is only split off common programme names with a level.
+func TestExtractEducationField(t *testing.T) {
+	tests := []struct {
+		education string
+		field     string
+	}{
+		{"M Informatica", "Informatica"},
+		{"B Technische Bedrijfskunde", "Technische Bedrijfskunde"},
+		{"Master Rechtsgeleerdheid", "Rechtsgeleerdheid"},
+		{"Bachelor Rechtsgeleerdheid", "Rechtsgeleerdheid"},
+		{"BA Geschiedenis", "Geschiedenis"},
+		{"MA Geschiedenis", "Geschiedenis"},
+		{"Associate degree Ondernemen", "Ondernemen"},
+		{"Ad Ondernemen", "Ondernemen"},
+		{"Kok (niveau 2)", "Kok"},
+		{"Geneeskunde", ""},
+		{"Bedrijfskunde", ""},
+	}
+	for _, parse := range []bool{false, true} {
+		v := New(x509.NewCertPool(), Options{ParseEducationField: parse})
+		for _, tc := range tests {
+			diplomas, _, err := v.ExtractHTML(testHTML(diplomaPage([]string{"Opleiding", tc.education})))
+			if err != nil {
+				t.Errorf("%s: %v", tc.education, err)
+				continue
+			}
+			want := testPageDiploma(func(d *Diploma) { d.Education = tc.education })
+			if parse {
+				want.EducationField = tc.field
+			}
+			if !reflect.DeepEqual(diplomas, []Diploma{want}) {
+				t.Errorf("%s, parsing %v: got %+v", tc.education, parse, diplomas)
+			}
+		}
+	}
+}
+
+// The type of document is normalized to a small vocabulary, and only
+// extracted when configured.
+func TestExtractDocumentType(t *testing.T) {
+	tests := []struct {
+		value        string
+		documentType string
+	}{
+		{"Diploma", "original"},
+		{"Getuigschrift", "original"},
+		{"Certificaat", "original"},
+		{"Duplicaat diploma", "duplicate"},
+		{"DUPLICAAT", "duplicate"},
+		{"Verklaring", "statement"},
+		{"Verklaring omtrent diploma", "statement"},
+		{"Onbekend", "other"},
+		{"Certificate", "original"},
+		{"Duplicate diploma", "duplicate"},
+		{"Statement", "statement"},
+	}
+	for _, include := range []bool{false, true} {
+		v := New(x509.NewCertPool(), Options{IncludeDocumentType: include})
+		for _, tc := range tests {
+			diplomas, warnings, err := v.ExtractHTML(testHTML(diplomaPage([]string{"Soort waardedocument", tc.value})))
+			if err != nil || len(warnings) != 0 {
+				t.Errorf("%s: got warnings %v, error %v", tc.value, warnings, err)
+				continue
+			}
+			want := testPageDiploma(nil)
+			if include {
+				want.DocumentType = tc.documentType
+			}
+			if !reflect.DeepEqual(diplomas, []Diploma{want}) {
+				t.Errorf("%s, including %v: got %+v", tc.value, include, diplomas)
+			}
+		}
+	}
+}
+
+// An absent and an empty prefix give the same family name and attributes.
+func TestExtractPrefix(t *testing.T) {
+	tests := []struct {
+		name           string
+		page           [][]string
+		fullFamilyName string
+		prefix         string // issued attribute, not issued when empty
+	}{
+		{"absent", diplomaPage(), "Jansen", ""},
+		{"empty", diplomaPage([]string{"Tussenvoegsel", " "}), "Jansen", ""},
+		{"present", diplomaPage([]string{"Tussenvoegsel", "de"}), "de Jansen", "de"},
+	}
+	v := New(x509.NewCertPool(), Options{})
+	for _, tc := range tests {
+		diplomas, _, err := v.ExtractHTML(testHTML(tc.page))
+		if err != nil || len(diplomas) != 1 {
+			t.Errorf("%s: got %d diplomas, error %v", tc.name, len(diplomas), err)
+			continue
+		}
+		if got := diplomas[0].FullFamilyName(); got != tc.fullFamilyName {
+			t.Errorf("%s: got full family name %q, want %q", tc.name, got, tc.fullFamilyName)
+		}
+		prefix, issued := diplomas[0].Attributes()["prefix"]
+		if prefix != tc.prefix || issued != (tc.prefix != "") {
+			t.Errorf("%s: got prefix attribute %q, issued %v", tc.name, prefix, issued)
+		}
+	}
+}
+
+// The distinctions DUO uses are normalized, and only extracted when
+// configured.
+func TestExtractDistinction(t *testing.T) {
+	tests := []struct {
+		label, value string
+		distinction  string
+	}{
+		{"Judicium", "cum laude", "cum-laude"},
+		{"Judicium", "Cum Laude", "cum-laude"},
+		{"Judicium", "met lof", "cum-laude"},
+		{"Judicium", "summa cum laude", "summa-cum-laude"},
+		{"Judicium", "met de hoogste lof", "summa-cum-laude"},
+		{"Judicium", "met genoegen", "with-merit"},
+		{"Predicaat", "Met genoegen", "with-merit"},
+		{"Predicaat", "met goed gevolg", ""},
+		{"Predicaat", "Met goed gevolg afgelegd", ""},
+		{"Judicium", "geen", ""},
+		{"Judicium", "-", ""},
+		{"Judicium", "bene meritum", "other"},
+		{"Distinction", "cum laude", "cum-laude"},
+	}
+	for _, include := range []bool{false, true} {
+		v := New(x509.NewCertPool(), Options{IncludeDistinction: include})
+		for _, tc := range tests {
+			diplomas, warnings, err := v.ExtractHTML(testHTML(diplomaPage([]string{tc.label, tc.value})))
+			if err != nil || len(warnings) != 0 {
+				t.Errorf("%s %q: got warnings %v, error %v", tc.label, tc.value, warnings, err)
+				continue
+			}
+			want := testPageDiploma(nil)
+			if include {
+				want.Distinction = tc.distinction
+			}
+			if !reflect.DeepEqual(diplomas, []Diploma{want}) {
+				t.Errorf("%s %q, including %v: got %+v", tc.label, tc.value, include, diplomas)
+			}
+		}
+	}
+}
+
+// The achieved date is read from exact dates, months and the Dutch periods
+// DUO uses, picking the first day of a month or period.
+func TestExtractAchieved(t *testing.T) {
+	tests := []struct {
+		label, value string
+		achieved     string // empty when the date cannot be parsed
+	}{
+		{"Behaald op", "31 augustus 2016", "31-08-2016"},
+		{"Behaald in", "augustus 2016", "01-08-2016"},
+		{"Behaald in", "voorjaar 2016", "01-03-2016"},
+		{"Behaald in", "lente 2016", "01-03-2016"},
+		{"Behaald in", "zomer 2016", "01-06-2016"},
+		{"Behaald in", "najaar 2016", "01-09-2016"},
+		{"Behaald in", "Herfst 2016", "01-09-2016"},
+		{"Behaald in", "winter 2016", "01-12-2016"},
+		{"Behaald in", "1e semester 2017", "01-01-2017"},
+		{"Behaald in", "2de semester 2017", "01-07-2017"},
+		{"Behaald in", "eerste kwartaal 2017", "01-01-2017"},
+		{"Behaald in", "3e kwartaal 2017", "01-07-2017"},
+		{"Behaald in", "4de kwartaal 2017", "01-10-2017"},
+		{"Obtained in", "autumn 2016", ""},
+		{"Behaald in", "studiejaar 2016/2017", ""},
+		{"Behaald in", "5e kwartaal 2017", ""},
+	}
+	v := New(x509.NewCertPool(), Options{})
+	for _, tc := range tests {
+		page := diplomaPage([]string{"Behaald op"}, []string{tc.label, tc.value})
+		diplomas, warnings, err := v.ExtractHTML(testHTML(page))
+		if tc.achieved == "" {
+			if err == nil || len(warnings) != 1 || warnings[0].Message != "cannot parse date in Behaald in" {
+				t.Errorf("%s %q: got warnings %v, error %v", tc.label, tc.value, warnings, err)
+			}
+			continue
+		}
+		if err != nil || len(warnings) != 0 {
+			t.Errorf("%s %q: got warnings %v, error %v", tc.label, tc.value, warnings, err)
+			continue
+		}
+		if diplomas[0].Achieved != tc.achieved {
+			t.Errorf("%s %q: got %q, want %q", tc.label, tc.value, diplomas[0].Achieved, tc.achieved)
+		}
+	}
+}
+
+// Common degrees are normalized, unknown ones pass through with a warning.
+func TestExtractNormalizedDegree(t *testing.T) {
+	tests := []struct {
+		degree     string
+		normalized string
+		warning    bool
+	}{
+		{"WO Bachelor", "wo-bachelor", false},
+		{"WO Master", "wo-master", false},
+		{"WO Doctoraal", "wo-master", false},
+		{"HBO Associate degree", "hbo-associate", false},
+		{"HBO Bachelor", "hbo-bachelor", false},
+		{"HBO Master", "hbo-master", false},
+		{"wo  master", "wo-master", false},
+		{"MBO niveau 4", "mbo-4", false}, // from DegreeNormalization
+		{"HBO Propedeuse", "HBO Propedeuse", true},
+	}
+	v := New(x509.NewCertPool(), Options{NormalizeDegree: true, DegreeNormalization: map[string]string{"MBO Niveau 4": "mbo-4"}})
+	for _, tc := range tests {
+		diplomas, warnings, err := v.ExtractHTML(testHTML(diplomaPage([]string{"Aard van het examen", tc.degree})))
+		if err != nil {
+			t.Errorf("%s: %v", tc.degree, err)
+			continue
+		}
+		want := testPageDiploma(func(d *Diploma) { d.Degree, d.NormalizedDegree = tc.degree, tc.normalized })
+		if !reflect.DeepEqual(diplomas, []Diploma{want}) {
+			t.Errorf("%s: got %+v", tc.degree, diplomas)
+		}
+		var wantWarnings []Warning
+		if tc.warning {
+			wantWarnings = []Warning{{Message: "unknown degree " + strconv.Quote(tc.degree)}}
+		}
+		if !reflect.DeepEqual(warnings, wantWarnings) {
+			t.Errorf("%s: got warnings %v", tc.degree, warnings)
+		}
+	}
+
+	// Without a degree, there is nothing to normalize.
+	diplomas, warnings, err := v.ExtractHTML(testHTML(diplomaPage([]string{"Aard van het examen"})))
+	if err != nil || len(warnings) != 0 || diplomas[0].NormalizedDegree != "" {
+		t.Errorf("without degree: got %+v, warnings %v, error %v", diplomas, warnings, err)
+	}
+}
+
+// The transcript is issued as a JSON list of courses with their grades.
+func TestTranscriptAttribute(t *testing.T) {
+	d := testPageDiploma(func(d *Diploma) { d.Transcript = testTranscript })
+	want := `[{"course":"Nederlands","grade":"7"},{"course":"Wiskunde B","grade":"8,5"},{"course":"Profielwerkstuk","grade":"voldoende"}]`
+	if got := d.Attributes()["transcript"]; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	d = testPageDiploma(nil)
+	if _, ok := d.Attributes()["transcript"]; ok {
+		t.Error("transcript issued without courses")
+	}
+}
@@ -0,0 +1,21 @@
+package duo
+
+// Extractor extracts the diplomas from a PDF of which the signature has been
+// verified, so the verification can be reused for other signed PDFs. Only the
+// verified (signed) parts of the PDF are passed. Soft issues that don't
+// prevent extraction are returned as warnings. Extracted diplomas are
+// validated against Options.RequiredAttributes afterwards.
+type Extractor interface {
+	Extract(verifiedPDF []byte) ([]Diploma, []Warning, error)
+}
+
+// DUOExtractor extracts diplomas from extracts of the DUO diploma register, by
+// converting them to HTML with pdf2htmlEX and parsing that, using the options
+// of its Verifier. It is the default Extractor.
+type DUOExtractor struct {
+	verifier *Verifier
+}
+
+func (e DUOExtractor) Extract(verifiedPDF []byte) ([]Diploma, []Warning, error) {
+	return e.verifier.extractAttributes(verifiedPDF)
+}
@@ -0,0 +1,258 @@
+package duo
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An Extractor that returns fixed diplomas, to test the seam without
+// pdf2htmlEX.
+type stubExtractor struct {
+	diplomas []Diploma
+	err      error
+	input    []byte
+}
+
+func (e *stubExtractor) Extract(verifiedPDF []byte) ([]Diploma, []Warning, error) {
+	e.input = verifiedPDF
+	return e.diplomas, []Warning{{Page: 1, Message: "stub"}}, e.err
+}
+
+// A diploma with all DefaultRequiredAttributes.
+func testDiploma() Diploma {
+	return Diploma{
+		FamilyName:  "Jansen",
+		FirstName:   "Jan",
+		Gender:      "male",
+		DateOfBirth: "01-02-1990",
+		Education:   "Master Informatica",
+		Achieved:    "31-08-2015",
+		Institute:   "Universiteit Utrecht",
+		City:        "UTRECHT",
+	}
+}
+
+func TestExtractorOption(t *testing.T) {
+	pdfData := []byte("%PDF-1.4 stub")
+	for _, tc := range []struct {
+		name     string
+		diplomas []Diploma
+		err      error
+		wantErr  bool
+		want     int
+	}{
+		{"diplomas", []Diploma{testDiploma(), testDiploma()}, nil, false, 2},
+		{"no diplomas", nil, nil, false, 0},
+		{"extractor error", nil, errors.New("broken"), true, 0},
+		{"invalid diploma", []Diploma{{FamilyName: "Jansen"}}, nil, true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			extractor := &stubExtractor{diplomas: tc.diplomas, err: tc.err}
+			v := New(x509.NewCertPool(), Options{SkipVerification: true, Extractor: extractor})
+			result, err := v.VerifyAndExtractResult(pdfData)
+			if !bytes.Equal(extractor.input, pdfData) {
+				t.Errorf("extractor got %q, want %q", extractor.input, pdfData)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Diplomas) != tc.want {
+				t.Errorf("got %d diplomas, want %d", len(result.Diplomas), tc.want)
+			}
+			if len(result.Warnings) != 1 || result.Warnings[0].Message != "stub" {
+				t.Errorf("warnings not passed on: %v", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestDefaultExtractor(t *testing.T) {
+	v := New(x509.NewCertPool(), Options{})
+	if _, ok := v.extractor.(DUOExtractor); !ok {
+		t.Errorf("default extractor is %T, want DUOExtractor", v.extractor)
+	}
+}
+
+// Put a fake pdf2htmlEX on PATH, running the given shell script (after
+// handling --version). The script can use $dir, the directory of the fake
+// binary.
+func fakePDF2HTML(t *testing.T, script string) string {
+	dir := t.TempDir()
+	script = `#!/bin/sh
+if [ "$1" = --version ]; then echo "pdf2htmlEX version 0.14.6"; exit 0; fi
+dir=$(dirname "$0")
+` + script
+	if err := os.WriteFile(filepath.Join(dir, "pdf2htmlEX"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+// A failing pdf2htmlEX has the last lines of its stderr in the error, made
+// printable and truncated, with the exit error still wrapped.
+func TestConvertToHTMLStderr(t *testing.T) {
+	fakePDF2HTML(t, `echo "Preprocessing: 1/1" >&2
+echo "Working: 0/1" >&2
+printf 'Error: \001bad object\n\n' >&2
+echo "`+strings.Repeat("x", 300)+`" >&2
+exit 3
+`)
+	v := New(x509.NewCertPool(), Options{})
+	_, err := v.convertToHTML([]byte("%PDF-1.4 stub"))
+
+	summary := "Working: 0/1; Error: ?bad object; "
+	summary += strings.Repeat("x", maxStderrSummary-len(summary)) + "..."
+	if err == nil || !strings.Contains(err.Error(), "(stderr: "+summary+")") {
+		t.Errorf("got error %v, want stderr %q", err, summary)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("exit error not wrapped in %v", err)
+	}
+	var extractErr *ExtractError
+	if !errors.As(err, &extractErr) || errors.Is(err, ErrExtractorUnavailable) {
+		t.Errorf("got %T %v, want an ExtractError for a failed run", err, err)
+	}
+}
+
+// pdf2htmlEX is run again when it fails, unless retries are disabled.
+func TestExtractRetry(t *testing.T) {
+	page := testHTML([][]string{
+		{"Uittreksel uit het diplomaregister"},
+		{"Achternaam", "Jansen"},
+		{"Voorna(a)m(en)", "Jan"},
+		{"Geslacht", "Man"},
+		{"Geboortedatum", "3 maart 1990"},
+		{"Opleiding", "M Informatica"},
+		{"Behaald op", "31 augustus 2016"},
+		{"Instelling", "Radboud Universiteit in NIJMEGEN"},
+	})
+	// Fails on the first run only, counting the runs in $dir/runs.
+	script := `echo run >> "$dir/runs"
+if [ ! -e "$dir/failed" ]; then
+	touch "$dir/failed"
+	echo "Segmentation fault" >&2
+	exit 139
+fi
+while [ $# -gt 1 ]; do
+	if [ "$1" = --dest-dir ]; then dest=$2; fi
+	shift
+done
+cp "$dir/page.html" "$dest/$1"
+`
+	for _, tc := range []struct {
+		name    string
+		retries int
+		runs    int
+		wantErr bool
+	}{
+		{"retried", 1, 2, false},
+		{"without retries", -1, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := fakePDF2HTML(t, script)
+			if err := os.WriteFile(filepath.Join(dir, "page.html"), page, 0644); err != nil {
+				t.Fatal(err)
+			}
+			v := New(x509.NewCertPool(), Options{Retries: tc.retries})
+			diplomas, _, err := v.extractAttributes([]byte("%PDF-1.4 stub"))
+			if tc.wantErr != (err != nil) || !tc.wantErr && len(diplomas) != 1 {
+				t.Errorf("got %d diplomas, error %v", len(diplomas), err)
+			}
+			runs, _ := os.ReadFile(filepath.Join(dir, "runs"))
+			if n := bytes.Count(runs, []byte("\n")); n != tc.runs {
+				t.Errorf("pdf2htmlEX ran %d times, want %d", n, tc.runs)
+			}
+		})
+	}
+}
+
+// An unsigned PDF with the given number of empty pages.
+func pagesPDF(pages int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := []int{0}
+	writeObject := func(obj string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets)-1, obj)
+	}
+	var kids []string
+	for i := 0; i < pages; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", i+3))
+	}
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages))
+	for i := 0; i < pages; i++ {
+		writeObject("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>")
+	}
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets))
+	for _, offset := range offsets[1:] {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets), xrefOffset)
+	return buf.Bytes()
+}
+
+// Documents with more than MaxPages pages are refused before pdf2htmlEX runs,
+// which converts at most one page more than MaxPages, and the HTML it
+// produces is limited to MaxHTMLSize.
+func TestConvertToHTMLLimits(t *testing.T) {
+	// Records its arguments in $dir/args, and writes 100 bytes of HTML.
+	script := `echo "$@" > "$dir/args"
+while [ $# -gt 1 ]; do
+	if [ "$1" = --dest-dir ]; then dest=$2; fi
+	shift
+done
+printf '%0100d' 0 > "$dest/$1"
+`
+	for _, tc := range []struct {
+		name        string
+		pages       int
+		maxHTMLSize int64
+		run         bool   // whether pdf2htmlEX must run
+		err         string // empty when the conversion must succeed
+	}{
+		{"within limits", 2, 100, true, ""},
+		{"too many pages", 3, 100, false, "too many pages in PDF"},
+		{"too much HTML", 2, 99, true, "pdf2htmlEX output exceeds maximum HTML size"},
+		{"unreadable PDF", 0, 100, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := fakePDF2HTML(t, script)
+			v := New(x509.NewCertPool(), Options{MaxPages: 2, MaxHTMLSize: tc.maxHTMLSize})
+			pdfData := []byte("%PDF-1.4 stub")
+			if tc.pages != 0 {
+				pdfData = pagesPDF(tc.pages)
+			}
+			htmlData, err := v.convertToHTML(pdfData)
+			if tc.err == "" && (err != nil || len(htmlData) != 100) {
+				t.Errorf("got %d bytes, error %v", len(htmlData), err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("got error %v, want %s", err, tc.err)
+			}
+			args, err := os.ReadFile(filepath.Join(dir, "args"))
+			if run := err == nil; run != tc.run {
+				t.Fatalf("pdf2htmlEX ran: %v, want %v", run, tc.run)
+			}
+			if tc.run && !strings.Contains(string(args), "--last-page 3 ") {
+				t.Errorf("pdf2htmlEX run with %s", args)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package duo
+
+// This file contains verification of RFC 3161 timestamp tokens, as used in
+// PAdES document timestamps and as signature timestamps in CMS signatures.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"time"
+
+	"github.com/mastahyeti/cms/protocol"
+)
+
+// Unsigned attribute of a CMS signer with a timestamp token over the
+// signature (id-aa-signatureTimeStampToken, RFC 3161 appendix A).
+var oidSignatureTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+
+// Content type of a timestamp token (id-ct-TSTInfo, RFC 3161 section 2.4.2).
+var oidTSTInfo = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+// TSTInfo as defined in RFC 3161, section 2.4.2. Only the fields we need are
+// included, the rest is ignored while parsing.
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   asn1.RawValue
+	GenTime        time.Time `asn1:"generalized"`
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// Hash functions that may be used in a message imprint.
+var timestampHashes = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// verifyTimestampToken verifies that the given timestamp token is signed by a
+// trusted certificate and covers the given message, returning an error on any
+// error (including verification failure).
+func (v *Verifier) verifyTimestampToken(tokenData []byte, msg []byte, signingTime time.Time) (*x509.Certificate, error) {
+	info, cert, err := v.parseTimestampToken(tokenData, v.pool, signingTime)
+	if err != nil {
+		return nil, err
+	}
+	return cert, checkMessageImprint(info, msg)
+}
+
+// signatureTimestamp verifies the signature timestamp embedded in the given
+// CMS signature against the trusted timestamping authorities, and returns the
+// time at which the signature was timestamped.
+func (v *Verifier) signatureTimestamp(sigData []byte) (time.Time, error) {
+	cmsLock.Lock()
+	ci, err := protocol.ParseContentInfo(sigData)
+	cmsLock.Unlock()
+	if err != nil {
+		return time.Time{}, err
+	}
+	sd, err := ci.SignedDataContent()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return time.Time{}, errors.New("signatureTimestamp: expected exactly one signer")
+	}
+	signer := sd.SignerInfos[0]
+	token, err := signer.UnsignedAttrs.GetOnlyAttributeValueBytes(oidSignatureTimeStampToken)
+	if err != nil {
+		return time.Time{}, errors.New("signatureTimestamp: cannot find signature timestamp: " + err.Error())
+	}
+
+	// The certificates of the timestamping authority must have been valid
+	// at the time of the timestamp itself.
+	info, _, err := v.parseTimestampToken(token.FullBytes, v.opts.TSARoots, time.Time{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := checkMessageImprint(info, signer.Signature); err != nil {
+		return time.Time{}, err
+	}
+	return info.GenTime, nil
+}
+
+// Check that the timestamp covers the given message.
+func checkMessageImprint(info *tstInfo, msg []byte) error {
+	hash, ok := timestampHashes[info.MessageImprint.HashAlgorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		return errors.New("verifyTimestampToken: unsupported hash algorithm")
+	}
+	hashInst := hash.New()
+	hashInst.Write(msg)
+	if !bytes.Equal(hashInst.Sum(nil), info.MessageImprint.HashedMessage) {
+		return errors.New("verifyTimestampToken: could not verify timestamp: hash doesn't match")
+	}
+	return nil
+}
+
+// parseTimestampToken verifies the signature of a timestamp token against the
+// given roots and returns the TSTInfo it contains and the certificate it is
+// signed with. The certificates are
+// checked at the given signing time, or at the time of the timestamp when it
+// is zero.
+func (v *Verifier) parseTimestampToken(tokenData []byte, roots *x509.CertPool, signingTime time.Time) (*tstInfo, *x509.Certificate, error) {
+	sig, err := parseSignedData(tokenData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := timestampContent(tokenData)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &tstInfo{}
+	_, err = asn1.Unmarshal(data, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	if signingTime.IsZero() {
+		signingTime = info.GenTime
+	}
+
+	var chains [][][]*x509.Certificate
+	err = v.verifyChain(func(verifyOpts x509.VerifyOptions) error {
+		var err error
+		chains, err = sig.Verify(verifyOpts)
+		return err
+	}, roots, x509.ExtKeyUsageTimeStamping, signingTime)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, signerCertificate(chains), nil
+}
+
+// Return the DER-encoded TSTInfo of a timestamp token. The cms package only
+// returns content of type id-data.
+func timestampContent(tokenData []byte) ([]byte, error) {
+	cmsLock.Lock()
+	defer cmsLock.Unlock()
+	ci, err := protocol.ParseContentInfo(tokenData)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := ci.SignedDataContent()
+	if err != nil {
+		return nil, err
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, errors.New("parseTimestampToken: not a timestamp token")
+	}
+	return sd.EncapContentInfo.EContentValue()
+}
+
+// Return the CMS signature without its signature timestamps. The cms package
+// would verify them against the roots of the signature itself, while
+// signatureTimestamp verifies them against Options.TSARoots (and they are
+// ignored without it). Unsigned attributes aren't covered by the signature, so
+// it still verifies without them.
+func withoutSignatureTimestamps(sigData []byte) ([]byte, error) {
+	cmsLock.Lock()
+	defer cmsLock.Unlock()
+	ci, err := protocol.ParseContentInfo(sigData)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := ci.SignedDataContent()
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for i := range sd.SignerInfos {
+		var attrs protocol.Attributes
+		for _, attr := range sd.SignerInfos[i].UnsignedAttrs {
+			if attr.Type.Equal(oidSignatureTimeStampToken) {
+				found = true
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		sd.SignerInfos[i].UnsignedAttrs = attrs
+	}
+	if !found {
+		return sigData, nil
+	}
+	return sd.ContentInfoDER()
+}
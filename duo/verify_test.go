@@ -0,0 +1,910 @@
+package duo
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mastahyeti/cms"
+	"github.com/mastahyeti/cms/oid"
+	"github.com/mastahyeti/cms/protocol"
+)
+
+// Signing time of the test PDFs, within the validity of the test certificates.
+var testSigningTime = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// A test certificate with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Create a certificate with a P-256 key for the given subject and extended
+// key usages, signed by the parent or self-signed when the parent is nil.
+func newTestCert(t testing.TB, subject string, parent *testCert, isCA bool, notBefore, notAfter time.Time, extKeyUsage ...x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestCertWithKey(t, subject, parent, isCA, notBefore, notAfter, key, extKeyUsage...)
+}
+
+// Like newTestCert, with the given key.
+func newTestCertWithKey(t testing.TB, subject string, parent *testCert, isCA bool, notBefore, notAfter time.Time, key crypto.Signer, extKeyUsage ...x509.ExtKeyUsage) *testCert {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: subject},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signerCert, signerKey := template, crypto.Signer(key)
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+// A root, an intermediate signed by the root, and a leaf signed by the
+// intermediate, created once for all tests.
+var (
+	testCertsOnce                            sync.Once
+	testRoot, testIntermediate, testLeaf     *testCert
+	testSelfSigned, testExpired, testUnknown *testCert
+	testEmailSigner, testServer              *testCert
+)
+
+func testCerts(t testing.TB) {
+	testCertsOnce.Do(func() {
+		notBefore := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		notAfter := time.Date(2039, 1, 1, 0, 0, 0, 0, time.UTC)
+		testRoot = newTestCert(t, "Test DUO root", nil, true, notBefore, notAfter)
+		testIntermediate = newTestCert(t, "Test DUO intermediate", testRoot, true, notBefore, notAfter)
+		testLeaf = newTestCert(t, "Test DUO signer", testIntermediate, false, notBefore, notAfter)
+		testSelfSigned = newTestCert(t, "Test self-signed DUO signer", nil, false, notBefore, notAfter)
+		testExpired = newTestCert(t, "Test expired DUO signer", nil, false, notBefore, testSigningTime.Add(-time.Hour))
+		testUnknown = newTestCert(t, "Test unknown signer", nil, false, notBefore, notAfter)
+		testEmailSigner = newTestCert(t, "Test DUO email signer", testIntermediate, false, notBefore, notAfter, x509.ExtKeyUsageEmailProtection)
+		testServer = newTestCert(t, "Test TLS server", testIntermediate, false, notBefore, notAfter, x509.ExtKeyUsageServerAuth)
+	})
+}
+
+func certPool(certs ...*testCert) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c.cert)
+	}
+	return pool
+}
+
+// Size of the signature placeholder, in bytes (hex encoded in the PDF).
+const testSignatureSize = 4096
+
+// A signed test PDF, built by build.
+type testPDF struct {
+	subfilter string // adbe.pkcs7.detached when empty
+	signer    *testCert
+	chain     []*x509.Certificate                               // embedded in the signature, signer.cert when nil
+	byteRange func(contentsStart, contentsEnd, size int) string // replaces the real byte ranges
+	trailer   string                                            // appended after the signed data
+
+	// Encrypt dictionary referenced from the trailer, as in a
+	// password-protected PDF. Only used without objectStream.
+	encrypt string
+
+	// Add an RFC 3161 signature timestamp at testTimestampTime from this
+	// timestamping authority.
+	tsa *testCert
+
+	// Store the catalog in an object stream, with a cross-reference stream
+	// instead of a cross-reference table.
+	objectStream bool
+
+	// With objectStream, write a hybrid-reference file: a cross-reference
+	// table for the objects outside the object stream, with the
+	// cross-reference stream in XRefStm.
+	hybrid bool
+
+	// Rows of text on a single page, like the rows of testHTML. Only used
+	// without objectStream.
+	page [][]string
+}
+
+// Build the PDF: a catalog with a signature in Perms/DocMDP, signed over the
+// byte ranges around the Contents string.
+func (p testPDF) build(t testing.TB) []byte {
+	subfilter := p.subfilter
+	if subfilter == "" {
+		subfilter = "adbe.pkcs7.detached"
+	}
+	placeholder := strings.Repeat("0", 2*testSignatureSize)
+	sigDict := "<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /" + subfilter +
+		" /M (D:" + testSigningTime.Format("20060102150405") + "Z)" +
+		" /ByteRange [0 0000000000 0000000000 0000000000] /Contents <" + placeholder + "> >>"
+	catalog := "<< /Type /Catalog /Pages 2 0 R /Perms << /DocMDP 3 0 R >> >>"
+	pages := "<< /Type /Pages /Kids [] /Count 0 >>"
+	if p.page != nil {
+		pages = "<< /Type /Pages /Kids [4 0 R] /Count 1 >>"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n")
+	offsets := make([]int, 8)
+	writeObject := func(id int, obj string) {
+		offsets[id] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", id, obj)
+	}
+	if p.objectStream {
+		// Objects 1 and 2 in object stream 4, and an uncompressed
+		// cross-reference stream as object 5.
+		header := fmt.Sprintf("1 0 2 %d ", len(catalog)+1)
+		content := header + catalog + "\n" + pages + "\n"
+		writeObject(3, sigDict)
+		writeObject(4, fmt.Sprintf("<< /Type /ObjStm /N 2 /First %d /Length %d >>\nstream\n%sendstream", len(header), len(content), content))
+		xrefOffset := buf.Len()
+		var entries bytes.Buffer
+		entry := func(typ byte, field2, field3 int) {
+			entries.Write([]byte{typ, byte(field2 >> 24), byte(field2 >> 16), byte(field2 >> 8), byte(field2), byte(field3)})
+		}
+		entry(0, 0, 255)
+		entry(2, 4, 0)
+		entry(2, 4, 1)
+		entry(1, offsets[3], 0)
+		entry(1, offsets[4], 0)
+		entry(1, xrefOffset, 0)
+		offsets = append(offsets[:5], xrefOffset)
+		fmt.Fprintf(&buf, "5 0 obj\n<< /Type /XRef /Size 6 /W [1 4 1] /Root 1 0 R /Length %d >>\nstream\n", entries.Len())
+		buf.Write(entries.Bytes())
+		buf.WriteString("\nendstream\nendobj\n")
+		if p.hybrid {
+			// The cross-reference table lists the objects in the object
+			// stream as free, only XRefStm has them.
+			tableOffset := buf.Len()
+			buf.WriteString("xref\n0 6\n0000000000 65535 f \n0000000000 65535 f \n0000000000 65535 f \n")
+			for _, offset := range offsets[3:] {
+				fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+			}
+			fmt.Fprintf(&buf, "trailer\n<< /Size 6 /Root 1 0 R /XRefStm %d >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset, tableOffset)
+		} else {
+			fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", xrefOffset)
+		}
+	} else {
+		writeObject(1, catalog)
+		writeObject(2, pages)
+		writeObject(3, sigDict)
+		size := 4
+		if p.page != nil {
+			content := testPageContent(p.page)
+			writeObject(4, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 6 0 R >> >> /Contents 5 0 R >>")
+			writeObject(5, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+			writeObject(6, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+			size = 7
+		}
+		trailer := "/Root 1 0 R"
+		if p.encrypt != "" {
+			for id := size; id < 7; id++ {
+				writeObject(id, "null")
+			}
+			writeObject(7, p.encrypt)
+			size = 8
+			trailer += " /Encrypt 7 0 R /ID [<0123456789abcdef0123456789abcdef> <0123456789abcdef0123456789abcdef>]"
+		}
+		xrefOffset := buf.Len()
+		fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", size)
+		for _, offset := range offsets[1:size] {
+			fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+		}
+		fmt.Fprintf(&buf, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", size, trailer, xrefOffset)
+	}
+	data := buf.Bytes()
+
+	// Fill in the byte ranges: everything except the Contents string.
+	contentsStart := bytes.Index(data, []byte("<"+placeholder+">"))
+	contentsEnd := contentsStart + len(placeholder) + 2
+	byteRange := fmt.Sprintf("0 %010d %010d %010d", contentsStart, contentsEnd, len(data)-contentsEnd)
+	if p.byteRange != nil {
+		byteRange = p.byteRange(contentsStart, contentsEnd, len(data))
+	}
+	byteRangeMarker := []byte("/ByteRange [0 0000000000 0000000000 0000000000]")
+	byteRangeStart := bytes.Index(data, byteRangeMarker)
+	replacement := []byte("/ByteRange [" + byteRange + "]")
+	if len(replacement) > len(byteRangeMarker) {
+		t.Fatalf("ByteRange %q is too long", byteRange)
+	}
+	replacement = append(replacement, bytes.Repeat([]byte(" "), len(byteRangeMarker)-len(replacement))...)
+	copy(data[byteRangeStart:], replacement)
+
+	// Sign the data outside the Contents string.
+	if p.signer != nil {
+		signed := append(append([]byte{}, data[:contentsStart]...), data[contentsEnd:]...)
+		chain := p.chain
+		if chain == nil {
+			chain = []*x509.Certificate{p.signer.cert}
+		}
+		var sig []byte
+		var err error
+		switch subfilter {
+		case "adbe.pkcs7.sha1":
+			hash := sha1.Sum(signed)
+			sig, err = cms.Sign(hash[:], chain, p.signer.key)
+		case "ETSI.RFC3161":
+			// A document timestamp by the signer.
+			sig = newTestTimestampToken(t, p.signer, signed, testSigningTime)
+		default:
+			sig, err = cms.SignDetached(signed, chain, p.signer.key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.tsa != nil {
+			sig = addTestSignatureTimestamp(t, sig, p.tsa)
+		}
+		if len(sig) > testSignatureSize {
+			t.Fatalf("signature of %d bytes doesn't fit", len(sig))
+		}
+		copy(data[contentsStart+1:], hex.EncodeToString(sig))
+	}
+	return append(data, p.trailer...)
+}
+
+// Time of the signature timestamps of the test PDFs, before the signing time
+// they claim themselves.
+var testTimestampTime = testSigningTime.Add(-time.Minute)
+
+// TSTInfo of a test timestamp token, like tstInfo but with a serial number
+// that can be marshalled.
+type testTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+}
+
+// Create an RFC 3161 timestamp token over msg at the given time, signed by the
+// timestamping authority.
+func newTestTimestampToken(t testing.TB, tsa *testCert, msg []byte, genTime time.Time) []byte {
+	hash := sha256.Sum256(msg)
+	info, err := asn1.Marshal(testTSTInfo{
+		Version: 1,
+		Policy:  asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1},
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}},
+			HashedMessage: hash[:],
+		},
+		SerialNumber: big.NewInt(1),
+		GenTime:      genTime.UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eci, err := protocol.NewEncapsulatedContentInfo(oid.ContentTypeTSTInfo, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := protocol.NewSignedData(eci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSignerInfo([]*x509.Certificate{tsa.cert}, tsa.key); err != nil {
+		t.Fatal(err)
+	}
+	token, err := sd.ContentInfoDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Add a signature timestamp from the timestamping authority at
+// testTimestampTime to a CMS signature, as PAdES signers do.
+func addTestSignatureTimestamp(t testing.TB, sig []byte, tsa *testCert) []byte {
+	ci, err := protocol.ParseContentInfo(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := ci.SignedDataContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &sd.SignerInfos[0]
+	token := newTestTimestampToken(t, tsa, signer.Signature, testTimestampTime)
+	attr, err := protocol.NewAttribute(oid.AttributeTimeStampToken, asn1.RawValue{FullBytes: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.UnsignedAttrs = append(signer.UnsignedAttrs, attr)
+	sig, err = sd.ContentInfoDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// The content stream of a page with the given rows: a single string is a line
+// of text, two strings are a label with its value in a second column.
+func testPageContent(rows [][]string) string {
+	escape := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+	var b strings.Builder
+	b.WriteString("BT /F1 10 Tf")
+	for i, row := range rows {
+		y := 800 - 16*i
+		for j, text := range row {
+			fmt.Fprintf(&b, "\n1 0 0 1 %d %d Tm (%s) Tj", 50+150*j, y, escape.Replace(text))
+		}
+	}
+	b.WriteString("\nET")
+	return b.String()
+}
+
+// A verifier trusting the given pool, at the signing time of the test PDFs.
+func newTestVerifier(pool *x509.CertPool, opts Options) *Verifier {
+	opts.Now = func() time.Time { return testSigningTime.Add(time.Hour) }
+	return New(pool, opts)
+}
+
+func TestVerifyPDFChain(t *testing.T) {
+	testCerts(t)
+	leafAndIntermediate := []*x509.Certificate{testLeaf.cert, testIntermediate.cert}
+	tests := []struct {
+		name   string
+		pdf    testPDF
+		pinned *x509.CertPool
+		opts   Options
+		reason string // of the CertificateError, empty when the PDF verifies
+	}{
+		{"pinned leaf", testPDF{signer: testSelfSigned}, certPool(testSelfSigned), Options{}, ""},
+		{"pinned intermediate, configured intermediates", testPDF{signer: testLeaf}, certPool(testIntermediate), Options{Intermediates: certPool(testIntermediate)}, ""},
+		{"pinned root, configured intermediates", testPDF{signer: testLeaf}, certPool(testRoot), Options{Intermediates: certPool(testIntermediate)}, ""},
+		{"pinned root, embedded intermediate", testPDF{signer: testLeaf, chain: leafAndIntermediate}, certPool(testRoot), Options{}, ""},
+		{"pinned root, no intermediates", testPDF{signer: testLeaf}, certPool(testRoot), Options{}, "unknown-authority"},
+		{"unknown signer", testPDF{signer: testUnknown}, certPool(testRoot, testSelfSigned), Options{Intermediates: certPool(testIntermediate)}, "unknown-authority"},
+		{"expired", testPDF{signer: testExpired}, certPool(testExpired), Options{}, "expired"},
+		{"expired within clock skew", testPDF{signer: testExpired}, certPool(testExpired), Options{ClockSkew: 2 * time.Hour}, ""},
+		{"embedded intermediate, unknown root", testPDF{signer: testLeaf, chain: leafAndIntermediate}, certPool(testSelfSigned), Options{}, "unknown-authority"},
+		{"expired, pinned root", testPDF{signer: testExpired}, certPool(testRoot, testExpired), Options{Intermediates: certPool(testIntermediate)}, "expired"},
+		{"email protection usage", testPDF{signer: testEmailSigner}, certPool(testRoot), Options{Intermediates: certPool(testIntermediate)}, ""},
+		{"server usage", testPDF{signer: testServer}, certPool(testRoot), Options{Intermediates: certPool(testIntermediate)}, "usage"},
+		{"server usage, pinned leaf", testPDF{signer: testServer}, certPool(testServer), Options{}, "usage"},
+		{"server usage, sha1", testPDF{subfilter: "adbe.pkcs7.sha1", signer: testServer}, certPool(testRoot), Options{Intermediates: certPool(testIntermediate)}, "usage"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVerifier(tc.pinned, tc.opts)
+			_, signature, err := v.verifyPDF(tc.pdf.build(t))
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				if !signature.Signer.Equal(tc.pdf.signer.cert) {
+					t.Errorf("signer is %s", signature.Signer.Subject)
+				}
+				if !signature.SigningTime.Equal(testSigningTime) {
+					t.Errorf("signing time is %s", signature.SigningTime)
+				}
+				return
+			}
+			var certErr CertificateError
+			if !errors.As(err, &certErr) || certErr.Reason != tc.reason {
+				t.Errorf("got error %v, want a %s CertificateError", err, tc.reason)
+			}
+		})
+	}
+}
+
+// The certificates embedded in signatures must not end up in the configured
+// intermediates, which are shared by concurrent verifications.
+func TestVerifyPDFIntermediatesUnchanged(t *testing.T) {
+	testCerts(t)
+	intermediates := certPool(testIntermediate)
+	v := newTestVerifier(certPool(testRoot, testSelfSigned), Options{Intermediates: intermediates})
+	embedding := testPDF{signer: testSelfSigned, chain: []*x509.Certificate{testSelfSigned.cert, testUnknown.cert}}.build(t)
+	signed := testPDF{signer: testLeaf}.build(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, pdf := range [][]byte{embedding, signed} {
+				if _, _, err := v.verifyPDF(pdf); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(intermediates.Subjects()); n != 1 {
+		t.Errorf("intermediates contain %d certificates after verifying", n)
+	}
+}
+
+// Signing certificates with an RSA key smaller than MinKeyBits are weak, even
+// when the chain verifies.
+func TestVerifyPDFKeySize(t *testing.T) {
+	notBefore := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2039, 1, 1, 0, 0, 0, 0, time.UTC)
+	signers := make(map[int]*testCert)
+	for _, bits := range []int{1024, 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[bits] = newTestCertWithKey(t, fmt.Sprintf("Test %d-bit DUO signer", bits), nil, false, notBefore, notAfter, key)
+	}
+	tests := []struct {
+		bits       int
+		minKeyBits int
+		weak       bool
+	}{
+		{1024, 0, true}, // DefaultMinKeyBits
+		{2048, 0, false},
+		{1024, 1024, false},
+		{2048, 3072, true},
+		{1024, -1, false},
+	}
+	for _, tc := range tests {
+		signer := signers[tc.bits]
+		v := newTestVerifier(certPool(signer), Options{MinKeyBits: tc.minKeyBits})
+		_, _, err := v.verifyPDF(testPDF{signer: signer}.build(t))
+		if tc.weak && !errors.Is(err, ErrWeakSignature) || !tc.weak && err != nil {
+			t.Errorf("%d-bit key with MinKeyBits %d: got error %v", tc.bits, tc.minKeyBits, err)
+		}
+	}
+}
+
+// Only signatures with an accepted SubFilter verify.
+func TestVerifyPDFSubFilters(t *testing.T) {
+	testCerts(t)
+	tests := []struct {
+		subfilter  string
+		subFilters []string
+		accepted   bool
+	}{
+		{"adbe.pkcs7.detached", nil, true},
+		{"ETSI.CAdES.detached", nil, true},
+		{"adbe.pkcs7.detached", []string{"ETSI.CAdES.detached"}, false},
+		{"adbe.pkcs7.sha1", []string{"ETSI.CAdES.detached"}, false},
+		{"ETSI.CAdES.detached", []string{"ETSI.CAdES.detached"}, true},
+		{"adbe.pkcs7.sha1", []string{"adbe.pkcs7.sha1"}, true},
+	}
+	for _, tc := range tests {
+		v := newTestVerifier(certPool(testSelfSigned), Options{SubFilters: tc.subFilters})
+		_, _, err := v.verifyPDF(testPDF{subfilter: tc.subfilter, signer: testSelfSigned}.build(t))
+		rejected := err != nil && strings.Contains(err.Error(), "subfilter not accepted: "+tc.subfilter)
+		if tc.accepted && err != nil || !tc.accepted && !rejected {
+			t.Errorf("%s with %v: got error %v", tc.subfilter, tc.subFilters, err)
+		}
+	}
+}
+
+// PAdES signatures are verified like detached CMS signatures, with the time of
+// their signature timestamp when TSARoots is set. PAdES document timestamps
+// must be signed by a timestamping authority.
+func TestVerifyPDFPAdES(t *testing.T) {
+	testCerts(t)
+	notBefore := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2039, 1, 1, 0, 0, 0, 0, time.UTC)
+	tsa := newTestCert(t, "Test TSA", nil, false, notBefore, notAfter, x509.ExtKeyUsageTimeStamping)
+	otherTSA := newTestCert(t, "Test other TSA", nil, false, notBefore, notAfter, x509.ExtKeyUsageTimeStamping)
+	leafAndIntermediate := []*x509.Certificate{testLeaf.cert, testIntermediate.cert}
+	tests := []struct {
+		name        string
+		pdf         testPDF
+		pinned      *x509.CertPool
+		tsaRoots    *x509.CertPool
+		signer      *testCert // empty when the PDF doesn't verify
+		signingTime time.Time
+		err         string // part of the error
+	}{
+		{"signature", testPDF{subfilter: "ETSI.CAdES.detached", signer: testLeaf, chain: leafAndIntermediate}, certPool(testRoot), nil,
+			testLeaf, testSigningTime, ""},
+		{"signature with timestamp", testPDF{subfilter: "ETSI.CAdES.detached", signer: testLeaf, chain: leafAndIntermediate, tsa: tsa}, certPool(testRoot), nil,
+			testLeaf, testSigningTime, ""},
+		{"signature with trusted timestamp", testPDF{subfilter: "ETSI.CAdES.detached", signer: testLeaf, chain: leafAndIntermediate, tsa: tsa}, certPool(testRoot), certPool(tsa),
+			testLeaf, testTimestampTime, ""},
+		{"signature without timestamp", testPDF{subfilter: "ETSI.CAdES.detached", signer: testLeaf, chain: leafAndIntermediate}, certPool(testRoot), certPool(tsa),
+			nil, time.Time{}, "cannot find signature timestamp"},
+		{"signature with untrusted timestamp", testPDF{subfilter: "ETSI.CAdES.detached", signer: testLeaf, chain: leafAndIntermediate, tsa: otherTSA}, certPool(testRoot), certPool(tsa),
+			nil, time.Time{}, "unknown-authority"},
+		{"untrusted signature with trusted timestamp", testPDF{subfilter: "ETSI.CAdES.detached", signer: testUnknown, tsa: tsa}, certPool(testRoot), certPool(tsa),
+			nil, time.Time{}, "unknown-authority"},
+		{"document timestamp", testPDF{subfilter: "ETSI.RFC3161", signer: tsa}, certPool(tsa), nil,
+			tsa, testSigningTime, ""},
+		{"document timestamp by untrusted TSA", testPDF{subfilter: "ETSI.RFC3161", signer: otherTSA}, certPool(tsa), nil,
+			nil, time.Time{}, "unknown-authority"},
+		{"document timestamp without timestamping usage", testPDF{subfilter: "ETSI.RFC3161", signer: testServer}, certPool(testServer), nil,
+			nil, time.Time{}, "usage"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVerifier(tc.pinned, Options{TSARoots: tc.tsaRoots})
+			_, signature, err := v.verifyPDF(tc.pdf.build(t))
+			if tc.signer == nil {
+				var certErr CertificateError
+				if err == nil || !strings.Contains(err.Error(), tc.err) && !(errors.As(err, &certErr) && certErr.Reason == tc.err) {
+					t.Errorf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !signature.Signer.Equal(tc.signer.cert) {
+				t.Errorf("signer is %s", signature.Signer.Subject)
+			}
+			if !signature.SigningTime.Equal(tc.signingTime) {
+				t.Errorf("signing time is %s, want %s", signature.SigningTime, tc.signingTime)
+			}
+		})
+	}
+
+	// A timestamp token over other data, both as a document timestamp and as
+	// a signature timestamp.
+	v := newTestVerifier(certPool(tsa), Options{TSARoots: certPool(tsa)})
+	token := newTestTimestampToken(t, tsa, []byte("signed data"), testSigningTime)
+	if _, err := v.verifyTimestampToken(token, []byte("other data"), testSigningTime); err == nil || !strings.Contains(err.Error(), "hash doesn't match") {
+		t.Errorf("got error %v for a timestamp over other data", err)
+	}
+	if _, err := v.verifyTimestampToken(token, []byte("signed data"), testSigningTime); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestVerifyPDFByteRange(t *testing.T) {
+	testCerts(t)
+	tests := []struct {
+		name      string
+		byteRange func(start, end, size int) string
+		trailer   string
+		err       string // substring of the error, empty when the PDF verifies
+	}{
+		{"valid", nil, "", ""},
+		{"trailing padding", nil, "\r\n  \t\n", ""},
+		{"too much trailing padding", nil, strings.Repeat(" ", maxTrailingPadding+1), "don't cover the entire PDF"},
+		{"unsigned update", nil, "% unsigned\n%%EOF\n", "don't cover the entire PDF"},
+		{"three values", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d", start, end)
+		}, "", "could not find ByteRange"},
+		{"not an integer", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d (x)", start, end)
+		}, "", "invalid ByteRange type"},
+		{"real number", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d.0 %d %d", start, end, size-end)
+		}, "", "invalid ByteRange type"},
+		{"negative length", func(start, end, size int) string {
+			return fmt.Sprintf("0 -%d %d %d", start, end, size-end)
+		}, "", "negative ByteRange value"},
+		{"negative offset", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d -%d %d", start, end, size-end)
+		}, "", "negative ByteRange value"},
+		{"not at start", func(start, end, size int) string {
+			return fmt.Sprintf("1 %d %d %d", start-1, end, size-end)
+		}, "", "don't cover the entire PDF"},
+		{"past the end", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d %d", start, end, size-end+1)
+		}, "", "don't cover the entire PDF"},
+		{"offset past the end", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d 0", start, size+1)
+		}, "", "don't cover the entire PDF"},
+		{"overflowing length", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d 9223372036854775807", start, end)
+		}, "", "don't cover the entire PDF"},
+		{"end not covered", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d %d", start, end, size-end-maxTrailingPadding-1)
+		}, "", "don't cover the entire PDF"},
+		{"overlapping", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d %d", end+1, end, size-end)
+		}, "", "invalid byte ranges"},
+		{"huge first range", func(start, end, size int) string {
+			return fmt.Sprintf("0 9223372036854775807 %d %d", end, size-end)
+		}, "", "invalid byte ranges"},
+		{"contents signed", func(start, end, size int) string {
+			return fmt.Sprintf("0 %d %d %d", start+1, end, size-end)
+		}, "", "invalid message digest"},
+	}
+	v := newTestVerifier(certPool(testSelfSigned), Options{})
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pdf := testPDF{signer: testSelfSigned, byteRange: tc.byteRange, trailer: tc.trailer}.build(t)
+			trusted, _, err := v.verifyPDF(pdf)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				// Only the signed data, so without the signature.
+				signed := append([]byte{}, pdf[:len(pdf)-len(tc.trailer)]...)
+				contents := bytes.Index(signed, []byte("/Contents <")) + len("/Contents ")
+				copy(signed[contents:], make([]byte, 2*testSignatureSize+2))
+				if !bytes.Equal(trusted, signed) {
+					t.Error("trusted PDF differs from the signed data")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+// verifyPDF must return an error for any input, never panic. The seeds include
+// the ByteRange values that used to make it panic.
+func FuzzVerifyPDF(f *testing.F) {
+	testCerts(f)
+	byteRanges := []func(start, end, size int) string{
+		nil,
+		func(start, end, size int) string { return fmt.Sprintf("0 -%d %d %d", start, end, size-end) },
+		func(start, end, size int) string { return fmt.Sprintf("0 %d -%d %d", start, end, size-end) },
+		func(start, end, size int) string { return fmt.Sprintf("0 %d %d 0", start, size+1) },
+		func(start, end, size int) string { return fmt.Sprintf("0 %d %d 9223372036854775807", start, end) },
+		func(start, end, size int) string { return fmt.Sprintf("0 %d %d %d", end+1, end, size-end) },
+		func(start, end, size int) string { return fmt.Sprintf("0 9223372036854775807 %d %d", end, size-end) },
+	}
+	for _, byteRange := range byteRanges {
+		f.Add(testPDF{signer: testSelfSigned, byteRange: byteRange}.build(f))
+	}
+	f.Add(testPDF{signer: testSelfSigned, objectStream: true}.build(f))
+	f.Add(testPDF{signer: testSelfSigned, subfilter: "adbe.pkcs7.sha1"}.build(f))
+
+	v := newTestVerifier(certPool(testSelfSigned), Options{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		trusted, signature, err := v.verifyPDF(data)
+		if err == nil && (len(trusted) > len(data) || signature == nil) {
+			t.Errorf("verified a PDF of %d bytes as %d bytes", len(data), len(trusted))
+		}
+	})
+}
+
+// Password-protected PDFs are reported as encrypted, whether or not the PDF
+// library supports their encryption.
+func TestVerifyPDFEncrypted(t *testing.T) {
+	testCerts(t)
+	v := newTestVerifier(certPool(testSelfSigned), Options{})
+	password := "<" + strings.Repeat("28bf4e5e4e758a4164004e56fffa0108", 2) + ">"
+	tests := []struct {
+		name    string
+		encrypt string
+	}{
+		{"user password", "<< /Filter /Standard /V 1 /R 2 /Length 40 /O " + password + " /U " + password + " /P -3904 >>"},
+		{"AES-256", "<< /Filter /Standard /V 5 /R 6 /Length 256 /O " + password + " /U " + password + " /P -3904 >>"},
+		{"unknown handler", "<< /Filter /Unknown.Security /V 2 >>"},
+	}
+	for _, tc := range tests {
+		_, _, err := v.verifyPDF(testPDF{signer: testSelfSigned, encrypt: tc.encrypt}.build(t))
+		if !errors.Is(err, ErrEncryptedPDF) {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, ErrEncryptedPDF)
+		}
+	}
+	if _, _, err := v.verifyPDF(testPDF{signer: testSelfSigned}.build(t)); err != nil {
+		t.Errorf("unexpected error without encryption: %v", err)
+	}
+}
+
+// PDFs that were cut off are reported as truncated, unless only the padding
+// after the end of file marker is missing.
+func TestVerifyPDFTruncated(t *testing.T) {
+	testCerts(t)
+	v := newTestVerifier(certPool(testSelfSigned), Options{})
+	pdf := testPDF{signer: testSelfSigned, trailer: "\n\n"}.build(t)
+	eof := bytes.LastIndex(pdf, []byte("%%EOF"))
+	tests := []struct {
+		name      string
+		data      []byte
+		truncated bool
+	}{
+		{"empty", nil, true},
+		{"header only", pdf[:len("%PDF-1.7\n")], true},
+		{"half", pdf[:len(pdf)/2], true},
+		{"within the signature", pdf[:bytes.Index(pdf, []byte("/Contents <"))+100], true},
+		{"before the cross-reference table", pdf[:bytes.LastIndex(pdf, []byte("xref"))], true},
+		{"within the end of file marker", pdf[:eof+3], true},
+		{"without padding", pdf[:len(pdf)-len("\n\n")], false},
+		{"complete", pdf, false},
+	}
+	for _, tc := range tests {
+		_, _, err := v.verifyPDF(tc.data)
+		if tc.truncated != errors.Is(err, ErrTruncatedPDF) {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+		if !tc.truncated && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestVerifyPDFObjectStream(t *testing.T) {
+	testCerts(t)
+	v := newTestVerifier(certPool(testSelfSigned), Options{})
+	_, signature, err := v.verifyPDF(testPDF{signer: testSelfSigned, objectStream: true}.build(t))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !signature.Signer.Equal(testSelfSigned.cert) {
+		t.Errorf("signer is %s", signature.Signer.Subject)
+	}
+
+	_, _, err = v.verifyPDF(testPDF{signer: testSelfSigned, objectStream: true, hybrid: true}.build(t))
+	if !errors.Is(err, ErrHybridPDF) {
+		t.Errorf("got error %v for a hybrid-reference file, want %v", err, ErrHybridPDF)
+	}
+}
+
+// The clock skew is allowed up to and including its boundary, for the signing
+// time as well as for the validity of the signing certificate.
+func TestVerifyPDFClockSkew(t *testing.T) {
+	testCerts(t)
+	notBefore := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	notYetValid := newTestCert(t, "Test not yet valid DUO signer", nil, false, testSigningTime.Add(time.Hour), notBefore.AddDate(20, 0, 0))
+	tests := []struct {
+		name   string
+		signer *testCert
+		now    time.Time // current time of the verifier
+		skew   time.Duration
+		err    string // part of the error, empty when the PDF verifies
+	}{
+		{"signed now", testSelfSigned, testSigningTime, 0, ""},
+		{"signed in the future without skew", testSelfSigned, testSigningTime.Add(-time.Second), 0, "signing time is in the future"},
+		{"signed at the skew boundary", testSelfSigned, testSigningTime.Add(-time.Minute), time.Minute, ""},
+		{"signed beyond the skew boundary", testSelfSigned, testSigningTime.Add(-time.Minute - time.Second), time.Minute, "signing time is in the future"},
+		{"expired at the skew boundary", testExpired, testSigningTime.Add(time.Hour), time.Hour, ""},
+		{"expired beyond the skew boundary", testExpired, testSigningTime.Add(time.Hour), time.Hour - time.Second, "expired"},
+		{"not yet valid at the skew boundary", notYetValid, testSigningTime.Add(time.Hour), time.Hour, ""},
+		{"not yet valid beyond the skew boundary", notYetValid, testSigningTime.Add(time.Hour), time.Hour - time.Second, "expired"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			now := tc.now
+			v := New(certPool(tc.signer), Options{ClockSkew: tc.skew, Now: func() time.Time { return now }})
+			_, _, err := v.verifyPDF(testPDF{signer: tc.signer}.build(t))
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tc.err == "":
+			case tc.err == "expired":
+				var certErr CertificateError
+				if !errors.As(err, &certErr) || certErr.Reason != "expired" {
+					t.Errorf("got error %v, want an expired CertificateError", err)
+				}
+			case err == nil || !strings.Contains(err.Error(), tc.err):
+				t.Errorf("got error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+var updateSelftest = flag.Bool("update-selftest", false, "regenerate the synthetic sample diploma in ../selftest")
+
+// Rows of the synthetic sample diploma bundled for the selftest command.
+var selftestRows = [][]string{
+	{"Uittreksel uit het diplomaregister"},
+	{"Achternaam", "Jansen"},
+	{"Voorna(a)m(en)", "Jan"},
+	{"Geslacht", "Man"},
+	{"Geboortedatum", "3 maart 1990"},
+	{"Opleiding", "M Informatica"},
+	{"Aard van het examen", "WO Master"},
+	{"Behaald op", "31 augustus 2016"},
+	{"Instelling", "Radboud Universiteit in NIJMEGEN"},
+}
+
+// The synthetic sample diploma in ../selftest must verify with the bundled
+// certificate, and the HTML that pdf2htmlEX is expected to produce for it (in
+// ../testdata/selftest.html, used by the selftest tests without pdf2htmlEX)
+// must contain a diploma. Run with -update-selftest to regenerate all three
+// files.
+func TestSelftestFixture(t *testing.T) {
+	const (
+		pdfPath  = "../selftest/diploma.pdf"
+		certPath = "../selftest/synthetic.pem"
+		htmlPath = "../testdata/selftest.html"
+	)
+	if *updateSelftest {
+		notBefore := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+		notAfter := time.Date(2039, 1, 1, 0, 0, 0, 0, time.UTC)
+		signer := newTestCert(t, "Synthetic selftest signer", nil, false, notBefore, notAfter)
+		files := map[string][]byte{
+			pdfPath:  testPDF{signer: signer, page: selftestRows}.build(t),
+			certPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signer.cert.Raw}),
+			htmlPath: testHTML(selftestRows),
+		}
+		for path, data := range files {
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pdfData, err := os.ReadFile(pdfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadCertificate(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := newTestVerifier(certPool(&testCert{cert: cert}), Options{}).verifyPDF(pdfData); err != nil {
+		t.Errorf("cannot verify %s: %v", pdfPath, err)
+	}
+	html, err := os.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diplomas, _, err := New(x509.NewCertPool(), Options{}).extractHTML(html)
+	if err != nil || len(diplomas) != 1 {
+		t.Errorf("%s: got %d diplomas, error %v", htmlPath, len(diplomas), err)
+	}
+}
+
+func writeTestCertPEM(t *testing.T, dir, name string, c *testCert) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Certificates from every directory are trusted, and certificates in more
+// than one directory are added once.
+func TestLoadCertPool(t *testing.T) {
+	testCerts(t)
+	current, upcoming := t.TempDir(), t.TempDir()
+	writeTestCertPEM(t, current, "current", testRoot)
+	writeTestCertPEM(t, upcoming, "upcoming", testSelfSigned)
+	writeTestCertPEM(t, upcoming, "current", testRoot)
+
+	pool, err := LoadCertPool(current, upcoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pool.Subjects()); n != 2 {
+		t.Errorf("got %d certificates, want 2", n)
+	}
+	v := newTestVerifier(pool, Options{})
+	if _, _, err := v.verifyPDF(testPDF{signer: testSelfSigned}.build(t)); err != nil {
+		t.Errorf("signed by a certificate in the second directory: %v", err)
+	}
+
+	var extractErr *ExtractError
+	if _, err := LoadCertPool(t.TempDir()); !errors.As(err, &extractErr) {
+		t.Errorf("without certificates: got %T %v, want an *ExtractError", err, err)
+	}
+}
@@ -0,0 +1,20 @@
+package duo
+
+import (
+	_ "embed"
+	"time"
+)
+
+// A tiny one-page PDF, only used to run pdf2htmlEX once.
+//
+//go:embed warmup.pdf
+var warmupPDF []byte
+
+// WarmUp runs pdf2htmlEX once on a tiny PDF, discarding the output, so font
+// caches are initialized before the first real extraction. Returns how long
+// it took.
+func (v *Verifier) WarmUp() (time.Duration, error) {
+	start := time.Now()
+	_, err := v.convertToHTML(warmupPDF)
+	return time.Since(start), err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// Prefix of environment variables that override config options. The variable
+// for an option is the prefix followed by the option name in uppercase, e.g.
+// DUO_CORS_DOMAIN for cors_domain.
+const envPrefix = "DUO_"
+
+// Name of the environment variable that overrides the given config option.
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(option)
+}
+
+// Override config options with environment variables, if set. Lists are
+// comma-separated and maps are comma-separated key=value pairs.
+func (c *Config) applyEnv() error {
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		option := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		env, ok := os.LookupEnv(envName(option))
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(value.Field(i), env); err != nil {
+			return errors.New("cannot parse " + envName(option) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func setFromEnv(field reflect.Value, env string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(env)
+	case int:
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case []string:
+		field.Set(reflect.ValueOf(splitList(env)))
+	case []irma.AttributeTypeIdentifier:
+		var identifiers []irma.AttributeTypeIdentifier
+		for _, id := range splitList(env) {
+			identifiers = append(identifiers, irma.NewAttributeTypeIdentifier(id))
+		}
+		field.Set(reflect.ValueOf(identifiers))
+	case map[string]string:
+		m := make(map[string]string)
+		for _, pair := range splitList(env) {
+			i := strings.IndexByte(pair, '=')
+			if i < 0 {
+				return errors.New("expected key=value, got " + pair)
+			}
+			m[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return errors.New("unsupported option type " + field.Type().String())
+	}
+	return nil
+}
+
+// Split a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes sent to clients as "error:<code>" (see sendErrorResponse), or in
+// the error field of a JSON match error. Frontends map them to messages, see
+// webapp/nl/messages.js, so existing codes must not be changed.
+const (
+	ErrorInvalidMethod        = "invalid-method"
+	ErrorBadContentType       = "bad-content-type"
+	ErrorBadEncoding          = "bad-encoding"
+	ErrorFileTooBig           = "file-too-big"
+	ErrorTooManyParts         = "too-many-parts"
+	ErrorNoPDFFile            = "no-pdf-file"
+	ErrorPDFURLNotAllowed     = "pdf-url-not-allowed"
+	ErrorPDFURLFetch          = "pdf-url-fetch"
+	ErrorReadFile             = "readfile"
+	ErrorNotAPDF              = "not-a-pdf"
+	ErrorEncryptedPDF         = "encrypted-pdf"
+	ErrorTruncatedPDF         = "truncated-pdf"
+	ErrorWeakSignature        = "weak-signature"
+	ErrorUntrustedSignature   = "untrusted-signature"
+	ErrorExtractorUnavailable = "extractor-unavailable"
+	ErrorBusy                 = "busy"
+	ErrorExtract              = "extract"
+	ErrorNoDiplomaFound       = "no-diploma-found"
+	ErrorAttributes           = "attributes"
+	ErrorAttributesExpired    = "attributes-expired"
+	ErrorAttributesMissing    = "attributes-missing"
+	ErrorSession              = "session"
+	ErrorIRMAServer           = "irma-server"
+	ErrorNoInitials           = "no-initials"
+	ErrorInitialsMatch        = "initials-match"
+	ErrorNameMatch            = "name-match"
+	ErrorDateOfBirthMatch     = "dateofbirth-match"
+	ErrorIdentifierMatch      = "identifier-match"
+	ErrorAttributeMatch       = "attribute-match" // a disclosure group, see disclosure_groups
+	ErrorInstituteNotAllowed  = "institute-not-allowed"
+	ErrorLevelNotAllowed      = "level-not-allowed"
+	ErrorCredentialExpired    = "credential-expired" // with validity_from_achieved
+	ErrorSigning              = "signing"
+	ErrorUnknownKey           = "unknown-key"
+	ErrorHTTPSRequired        = "https-required"
+	ErrorUnauthorized         = "unauthorized"
+	ErrorReload               = "reload"
+	ErrorInternal             = "internal"
+)
+
+// All error codes, as listed by /api/errors. Keep in sync with the constants
+// above.
+var errorCodes = []string{
+	ErrorInvalidMethod,
+	ErrorBadContentType,
+	ErrorBadEncoding,
+	ErrorFileTooBig,
+	ErrorTooManyParts,
+	ErrorNoPDFFile,
+	ErrorPDFURLNotAllowed,
+	ErrorPDFURLFetch,
+	ErrorReadFile,
+	ErrorNotAPDF,
+	ErrorEncryptedPDF,
+	ErrorTruncatedPDF,
+	ErrorWeakSignature,
+	ErrorUntrustedSignature,
+	ErrorExtractorUnavailable,
+	ErrorBusy,
+	ErrorExtract,
+	ErrorNoDiplomaFound,
+	ErrorAttributes,
+	ErrorAttributesExpired,
+	ErrorAttributesMissing,
+	ErrorSession,
+	ErrorIRMAServer,
+	ErrorNoInitials,
+	ErrorInitialsMatch,
+	ErrorNameMatch,
+	ErrorDateOfBirthMatch,
+	ErrorIdentifierMatch,
+	ErrorAttributeMatch,
+	ErrorInstituteNotAllowed,
+	ErrorLevelNotAllowed,
+	ErrorCredentialExpired,
+	ErrorSigning,
+	ErrorUnknownKey,
+	ErrorHTTPSRequired,
+	ErrorUnauthorized,
+	ErrorReload,
+	ErrorInternal,
+}
+
+// List all error codes the server can send as a JSON array, so frontends can
+// check they have a message for each of them.
+func apiErrors(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(errorCodes)
+	if err != nil {
+		sendErrorResponse(w, 500, ErrorInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Parse the non-test Go files of this package.
+func parsePackage(t *testing.T) (*token.FileSet, []*ast.File) {
+	t.Helper()
+	paths, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return fset, files
+}
+
+func TestErrorCodesListed(t *testing.T) {
+	_, files := parsePackage(t)
+	listed := make(map[string]bool)
+	for _, code := range errorCodes {
+		if listed[code] {
+			t.Errorf("error code %q is listed twice", code)
+		}
+		listed[code] = true
+	}
+
+	defined := make(map[string]string) // code -> constant
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.ValueSpec)
+				for i, name := range spec.Names {
+					if !strings.HasPrefix(name.Name, "Error") || i >= len(spec.Values) {
+						continue
+					}
+					lit, ok := spec.Values[i].(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						t.Errorf("%s is not a string constant", name.Name)
+						continue
+					}
+					code, _ := strconv.Unquote(lit.Value)
+					if other, ok := defined[code]; ok {
+						t.Errorf("%s and %s have the same code %q", other, name.Name, code)
+					}
+					defined[code] = name.Name
+					if !listed[code] {
+						t.Errorf("%s (%q) is missing from errorCodes", name.Name, code)
+					}
+				}
+			}
+		}
+	}
+	for code := range listed {
+		if _, ok := defined[code]; !ok {
+			t.Errorf("errorCodes lists %q, which isn't an Error constant", code)
+		}
+	}
+}
+
+// Functions taking an error code, and the index of that argument.
+var errorCodeArgs = map[string]int{
+	"sendErrorResponse":   2,
+	"sendMatchError":      3,
+	"sendFieldMatchError": 3,
+	"recordError":         1,
+}
+
+func TestErrorCodesUseConstants(t *testing.T) {
+	fset, files := parsePackage(t)
+	for _, file := range files {
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			ident, ok := call.Fun.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			index, ok := errorCodeArgs[ident.Name]
+			if !ok || index >= len(call.Args) {
+				return true
+			}
+			switch arg := call.Args[index].(type) {
+			case *ast.Ident:
+				if !strings.HasPrefix(arg.Name, "Error") && arg.Name != "errorCode" {
+					t.Errorf("%s: %s called with %s instead of an Error constant", fset.Position(call.Pos()), ident.Name, arg.Name)
+				}
+			default:
+				t.Errorf("%s: %s called with an expression instead of an Error constant", fset.Position(call.Pos()), ident.Name)
+			}
+			return true
+		})
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiErrors(w, httptest.NewRequest("GET", "/api/errors", nil))
+	var codes []string
+	if err := json.Unmarshal(w.Body.Bytes(), &codes); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != len(errorCodes) {
+		t.Errorf("got %d codes, want %d", len(codes), len(errorCodes))
+	}
+}
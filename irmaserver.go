@@ -0,0 +1,58 @@
+package main
+
+// This file contains the client for the session API of newer IRMA servers,
+// used instead of handing signed JWTs to the IRMA app when irma_server_url is
+// set.
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client for requests to the IRMA server.
+var irmaServerClient = &http.Client{Timeout: 30 * time.Second}
+
+// Maximum size of a response from the IRMA server.
+const maxIRMAServerResponse = 64 * 1024
+
+// Start a session at the IRMA server with the given signed session request
+// JWT. Returns the response of the server, a JSON object with the session
+// pointer for the IRMA app, to be handed to the frontend as-is.
+func startSession(c *Config, requestJwt string) ([]byte, error) {
+	resp, err := irmaServerClient.Post(c.IRMAServerURL+"/session", "text/plain", strings.NewReader(requestJwt))
+	if err != nil {
+		return nil, err
+	}
+	return readIRMAServerResponse(resp)
+}
+
+// Fetch the signed result of a finished disclosure session from the IRMA
+// server.
+func sessionResultJwt(c *Config, token string) (string, error) {
+	resp, err := irmaServerClient.Get(c.IRMAServerURL + "/session/" + url.PathEscape(token) + "/result-jwt")
+	if err != nil {
+		return "", err
+	}
+	data, err := readIRMAServerResponse(resp)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func readIRMAServerResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIRMAServerResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("IRMA server returned " + resp.Status + ": " + string(data))
+	}
+	return data, nil
+}
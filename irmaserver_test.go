@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// The flow of the webapp with irma_server_url: request-attrs returns the
+// session pointer of the IRMA server, and the session token posted to issue
+// is used to fetch the disclosure result.
+func TestSessionFlow(t *testing.T) {
+	const token = "session-token"
+	const sessionResponse = `{"sessionPtr": {"u": "https://irma.example.com/irma/session/abc", "irmaqr": "disclosing"}, "token": "` + token + `"}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "disclosure-jwt" {
+			t.Errorf("IRMA server got request %q", body)
+		}
+		w.Write([]byte(sessionResponse))
+	})
+	mux.HandleFunc("/session/"+token+"/result-jwt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("result-jwt"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := defaultConfig()
+	c.IRMAServerURL = server.URL
+	withDisclosedAttributes(t, &c, nil)
+	var disclosureJwt string
+	parse := parseDisclosureJwt
+	parseDisclosureJwt = func(jwt string, pk *rsa.PublicKey) (map[irma.AttributeTypeIdentifier]irma.TranslatedString, error) {
+		disclosureJwt = jwt
+		return parse(jwt, pk)
+	}
+	state := &serverState{&c, nil}
+	withTestState(t, state)
+	configDir = t.TempDir()
+	writeAPIServerKey(t, configDir)
+	withSigner(t, &recordingSigner{})
+
+	w := httptest.NewRecorder()
+	apiRequestAttrs(w, httptest.NewRequest("GET", "/api/request-attrs", nil), state)
+	if w.Header().Get("Content-Type") != "application/json" || w.Body.String() != sessionResponse {
+		t.Fatalf("request-attrs returned %s %q", w.Header().Get("Content-Type"), w.Body)
+	}
+
+	postIssue(t, state, map[string]string{"token": token}, nil)
+	if disclosureJwt != "result-jwt" {
+		t.Errorf("issue used disclosure JWT %q, want the session result", disclosureJwt)
+	}
+}
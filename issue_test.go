@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+	"github.com/privacybydesign/irmago"
+)
+
+// Signer that signs the requests as JWTs with a test key, with the request in
+// the claims like the IRMA JWTs.
+type jwtSigner struct {
+	key *rsa.PrivateKey
+}
+
+func (s jwtSigner) sign(c *Config, subject, field string, request interface{}) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": c.RequestorName,
+		"sub": subject,
+		field: map[string]interface{}{"request": request},
+	})
+	token.Header["kid"] = c.JWTKeyID
+	return token.SignedString(s.key)
+}
+
+func (s jwtSigner) SignDisclosureRequest(c *Config, request *irma.DisclosureRequest) (string, error) {
+	return s.sign(c, "verification_request", "sprequest", request)
+}
+
+func (s jwtSigner) SignIssuanceRequest(c *Config, request *irma.IssuanceRequest) (string, error) {
+	return s.sign(c, "issue_request", "iprequest", request)
+}
+
+// Extractor that returns fixed diplomas, instead of running pdf2htmlEX.
+type fixedExtractor []duo.Diploma
+
+func (e fixedExtractor) Extract(pdfData []byte) ([]duo.Diploma, []duo.Warning, error) {
+	return e, nil, nil
+}
+
+// Claims of the issuance JWTs signed by jwtSigner.
+type issuanceClaims struct {
+	jwt.StandardClaims
+	Request struct {
+		Request struct {
+			Credentials []struct {
+				Validity   int64             `json:"validity"`
+				Credential string            `json:"credential"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"credentials"`
+		} `json:"request"`
+	} `json:"iprequest"`
+}
+
+// The diploma in the fixture PDF.
+var testDiploma = duo.Diploma{
+	FamilyName:  "Jansen",
+	FirstName:   "Jan",
+	Gender:      "male",
+	DateOfBirth: "03-03-1990",
+	Education:   "M Informatica",
+	Degree:      "WO Master",
+	Achieved:    "31-08-2016",
+	Institute:   "Radboud Universiteit",
+	City:        "NIJMEGEN",
+}
+
+// Start the HTTP server with a test config for issuing testDiploma at the
+// given time, with a disclosure that matches it. Returns the config, the key
+// of the signer and the URL of the server.
+func startIssueServer(t *testing.T, now time.Time) (*Config, *rsa.PrivateKey, string) {
+	withClock(t, now)
+	c := defaultConfig()
+	c.DUOCrendentialID = "pbdf.pbdf.diploma"
+	withDisclosedAttributes(t, &c, map[string]string{
+		"pbdf.pbdf.idin.initials":    "J.",
+		"pbdf.pbdf.idin.familyname":  "Jansen",
+		"pbdf.pbdf.idin.dateofbirth": "03-03-1990",
+	})
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSigner(t, jwtSigner{key})
+	pool := x509.NewCertPool()
+	v := duo.New(pool, duo.Options{SkipVerification: true, Extractor: fixedExtractor{testDiploma}})
+	withTestState(t, &serverState{&c, v})
+	configDir = t.TempDir()
+	writeAPIServerKey(t, configDir)
+	server := httptest.NewServer(newServerHandler(&c))
+	t.Cleanup(server.Close)
+	return &c, key, server.URL
+}
+
+// Build the multipart form posted by the webapp, with the disclosure JWT and
+// the given PDF.
+func issueForm(t *testing.T, pdf []byte) ([]byte, string) {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("attributes", "disclosure-jwt")
+	part, err := form.CreateFormFile("pdf", "diploma.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(pdf)
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), form.FormDataContentType()
+}
+
+// Post the body to /api/issue with the given headers, returning the response
+// and its body.
+func postIssueBody(t *testing.T, serverURL string, body []byte, header http.Header) (*http.Response, []byte) {
+	r, err := http.NewRequest("POST", serverURL+"/api/issue", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header = header
+	resp, err := http.DefaultTransport.RoundTrip(r) // no transparent decompression
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func readTestPDF(t *testing.T) []byte {
+	pdf, err := ioutil.ReadFile("testdata/diploma.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pdf
+}
+
+// Issue a credential for a fixture PDF through the HTTP server, from the
+// disclosure to the signed issuance request.
+func TestIssue(t *testing.T) {
+	now := time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+	c, key, serverURL := startIssueServer(t, now)
+	body, contentType := issueForm(t, readTestPDF(t))
+	resp, data := postIssueBody(t, serverURL, body, http.Header{"Content-Type": {contentType}})
+	if resp.StatusCode != 200 {
+		t.Fatalf("got %s: %s", resp.Status, data)
+	}
+
+	claims := &issuanceClaims{}
+	token, err := (&jwt.Parser{ValidMethods: []string{"RS256"}}).ParseWithClaims(string(data), claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("invalid issuance JWT %q: %v", data, err)
+	}
+	if claims.Issuer != c.RequestorName || claims.Subject != "issue_request" || token.Header["kid"] != c.JWTKeyID {
+		t.Errorf("unexpected issuer %q, subject %q or key ID %v", claims.Issuer, claims.Subject, token.Header["kid"])
+	}
+	credentials := claims.Request.Request.Credentials
+	if len(credentials) != 1 {
+		t.Fatalf("got %d credentials, want 1", len(credentials))
+	}
+	if credentials[0].Credential != c.DUOCrendentialID {
+		t.Errorf("got credential type %s", credentials[0].Credential)
+	}
+	if want := time.Time(credentialValidity(now, c.CredentialValidity)).Unix(); credentials[0].Validity != want {
+		t.Errorf("got validity %d, want %d", credentials[0].Validity, want)
+	}
+	got, _ := json.Marshal(credentials[0].Attributes)
+	want, _ := json.Marshal(testDiploma.Attributes())
+	if !bytes.Equal(got, want) {
+		t.Errorf("got attributes %s, want %s", got, want)
+	}
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Uploads may be gzip-compressed, limited to maxRequestSize after
+// decompression, and large responses are compressed for clients that accept
+// it.
+func TestIssueGzip(t *testing.T) {
+	_, _, serverURL := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	body, contentType := issueForm(t, readTestPDF(t))
+	bombBody, bombType := issueForm(t, append([]byte("%PDF-"), make([]byte, maxRequestSize)...))
+
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		encoding    string // Content-Encoding of the upload
+		status      int
+		error       string
+	}{
+		{"plain upload", body, contentType, "", 200, ""},
+		{"gzip upload", gzipData(t, body), contentType, "gzip", 200, ""},
+		{"invalid gzip", body, contentType, "gzip", 400, ErrorBadEncoding},
+		{"gzip bomb", gzipData(t, bombBody), bombType, "gzip", 413, ErrorFileTooBig},
+	}
+	for _, tc := range tests {
+		header := http.Header{"Content-Type": {tc.contentType}, "Accept-Encoding": {"gzip"}}
+		if tc.encoding != "" {
+			header.Set("Content-Encoding", tc.encoding)
+		}
+		resp, data := postIssueBody(t, serverURL, tc.body, header)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %s: %q", tc.name, resp.Status, data)
+			continue
+		}
+		if tc.error != "" {
+			if string(data) != "error:"+tc.error {
+				t.Errorf("%s: got %q, want error %s", tc.name, data, tc.error)
+			}
+			continue
+		}
+		// The issuance JWT is large enough to be compressed.
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("%s: response not compressed", tc.name)
+			continue
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		jwt, err := ioutil.ReadAll(gz)
+		if err != nil || bytes.Count(jwt, []byte(".")) != 2 {
+			t.Errorf("%s: got %q, %v", tc.name, jwt, err)
+		}
+	}
+}
+
+// Forms with too many parts are refused before parsing, malformed or
+// unreadable bodies are bad requests, and only bodies over maxRequestSize are
+// too big.
+func TestIssueFormParts(t *testing.T) {
+	_, _, serverURL := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	body, contentType := issueForm(t, readTestPDF(t))
+	bigBody, bigType := issueForm(t, append([]byte("%PDF-"), make([]byte, maxRequestSize)...))
+
+	partsBody := new(bytes.Buffer)
+	form := multipart.NewWriter(partsBody)
+	for i := 0; i <= maxFormParts; i++ {
+		form.WriteField("field", "value")
+	}
+	form.Close()
+	partsType := form.FormDataContentType()
+
+	gzipBody := gzipData(t, body)
+	tests := []struct {
+		name        string
+		body        []byte
+		contentType string
+		encoding    string // Content-Encoding of the upload
+		status      int
+		error       string
+	}{
+		{"valid form", body, contentType, "", 200, ""},
+		{"too many parts", partsBody.Bytes(), partsType, "", 400, ErrorTooManyParts},
+		{"too big", bigBody, bigType, "", 413, ErrorFileTooBig},
+		{"malformed part", []byte("--boundary\r\nno header\r\n\r\n"), "multipart/form-data; boundary=boundary", "", 400, ErrorBadEncoding},
+		{"truncated gzip", gzipBody[:len(gzipBody)/2], contentType, "gzip", 400, ErrorBadEncoding},
+	}
+	for _, tc := range tests {
+		header := http.Header{"Content-Type": {tc.contentType}}
+		if tc.encoding != "" {
+			header.Set("Content-Encoding", tc.encoding)
+		}
+		resp, data := postIssueBody(t, serverURL, tc.body, header)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %s: %q", tc.name, resp.Status, data)
+			continue
+		}
+		if tc.error != "" && string(data) != "error:"+tc.error {
+			t.Errorf("%s: got %q, want error %s", tc.name, data, tc.error)
+		}
+	}
+}
+
+func TestIssueContentType(t *testing.T) {
+	c := defaultConfig()
+	state := &serverState{&c, nil}
+	withTestState(t, state)
+	configDir = t.TempDir()
+	writeAPIServerKey(t, configDir)
+	tests := []struct {
+		method      string
+		contentType string
+		status      int // 0 when the request must get past the content type check
+	}{
+		{"POST", "application/json", 415},
+		{"POST", "application/json; charset=utf-8", 415},
+		{"POST", "text/plain", 415},
+		{"POST", "application/x-www-form-urlencoded", 415},
+		{"POST", "", 415},
+		{"POST", "multipart/form-data; boundary=\"", 415},
+		{"POST", "multipart/form-data; boundary=x", 0},
+		{"POST", "Multipart/Form-Data; boundary=x", 0},
+		{"GET", "application/json", 405},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, "/api/issue", strings.NewReader(`{"attributes": "disclosure-jwt"}`))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		apiIssue(w, r, state)
+		switch {
+		case tc.status == 415 && (w.Code != 415 || w.Body.String() != "error:"+ErrorBadContentType):
+			t.Errorf("%s %q: got %d %q, want 415 %s", tc.method, tc.contentType, w.Code, w.Body, ErrorBadContentType)
+		case tc.status == 0 && w.Code == 415:
+			t.Errorf("%s %q: refused content type", tc.method, tc.contentType)
+		case tc.status != 0 && w.Code != tc.status:
+			t.Errorf("%s %q: got %d, want %d", tc.method, tc.contentType, w.Code, tc.status)
+		}
+	}
+}
+
+// Diplomas of different degrees are issued as different credential types, by
+// the degree as extracted, which are reported in the JSON response and in the
+// audit log.
+func TestIssueCredentialTypes(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	c.CredentialTypes = map[string]string{
+		"WO Master":    "pbdf.pbdf.diplomaMaster",
+		"HBO Bachelor": "pbdf.pbdf.diplomaBachelor",
+	}
+	c.AttributeTransforms = map[string]string{"degree": "upper"}
+	bachelor := testDiploma
+	bachelor.Education, bachelor.Degree = "B Verpleegkunde", "HBO Bachelor"
+	state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: fixedExtractor{testDiploma, bachelor}})}
+	currentState.Store(state)
+
+	oldAuditLog := auditLog
+	t.Cleanup(func() { auditLog = oldAuditLog })
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	if auditLog, err = openAuditLog(auditPath, testAuditKey); err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.close()
+
+	body, contentType := issueForm(t, readTestPDF(t))
+	r := httptest.NewRequest("POST", "/api/issue", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	apiIssue(w, r, state)
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	want := []string{"pbdf.pbdf.diplomaMaster", "pbdf.pbdf.diplomaBachelor"}
+	var response issueResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(response.Credentials, want) || len(response.Attributes) != len(want) {
+		t.Errorf("got credentials %v with %d attribute lists, want %v", response.Credentials, len(response.Attributes), want)
+	}
+	data, err := ioutil.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record auditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(record.CredentialTypes, want) || record.Error != "" {
+		t.Errorf("got audit record %s", data)
+	}
+}
+
+// With optional_dateofbirth, a disclosed date of birth must still match, and
+// without one the issuance request doesn't ask for it.
+func TestIssueOptionalDateOfBirth(t *testing.T) {
+	c, key, serverURL := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	body, contentType := issueForm(t, readTestPDF(t))
+	tests := []struct {
+		name        string
+		optional    bool
+		dateOfBirth string // not disclosed when empty
+		status      int
+		error       string
+	}{
+		{"disclosed and matching", true, "03-03-1990", 200, ""},
+		{"disclosed and mismatching", true, "04-03-1990", 400, ErrorDateOfBirthMatch},
+		{"not disclosed", true, "", 200, ""},
+		{"not disclosed, required", false, "", 400, ErrorAttributesMissing},
+	}
+	for _, tc := range tests {
+		c.OptionalDateOfBirth = tc.optional
+		attributes := map[string]string{
+			"pbdf.pbdf.idin.initials":   "J.",
+			"pbdf.pbdf.idin.familyname": "Jansen",
+		}
+		if tc.dateOfBirth != "" {
+			attributes["pbdf.pbdf.idin.dateofbirth"] = tc.dateOfBirth
+		}
+		withDisclosedAttributes(t, c, attributes)
+		resp, data := postIssueBody(t, serverURL, body, http.Header{"Content-Type": {contentType}})
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %s: %q", tc.name, resp.Status, data)
+			continue
+		}
+		if tc.error != "" {
+			if string(data) != "error:"+tc.error {
+				t.Errorf("%s: got %q, want error %s", tc.name, data, tc.error)
+			}
+			continue
+		}
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(string(data), claims, func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		}); err != nil {
+			t.Errorf("%s: invalid issuance JWT: %v", tc.name, err)
+			continue
+		}
+		request, _ := json.Marshal(claims["iprequest"])
+		asked := strings.Contains(string(request), "pbdf.pbdf.idin.dateofbirth")
+		if want := tc.dateOfBirth != ""; asked != want {
+			t.Errorf("%s: issuance request asks for the date of birth: %v, want %v", tc.name, asked, want)
+		}
+	}
+}
+
+// Clients that accept JSON get the signed request in an envelope with the
+// metadata, others get the bare JWT.
+func TestIssueAccept(t *testing.T) {
+	_, _, serverURL := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	body, contentType := issueForm(t, readTestPDF(t))
+	tests := []struct {
+		accept string
+		json   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/plain", false},
+		{"application/json", true},
+		{"application/json, text/plain;q=0.5", true},
+	}
+	for _, tc := range tests {
+		header := http.Header{"Content-Type": {contentType}}
+		if tc.accept != "" {
+			header.Set("Accept", tc.accept)
+		}
+		resp, data := postIssueBody(t, serverURL, body, header)
+		if resp.StatusCode != 200 {
+			t.Errorf("Accept %q: got %s: %q", tc.accept, resp.Status, data)
+			continue
+		}
+		isJSON := resp.Header.Get("Content-Type") == "application/json"
+		if isJSON != tc.json {
+			t.Errorf("Accept %q: got Content-Type %q", tc.accept, resp.Header.Get("Content-Type"))
+			continue
+		}
+		if !tc.json {
+			if _, _, err := new(jwt.Parser).ParseUnverified(string(data), &issuanceClaims{}); err != nil {
+				t.Errorf("Accept %q: got %q, want a JWT: %v", tc.accept, data, err)
+			}
+			continue
+		}
+		var response issueResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			t.Errorf("Accept %q: %v", tc.accept, err)
+			continue
+		}
+		if _, _, err := new(jwt.Parser).ParseUnverified(response.JWT, &issuanceClaims{}); err != nil {
+			t.Errorf("Accept %q: got JWT %q: %v", tc.accept, response.JWT, err)
+		}
+		if response.Session != nil || response.SigningTime != nil {
+			t.Errorf("Accept %q: got session %s and signing time %v", tc.accept, response.Session, response.SigningTime)
+		}
+		if !reflect.DeepEqual(response.Credentials, []string{"pbdf.pbdf.diploma"}) || len(response.Attributes) != 1 {
+			t.Errorf("Accept %q: got credentials %v with attributes %v", tc.accept, response.Credentials, response.Attributes)
+		}
+		if bytes.Contains(data, []byte(testDiploma.Education)) {
+			t.Errorf("Accept %q: response contains the diploma: %s", tc.accept, data)
+		}
+	}
+}
+
+// A diploma listed more than once in an extract, possibly formatted
+// differently, is only issued once.
+func TestIssueDuplicateDiplomas(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	reformatted := testDiploma
+	reformatted.Institute = strings.ToUpper(testDiploma.Institute) + " "
+	bachelor := testDiploma
+	bachelor.Education, bachelor.Degree = "B Verpleegkunde", "HBO Bachelor"
+	state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: fixedExtractor{testDiploma, bachelor, testDiploma, reformatted}})}
+	currentState.Store(state)
+
+	body, contentType := issueForm(t, readTestPDF(t))
+	r := httptest.NewRequest("POST", "/api/issue", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	apiIssue(w, r, state)
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var response issueResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Credentials) != 2 {
+		t.Errorf("got %d credentials, want 2", len(response.Credentials))
+	}
+}
+
+// A valid PDF without diplomas, e.g. another document from DUO, doesn't issue
+// an empty request.
+func TestIssueNoDiploma(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: fixedExtractor{}})}
+	w := postIssue(t, state, map[string]string{"attributes": "disclosure-jwt"}, readTestPDF(t))
+	if w.Code != 400 || w.Body.String() != "error:"+ErrorNoDiplomaFound {
+		t.Errorf("got %d: %s", w.Code, w.Body)
+	}
+}
+
+// Attribute variants are issued next to the attributes they are derived from,
+// which keep their extracted value.
+func TestIssueAttributeVariants(t *testing.T) {
+	c, key, serverURL := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	c.AttributeVariants = map[string]AttributeVariant{"city_normalized": {From: "city", Transform: "title"}}
+	body, contentType := issueForm(t, readTestPDF(t))
+	resp, data := postIssueBody(t, serverURL, body, http.Header{"Content-Type": {contentType}})
+	if resp.StatusCode != 200 {
+		t.Fatalf("got %s: %s", resp.Status, data)
+	}
+	claims := &issuanceClaims{}
+	if _, err := jwt.ParseWithClaims(string(data), claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	attributes := claims.Request.Request.Credentials[0].Attributes
+	if attributes["city"] != "NIJMEGEN" || attributes["city_normalized"] != "Nijmegen" {
+		t.Errorf("got attributes %v", attributes)
+	}
+}
+
+// Extractor that fails the test when it is called.
+type unexpectedExtractor struct{ t *testing.T }
+
+func (e unexpectedExtractor) Extract(pdfData []byte) ([]duo.Diploma, []duo.Warning, error) {
+	e.t.Error("extractor called")
+	return nil, nil, nil
+}
+
+// Uploads that aren't PDF files are refused before any verification.
+func TestIssueNotAPDF(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: unexpectedExtractor{t}})}
+	for name, data := range map[string][]byte{
+		"JPEG":        {0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F'},
+		"DOCX":        []byte("PK\x03\x04\x14\x00\x06\x00"),
+		"text":        []byte("just some text"),
+		"empty":       {},
+		"magic later": []byte("\n%PDF-1.7"),
+	} {
+		w := postIssue(t, state, map[string]string{"attributes": "disclosure-jwt"}, data)
+		if w.Code != 400 || w.Body.String() != "error:"+ErrorNotAPDF {
+			t.Errorf("%s: got %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+// With allowed_levels, diplomas are only issued when one of their levels is
+// allowed, and a single diploma of another level refuses the whole upload.
+func TestIssueAllowedLevels(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	normalized := testDiploma
+	normalized.NormalizedDegree = "wo-master"
+	mbo := testDiploma
+	mbo.Education, mbo.Degree, mbo.Profile = "Verpleegkundige", "", "Zorg en welzijn"
+	vwo := testDiploma
+	vwo.Education, vwo.Degree = "VWO", ""
+	tests := []struct {
+		name     string
+		allowed  []string
+		diplomas []duo.Diploma
+		error    string // empty when issued
+	}{
+		{"no allowlist", nil, []duo.Diploma{testDiploma, mbo}, ""},
+		{"degree", []string{"WO Master"}, []duo.Diploma{testDiploma}, ""},
+		{"degree, other case and spacing", []string{" wo  master"}, []duo.Diploma{testDiploma}, ""},
+		{"normalized degree", []string{"wo-master", "hbo-bachelor"}, []duo.Diploma{normalized}, ""},
+		{"normalized degree not extracted", []string{"wo-master"}, []duo.Diploma{testDiploma}, ErrorLevelNotAllowed},
+		{"profile", []string{"zorg en welzijn"}, []duo.Diploma{mbo}, ""},
+		{"education", []string{"VWO"}, []duo.Diploma{vwo}, ""},
+		{"not allowed", []string{"HBO Bachelor"}, []duo.Diploma{testDiploma}, ErrorLevelNotAllowed},
+		{"without degree", []string{"WO Master"}, []duo.Diploma{vwo}, ErrorLevelNotAllowed},
+		{"one diploma not allowed", []string{"WO Master"}, []duo.Diploma{testDiploma, mbo}, ErrorLevelNotAllowed},
+	}
+	for _, tc := range tests {
+		c.AllowedLevels = tc.allowed
+		state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: fixedExtractor(tc.diplomas)})}
+		w := postIssue(t, state, map[string]string{"attributes": "disclosure-jwt"}, readTestPDF(t))
+		if tc.error == "" && w.Code != 200 || tc.error != "" && (w.Code != 400 || w.Body.String() != "error:"+tc.error) {
+			t.Errorf("%s: got %d: %s", tc.name, w.Code, w.Body)
+		}
+	}
+}
+
+// Disclosure groups are asked for after the built-in attributes and, with
+// require_match_to, must match the diploma. The issuance request pins them to
+// the disclosed value.
+func TestIssueDisclosureGroups(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	c.DisclosureGroups = []DisclosureGroup{
+		{
+			Label:      "Email",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.email.email")},
+		},
+		{
+			Label:          "Student",
+			Attributes:     []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.studentcard.university")},
+			RequireMatchTo: "institute",
+		},
+	}
+	state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: fixedExtractor{testDiploma}})}
+	tests := []struct {
+		name       string
+		university string // not disclosed when empty
+		status     int
+		body       string // error response, when not issued
+	}{
+		{"match", "Radboud Universiteit", 200, ""},
+		{"match after normalizing", "  RADBOUD universiteit", 200, ""},
+		{"mismatch", "Universiteit Utrecht", 400, `{"error":"attribute-match","field":"Student","diploma":0}`},
+		{"not disclosed", "", 400, "error:" + ErrorAttributesMissing},
+	}
+	for _, tc := range tests {
+		attributes := map[string]string{
+			"pbdf.pbdf.idin.initials":    "J.",
+			"pbdf.pbdf.idin.familyname":  "Jansen",
+			"pbdf.pbdf.idin.dateofbirth": "03-03-1990",
+			"pbdf.pbdf.email.email":      "jan@example.com",
+		}
+		if tc.university != "" {
+			attributes["pbdf.pbdf.studentcard.university"] = tc.university
+		}
+		withDisclosedAttributes(t, c, attributes)
+		s := &recordingSigner{}
+		withSigner(t, s)
+
+		body, contentType := issueForm(t, readTestPDF(t))
+		r := httptest.NewRequest("POST", "/api/issue", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		apiIssue(w, r, state)
+		if w.Code != tc.status || tc.body != "" && strings.TrimSpace(w.Body.String()) != tc.body {
+			t.Errorf("%s: got %d: %s", tc.name, w.Code, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		disclose := s.issuance.Disclose
+		if len(disclose) != 5 {
+			t.Fatalf("%s: got %d disjunctions, want 5", tc.name, len(disclose))
+		}
+		for i, want := range []string{"jan@example.com", tc.university} {
+			disjunction := disclose[3+i]
+			if disjunction.Label != c.DisclosureGroups[i].Label {
+				t.Errorf("%s: got disjunction %q, want %q", tc.name, disjunction.Label, c.DisclosureGroups[i].Label)
+			}
+			if value := disjunction.Values[c.DisclosureGroups[i].Attributes[0]]; value == nil || *value != want {
+				t.Errorf("%s: %s is not pinned to %q", tc.name, disjunction.Label, want)
+			}
+		}
+	}
+}
+
+// Encrypted and truncated PDFs are refused with their own error codes, so the
+// user knows to upload the original extract again.
+func TestIssueEncryptedTruncated(t *testing.T) {
+	c, _, _ := startIssueServer(t, time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC))
+	state := &serverState{c, duo.New(x509.NewCertPool(), duo.Options{Extractor: unexpectedExtractor{t}})}
+	pdf := readTestPDF(t)
+	encrypted := []byte("%PDF-1.7\n1 0 obj\n<< /Filter /Standard /V 5 /R 6 /Length 256 /P -3904 >>\nendobj\n" +
+		"trailer\n<< /Size 2 /Encrypt 1 0 R >>\nstartxref\n0\n%%EOF\n")
+	tests := []struct {
+		name  string
+		pdf   []byte
+		error string
+	}{
+		{"encrypted", encrypted, ErrorEncryptedPDF},
+		{"truncated", pdf[:len(pdf)/2], ErrorTruncatedPDF},
+		{"header only", pdf[:len("%PDF-1.4\n")], ErrorTruncatedPDF},
+	}
+	for _, tc := range tests {
+		w := postIssue(t, state, map[string]string{"attributes": "disclosure-jwt"}, tc.pdf)
+		if w.Code != 400 || w.Body.String() != "error:"+tc.error {
+			t.Errorf("%s: got %d: %s", tc.name, w.Code, w.Body)
+		}
+	}
+}
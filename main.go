@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/privacybydesign/irma_duo_issuer/duo"
 	"github.com/privacybydesign/irmago"
 )
 
@@ -13,46 +19,477 @@ import (
 var (
 	tmpDir          string
 	certDir         string
+	intermediateDir string
+	tsaRootDir      string
 	configDir       string
 	serverStaticDir string
 	enableDebug     bool
 	keepOutput      bool
+	maxHTMLSize     int64
+	maxPages        int
+	retries         int
+	devMode         bool
+	skipVerify      bool
+	wrapLabels      string
+	updateGolden    bool
+	maxDepth        int
+	warmUp          bool
 )
 
 type Config struct {
 	InitialsAttributes    []irma.AttributeTypeIdentifier `json:"initials_attributes"`
 	FamilyNameAttributes  []irma.AttributeTypeIdentifier `json:"familyname_attributes"`
 	DateOfBirthAttributes []irma.AttributeTypeIdentifier `json:"dateofbirth_attributes"`
+	OptionalDateOfBirth   bool                           `json:"optional_dateofbirth"`
+	IdentifierAttributes  []irma.AttributeTypeIdentifier `json:"identifier_attributes"`
+	DisclosureGroups      []DisclosureGroup              `json:"disclosure_groups"`
 	DUOCrendentialID      string                         `json:"duo_credential_id"`
 	CORSDomain            string                         `json:"cors_domain"`
+	CORSOrigins           []string                       `json:"cors_origins"`
+	CORSCredentials       bool                           `json:"cors_credentials"`
+	CORSMaxAge            int                            `json:"cors_max_age_seconds"`
+	StaticMaxAge          int                            `json:"static_max_age_seconds"`
+	HTTPSHeader           string                         `json:"https_header"` // e.g. X-Forwarded-Proto
+	HTTPSRedirect         bool                           `json:"https_redirect"`
+	CredentialValidity    int                            `json:"credential_validity"`   // in months
+	CredentialValidities  map[string]int                 `json:"credential_validities"` // credential type -> months
+	CredentialTypes       map[string]string              `json:"credential_types"`      // degree -> credential type
+	ValidityFromAchieved  bool                           `json:"validity_from_achieved"`
+	TLSCert               string                         `json:"tls_cert"`
+	TLSKey                string                         `json:"tls_key"`
+	AutocertHostname      string                         `json:"autocert_hostname"`
+	AutocertCacheDir      string                         `json:"autocert_cache_dir"`
+	AdminSecret           string                         `json:"admin_secret"`
+	PprofAddr             string                         `json:"pprof_addr"`           // host:port, read at startup only
+	AttributeTransforms   map[string]string              `json:"attribute_transforms"` // attribute name -> transform
+	AttributeVariants     map[string]AttributeVariant    `json:"attribute_variants"`   // new attribute name -> variant
+	AttributeDefaults     map[string]string              `json:"attribute_defaults"`   // attribute name -> value when empty
+	AllowedInstitutes     []string                       `json:"allowed_institutes"`
+	AllowedLevels         []string                       `json:"allowed_levels"`
+	ClockSkewSeconds      int                            `json:"clock_skew_seconds"`
+	NameMatchMode         string                         `json:"name_match_mode"`
+	NameMatchThreshold    int                            `json:"name_match_threshold"`
+	NameMatchParts        bool                           `json:"name_match_parts"`
+	ParseEducationField   bool                           `json:"parse_education_field"`
+	BasePath              string                         `json:"base_path"`
+	IncludeDocumentType   bool                           `json:"include_document_type"`
+	StrictLabels          bool                           `json:"strict_labels"`
+	Extractor             string                         `json:"extractor"`
+	NormalizeDegree       bool                           `json:"normalize_degree"`
+	DegreeNormalization   map[string]string              `json:"degree_normalization"` // raw degree -> normalized degree
+	IncludeLanguage       bool                           `json:"include_language"`
+	IncludeDistinction    bool                           `json:"include_distinction"`
+	IncludeTranscript     bool                           `json:"include_transcript"`
+	InstituteSeparator    string                         `json:"institute_separator"`
+	RequestorName         string                         `json:"requestor_name"`
+	JWTKeyID              string                         `json:"jwt_key_id"`
+	SigningKeys           map[string]string              `json:"signing_keys"`        // key ID -> private key file in the config dir
+	AuditLog              string                         `json:"audit_log"`           // path, opened at startup only
+	AuditKey              string                         `json:"audit_key"`           // secret for the chain of the audit log
+	ReadHeaderTimeout     int                            `json:"read_header_timeout"` // in seconds, like the other timeouts
+	ReadTimeout           int                            `json:"read_timeout"`
+	WriteTimeout          int                            `json:"write_timeout"`
+	IdleTimeout           int                            `json:"idle_timeout"`
+	MaxExtractions        int                            `json:"max_extractions"` // concurrent, 0 for no limit
+	ExtractionWait        int                            `json:"extraction_wait"` // in seconds
+	RequiredAttributes    []string                       `json:"required_attributes"`
+	UnpinnedAttributes    []string                       `json:"unpinned_attributes"`
+	SessionBinding        bool                           `json:"session_binding"`
+	SignatureLocations    []string                       `json:"signature_locations"`
+	SignatureSubFilters   []string                       `json:"signature_subfilters"`
+	MinSigningKeyBits     int                            `json:"min_signing_key_bits"` // 0 for no minimum
+	RejectSHA1Signatures  bool                           `json:"reject_sha1_signatures"`
+	IRMAServerURL         string                         `json:"irma_server_url"`
+	PDFURLHosts           []string                       `json:"pdf_url_hosts"`
 }
 
-var config Config
+// An additional disjunction of attributes to disclose, e.g. a verified email
+// address, optionally matched against an extracted attribute of the diploma.
+type DisclosureGroup struct {
+	Label          string                         `json:"label"`
+	Attributes     []irma.AttributeTypeIdentifier `json:"attributes"`
+	RequireMatchTo string                         `json:"require_match_to"` // extracted attribute name, optional
+}
+
+// An additional attribute derived from an extracted attribute, e.g. a
+// title-cased city next to the uppercase city from the diploma.
+type AttributeVariant struct {
+	From      string `json:"from"`
+	Transform string `json:"transform"`
+}
 
+// The configuration as loaded at startup. While serving, the API handlers use
+// the config in currentState instead, as it may be reloaded.
+var config = defaultConfig()
+
+// Defaults for values not present in the config file.
+func defaultConfig() Config {
+	return Config{
+		CredentialValidity: 12,
+		ClockSkewSeconds:   300,
+		NameMatchMode:      nameMatchInitials,
+		NameMatchThreshold: 2,
+		RequestorName:      "Privacy by Design Foundation",
+		JWTKeyID:           "duo",
+		ReadHeaderTimeout:  10,
+		ReadTimeout:        60,
+		WriteTimeout:       120, // includes running pdf2htmlEX
+		IdleTimeout:        120,
+		ExtractionWait:     10,
+		CORSMaxAge:         600,
+		MinSigningKeyBits:  duo.DefaultMinKeyBits,
+	}
+}
+
+// Read and validate the config file, with options overridden by environment
+// variables. The global config is only replaced when
+// the new config is valid.
 func readConfig() error {
+	newConfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	config = *newConfig
+	return nil
+}
+
+func loadConfig() (*Config, error) {
 	data, err := readFile(configDir + "/config.json")
 	if err != nil {
+		return nil, err
+	}
+
+	newConfig := new(Config)
+	*newConfig = defaultConfig()
+	err = json.Unmarshal(data, newConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = newConfig.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = newConfig.validate()
+	if err != nil {
+		return nil, err
+	}
+	return newConfig, nil
+}
+
+// Check whether the loaded config makes sense, to catch configuration mistakes
+// at startup instead of at the first request.
+func (c *Config) validate() error {
+	if c.CredentialValidity <= 0 {
+		return errors.New("credential_validity must be a positive number of months")
+	}
+	for credential, months := range c.CredentialValidities {
+		if months <= 0 {
+			return errors.New("validity of " + credential + " must be a positive number of months")
+		}
+	}
+	for degree, credential := range c.CredentialTypes {
+		if credential == "" {
+			return errors.New("credential type of degree " + degree + " cannot be empty")
+		}
+	}
+	if c.CORSCredentials && c.CORSDomain == "*" {
+		return errors.New("cors_credentials cannot be used with a cors_domain of *")
+	}
+	if c.RequestorName == "" || c.JWTKeyID == "" {
+		return errors.New("requestor_name and jwt_key_id cannot be empty")
+	}
+	if _, ok := c.SigningKeys[c.JWTKeyID]; c.SigningKeys != nil && !ok {
+		return errors.New("signing_keys must contain jwt_key_id " + c.JWTKeyID)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.TLSCert != "" {
+		if c.AutocertHostname != "" {
+			return errors.New("tls_cert and autocert_hostname cannot both be set")
+		}
+		for _, path := range []string{c.TLSCert, c.TLSKey} {
+			if _, err := os.Stat(path); err != nil {
+				return err
+			}
+		}
+	}
+	if c.AutocertHostname != "" && c.AutocertCacheDir == "" {
+		return errors.New("autocert_cache_dir must be set when using autocert")
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/")) {
+		return errors.New("base_path must start with a slash and must not end with one")
+	}
+	if strings.HasSuffix(c.IRMAServerURL, "/") {
+		return errors.New("irma_server_url must not end with a slash")
+	}
+	if c.ClockSkewSeconds < 0 {
+		return errors.New("clock_skew_seconds cannot be negative")
+	}
+	switch c.NameMatchMode {
+	case nameMatchStrict, nameMatchInitials, nameMatchFuzzy:
+	default:
+		return errors.New("unknown name_match_mode: " + c.NameMatchMode)
+	}
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+	if _, err := newExtractor(c.Extractor); err != nil {
 		return err
 	}
-	return json.Unmarshal(data, &config)
+	if c.CORSMaxAge < 0 {
+		return errors.New("cors_max_age_seconds cannot be negative")
+	}
+	if c.PprofAddr != "" {
+		// Require an explicit host, so it isn't served on all interfaces
+		// by accident.
+		if host, _, err := net.SplitHostPort(c.PprofAddr); err != nil || host == "" {
+			return errors.New("pprof_addr must be a host:port, e.g. 127.0.0.1:6060")
+		}
+	}
+	if c.AuditLog != "" && len(c.AuditKey) < minAuditKeyLength {
+		return fmt.Errorf("audit_log requires an audit_key of at least %d characters", minAuditKeyLength)
+	}
+	if c.StaticMaxAge < 0 {
+		return errors.New("static_max_age_seconds cannot be negative")
+	}
+	if c.MaxExtractions < 0 || c.ExtractionWait < 0 {
+		return errors.New("max_extractions and extraction_wait cannot be negative")
+	}
+	if c.MinSigningKeyBits < 0 {
+		return errors.New("min_signing_key_bits cannot be negative")
+	}
+	if c.NameMatchThreshold < 0 {
+		return errors.New("name_match_threshold cannot be negative")
+	}
+	attributeLists := map[string][]irma.AttributeTypeIdentifier{
+		"initials_attributes":    c.InitialsAttributes,
+		"familyname_attributes":  c.FamilyNameAttributes,
+		"dateofbirth_attributes": c.DateOfBirthAttributes,
+		"identifier_attributes":  c.IdentifierAttributes,
+	}
+	labels := make(map[string]bool)
+	for _, group := range c.DisclosureGroups {
+		if group.Label == "" || len(group.Attributes) == 0 {
+			return errors.New("disclosure groups need a label and attributes")
+		}
+		switch group.Label {
+		case "initials", "familyname", "dateofbirth", "identifier":
+			return errors.New("disclosure group label is reserved: " + group.Label)
+		}
+		if labels[group.Label] {
+			return errors.New("duplicate disclosure group label: " + group.Label)
+		}
+		labels[group.Label] = true
+		if group.RequireMatchTo != "" && !knownAttribute(group.RequireMatchTo) {
+			return errors.New("unknown attribute to match disclosure group " + group.Label + " to: " + group.RequireMatchTo)
+		}
+		attributeLists["disclosure group "+group.Label] = group.Attributes
+	}
+	for option, identifiers := range attributeLists {
+		for _, identifier := range identifiers {
+			if !validAttributeIdentifier(identifier.String()) {
+				return errors.New("invalid attribute identifier in " + option + ": " + identifier.String())
+			}
+		}
+	}
+	for _, location := range c.SignatureLocations {
+		if !duo.ValidSignatureLocation(location) {
+			return errors.New("unknown signature location: " + location)
+		}
+	}
+	if c.SignatureSubFilters != nil && len(c.SignatureSubFilters) == 0 {
+		return errors.New("signature_subfilters cannot be empty")
+	}
+	for _, subfilter := range c.SignatureSubFilters {
+		if !duo.ValidSubFilter(subfilter) {
+			return errors.New("unknown signature subfilter: " + subfilter)
+		}
+	}
+	for _, attribute := range c.RequiredAttributes {
+		if !knownAttribute(attribute) {
+			return errors.New("unknown required attribute: " + attribute)
+		}
+	}
+	for _, name := range c.UnpinnedAttributes {
+		switch name {
+		case "initials", "familyname", "dateofbirth", "identifier":
+		default:
+			if !labels[name] {
+				return errors.New("unknown unpinned attribute: " + name)
+			}
+		}
+	}
+	for name, variant := range c.AttributeVariants {
+		if knownAttribute(name) {
+			return errors.New("attribute variant cannot replace an extracted attribute: " + name)
+		}
+		if !knownAttribute(variant.From) {
+			return errors.New("unknown attribute for variant " + name + ": " + variant.From)
+		}
+		if _, ok := attributeTransforms[variant.Transform]; !ok {
+			return errors.New("unknown transform for variant " + name + ": " + variant.Transform)
+		}
+	}
+	for attribute, value := range c.AttributeDefaults {
+		if _, ok := c.AttributeVariants[attribute]; !ok && !knownAttribute(attribute) {
+			return errors.New("unknown attribute for default: " + attribute)
+		}
+		if strings.TrimSpace(value) == "" {
+			return errors.New("default for attribute " + attribute + " cannot be empty")
+		}
+	}
+	for raw, degree := range c.DegreeNormalization {
+		if strings.TrimSpace(degree) == "" {
+			return errors.New("normalized degree for " + raw + " cannot be empty")
+		}
+	}
+	for attribute, transform := range c.AttributeTransforms {
+		if !knownAttribute(attribute) {
+			// Variants have their own transform.
+			return errors.New("unknown attribute to transform: " + attribute)
+		}
+		if _, ok := attributeTransforms[transform]; !ok {
+			return errors.New("unknown transform for attribute " + attribute + ": " + transform)
+		}
+	}
+	return nil
+}
+
+// Whether the identifier has the form scheme.issuer.credential.attribute.
+func validAttributeIdentifier(identifier string) bool {
+	parts := strings.Split(identifier, ".")
+	if len(parts) != 4 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the attribute can be read from a diploma page.
+func knownAttribute(attribute string) bool {
+	for _, name := range duo.AttributeNames {
+		if name == attribute {
+			return true
+		}
+	}
+	return false
+}
+
+// The verifier for PDF extracts as created at startup. While serving, the API
+// handlers use the verifier in currentState instead, as it may be reloaded.
+var verifier *duo.Verifier
+
+// Create a verifier with the certificates in the certDir directories and the options set by
+// flags and the given config.
+func newVerifier(c *Config) (*duo.Verifier, error) {
+	pool := x509.NewCertPool()
+	opts := verifierOptions(c)
+	if !skipVerify {
+		var err error
+		pool, err = duo.LoadCertPool(strings.Split(certDir, ",")...)
+		if err != nil {
+			return nil, err
+		}
+		if intermediateDir != "" {
+			opts.Intermediates, err = duo.LoadCertPool(intermediateDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if tsaRootDir != "" {
+			opts.TSARoots, err = duo.LoadCertPool(tsaRootDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return duo.New(pool, opts), nil
+}
+
+// Return the extractor with the given name, for the extractor option. Nil
+// means the default duo.DUOExtractor.
+func newExtractor(name string) (duo.Extractor, error) {
+	switch name {
+	case "", "duo":
+		return nil, nil
+	default:
+		return nil, errors.New("unknown extractor: " + name)
+	}
+}
+
+// Options for a verifier as set by flags and the given config.
+func verifierOptions(c *Config) duo.Options {
+	extractor, _ := newExtractor(c.Extractor) // checked in validate
+	minKeyBits := c.MinSigningKeyBits
+	if minKeyBits == 0 {
+		minKeyBits = -1 // no minimum, instead of the library default
+	}
+	return duo.Options{
+		TmpDir:              tmpDir,
+		KeepOutput:          keepOutput,
+		Debug:               enableDebug,
+		MaxHTMLSize:         maxHTMLSize,
+		MaxPages:            maxPages,
+		Retries:             retries,
+		SkipVerification:    skipVerify,
+		ClockSkew:           time.Duration(c.ClockSkewSeconds) * time.Second,
+		ContinuationLabels:  strings.Split(wrapLabels, ","),
+		ParseEducationField: c.ParseEducationField,
+		IncludeDocumentType: c.IncludeDocumentType,
+		NormalizeDegree:     c.NormalizeDegree,
+		DegreeNormalization: c.DegreeNormalization,
+		IncludeLanguage:     c.IncludeLanguage,
+		IncludeDistinction:  c.IncludeDistinction,
+		IncludeTranscript:   c.IncludeTranscript,
+		InstituteSeparator:  c.InstituteSeparator,
+		RequiredAttributes:  c.RequiredAttributes,
+		SignatureLocations:  c.SignatureLocations,
+		SubFilters:          c.SignatureSubFilters,
+		MinKeyBits:          minKeyBits,
+		RejectSHA1:          c.RejectSHA1Signatures,
+		StrictLabels:        c.StrictLabels,
+		Extractor:           extractor,
+		Now:                 func() time.Time { return clock() },
+	}
 }
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s <command> [args...]\n", os.Args[0])
-		fmt.Fprintln(flag.CommandLine.Output(), "Available commands: help, read, server")
+		fmt.Fprintln(flag.CommandLine.Output(), "Available commands: help, read, dumptree, regress, certs check, audit verify, selftest, server")
 		fmt.Fprintln(flag.CommandLine.Output(), "Flags:")
 		flag.PrintDefaults()
 	}
 
 	flag.StringVar(&tmpDir, "tmpdir", "tmp", "Where to put temporary files for the pdf2htmlEX command")
-	flag.StringVar(&certDir, "certs", "certs", "Parent certificate directory (*.der)")
+	flag.StringVar(&certDir, "certs", "certs", "Comma-separated parent certificate directories (*.pem)")
+	flag.StringVar(&intermediateDir, "intermediates", "", "Directory with intermediate certificates (*.pem) between signing and parent certificates")
+	flag.StringVar(&tsaRootDir, "tsaroots", "", "Directory with timestamping authority root certificates (*.pem), to require and trust signature timestamps")
 	flag.StringVar(&configDir, "config", "config", "Directory with configuration files")
 	flag.StringVar(&serverStaticDir, "static", "static", "Static files to serve")
 	flag.BoolVar(&enableDebug, "debug", false, "Enable debug logging")
 	flag.BoolVar(&keepOutput, "keepoutput", false, "Do not remove temporary files")
+	flag.Int64Var(&maxHTMLSize, "maxhtmlsize", duo.DefaultMaxHTMLSize, "Maximum size in bytes of the HTML produced by pdf2htmlEX")
+	flag.IntVar(&maxPages, "maxpages", duo.DefaultMaxPages, "Maximum number of pages to process in a PDF")
+	flag.IntVar(&retries, "retries", duo.DefaultRetries, "How often to retry pdf2htmlEX when it fails (negative to not retry)")
+	flag.BoolVar(&devMode, "dev", false, "Development mode: sign with an ephemeral key instead of sk.pem")
+	flag.BoolVar(&skipVerify, "skipverify", false, "Do not verify PDF signatures (only allowed in development mode)")
+	flag.IntVar(&maxDepth, "maxdepth", 7, "Maximum depth of the object tree printed by the dumptree command")
+	flag.BoolVar(&warmUp, "warmup", false, "Run pdf2htmlEX once on startup of the server, so the first request isn't slowed down by initializing font caches")
+	flag.BoolVar(&updateGolden, "update", false, "Write missing golden files in the regress command")
+	flag.StringVar(&wrapLabels, "wraplabels", strings.Join(duo.DefaultContinuationLabels, ","), "Comma-separated labels of diploma values that may wrap to the next row")
 	flag.Parse()
 
+	if skipVerify && !devMode {
+		fmt.Fprintln(os.Stderr, "The -skipverify flag can only be used together with -dev.")
+		return
+	}
+
 	if flag.NArg() < 1 {
 		fmt.Println("Please provide a command")
 		return
@@ -61,12 +498,79 @@ func main() {
 	case "help", "usage":
 		flag.Usage()
 	case "read", "extract": // not sure what to call this
-		if flag.NArg() < 2 {
-			fmt.Fprintln(flag.CommandLine.Output(), "Provide at least one PDF path to \"read\".")
+		flags := flag.NewFlagSet("read", flag.ExitOnError)
+		issuance := flags.Bool("issuance", false, "Print the credentials that would be issued as JSON, using the config file")
+		flags.Parse(flag.Args()[1:])
+		if flags.NArg() < 1 {
+			fmt.Fprintln(flag.CommandLine.Output(), "Provide at least one PDF path (or - for stdin) to \"read\".")
+			flag.Usage()
+			return
+		}
+		if *issuance {
+			if err := readConfig(); err != nil {
+				fmt.Fprintln(os.Stderr, "Could not read config file: "+err.Error())
+				return
+			}
+		}
+		var err error
+		verifier, err = newVerifier(&config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not load certificates: "+err.Error())
+			return
+		}
+		cmdReadPDFs(flags.Args(), *issuance)
+	case "dumptree":
+		if flag.NArg() != 2 && flag.NArg() != 3 {
+			fmt.Fprintln(flag.CommandLine.Output(), "Provide a PDF path and optionally an output path to \"dumptree\".")
+			flag.Usage()
+			return
+		}
+		output := ""
+		if flag.NArg() == 3 {
+			output = flag.Arg(2)
+		}
+		if err := cmdDumpTree(flag.Arg(1), output); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not dump PDF tree: "+err.Error())
+			os.Exit(1)
+		}
+	case "regress":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(flag.CommandLine.Output(), "Provide a directory with samples to \"regress\".")
+			flag.Usage()
+			return
+		}
+		var err error
+		verifier, err = newVerifier(&config)
+		if err != nil {
+			// HTML samples can still be tested.
+			fmt.Fprintln(os.Stderr, "WARNING: could not load certificates, PDF samples will fail: "+err.Error())
+			verifier = duo.New(x509.NewCertPool(), verifierOptions(&config))
+		}
+		if !cmdRegress(flag.Arg(1), updateGolden) {
+			os.Exit(1)
+		}
+	case "certs":
+		if flag.NArg() < 2 || flag.Arg(1) != "check" {
+			fmt.Fprintln(flag.CommandLine.Output(), "Usage: certs check [-json] [-days n]")
+			flag.Usage()
+			return
+		}
+		if !cmdCertsCheck(flag.Args()[2:]) {
+			os.Exit(1)
+		}
+	case "audit":
+		if flag.NArg() != 3 || flag.Arg(1) != "verify" {
+			fmt.Fprintln(flag.CommandLine.Output(), "Usage: audit verify <file>")
 			flag.Usage()
 			return
 		}
-		cmdReadPDFs(flag.Args()[1:])
+		if !cmdAuditVerify(flag.Arg(2)) {
+			os.Exit(1)
+		}
+	case "selftest":
+		if !cmdSelftest() {
+			os.Exit(1)
+		}
 	case "server":
 		if flag.NArg() != 2 {
 			fmt.Fprintln(flag.CommandLine.Output(), "Provide a host:port to bind to for \"server\".")
@@ -78,6 +582,29 @@ func main() {
 			fmt.Fprintln(os.Stderr, "Could not read config file: "+err.Error())
 			return
 		}
+		verifier, err = newVerifier(&config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not load certificates: "+err.Error())
+			return
+		}
+		if devMode {
+			err = generateDevKey()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Could not generate development key: "+err.Error())
+				return
+			}
+		}
+		if skipVerify {
+			fmt.Fprintln(os.Stderr, "WARNING: PDF signatures are not verified, never use this in production!")
+		}
+		if warmUp {
+			duration, err := verifier.WarmUp()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "WARNING: pdf2htmlEX warm-up failed: "+err.Error())
+			} else {
+				fmt.Println("pdf2htmlEX warm-up took", duration)
+			}
+		}
 		cmdServe(flag.Arg(1))
 	default:
 		fmt.Fprintln(flag.CommandLine.Output(), "Unknown command:", flag.Arg(0))
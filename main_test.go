@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Malformed attribute identifiers are refused when loading the config, naming
+// the option and the identifier.
+func TestConfigAttributeIdentifiers(t *testing.T) {
+	oldConfigDir := configDir
+	t.Cleanup(func() { configDir = oldConfigDir })
+	configDir = t.TempDir()
+	tests := []struct {
+		config string
+		err    string // empty when the config is valid
+	}{
+		{`{"familyname_attributes": ["pbdf.pbdf.idin.familyname"]}`, ""},
+		{`{"familyname_attributes": ["pbdf.pbdf.idin"]}`, "invalid attribute identifier in familyname_attributes: pbdf.pbdf.idin"},
+		{`{"initials_attributes": ["pbdf..idin.initials"]}`, "invalid attribute identifier in initials_attributes: pbdf..idin.initials"},
+		{`{"dateofbirth_attributes": ["pbdf.pbdf.idin.dateofbirth."]}`, "invalid attribute identifier in dateofbirth_attributes: pbdf.pbdf.idin.dateofbirth."},
+		{`{"identifier_attributes": ["pbdf.gemeente.personalData.bsn.extra"]}`, "invalid attribute identifier in identifier_attributes: pbdf.gemeente.personalData.bsn.extra"},
+		{`{"identifier_attributes": [""]}`, "invalid attribute identifier in identifier_attributes: "},
+		{`{"disclosure_groups": [{"label": "student", "attributes": ["pbdf.pbdf.studentcard"]}]}`, "invalid attribute identifier in disclosure group student: pbdf.pbdf.studentcard"},
+	}
+	for _, tc := range tests {
+		if err := ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig()
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: got error %v, want %q", tc.config, err, tc.err)
+		}
+	}
+}
+
+// Only attributes that can be read from a diploma page can be required.
+func TestConfigRequiredAttributes(t *testing.T) {
+	oldConfigDir := configDir
+	t.Cleanup(func() { configDir = oldConfigDir })
+	configDir = t.TempDir()
+	tests := []struct {
+		config string
+		err    string // empty when the config is valid
+	}{
+		{`{}`, ""},
+		{`{"required_attributes": []}`, ""},
+		{`{"required_attributes": ["familyname", "dateofbirth", "degree"]}`, ""},
+		{`{"required_attributes": ["familyname", "surname"]}`, "unknown required attribute: surname"},
+		{`{"required_attributes": [""]}`, "unknown required attribute: "},
+	}
+	for _, tc := range tests {
+		if err := ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig()
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: got error %v, want %q", tc.config, err, tc.err)
+		}
+	}
+}
+
+// Disclosure group labels must be unique and can't shadow the built-in
+// disclosures, which they may be unpinned like.
+func TestConfigDisclosureGroups(t *testing.T) {
+	oldConfigDir := configDir
+	t.Cleanup(func() { configDir = oldConfigDir })
+	configDir = t.TempDir()
+	tests := []struct {
+		config string
+		err    string // empty when the config is valid
+	}{
+		{`{"disclosure_groups": [{"label": "Student", "attributes": ["pbdf.pbdf.studentcard.university"], "require_match_to": "institute"}]}`, ""},
+		{`{"disclosure_groups": [{"label": "Student", "attributes": ["pbdf.pbdf.studentcard.university"]}], "unpinned_attributes": ["Student", "familyname"]}`, ""},
+		{`{"unpinned_attributes": ["Student"]}`, "unknown unpinned attribute: Student"},
+		{`{"disclosure_groups": [{"label": "Student", "attributes": []}]}`, "disclosure groups need a label and attributes"},
+		{`{"disclosure_groups": [{"attributes": ["pbdf.pbdf.studentcard.university"]}]}`, "disclosure groups need a label and attributes"},
+		{`{"disclosure_groups": [{"label": "familyname", "attributes": ["pbdf.pbdf.studentcard.university"]}]}`, "disclosure group label is reserved: familyname"},
+		{`{"disclosure_groups": [{"label": "Student", "attributes": ["pbdf.pbdf.studentcard.university"]}, {"label": "Student", "attributes": ["pbdf.pbdf.email.email"]}]}`, "duplicate disclosure group label: Student"},
+		{`{"disclosure_groups": [{"label": "Student", "attributes": ["pbdf.pbdf.studentcard.university"], "require_match_to": "university"}]}`, "unknown attribute to match disclosure group Student to: university"},
+	}
+	for _, tc := range tests {
+		if err := ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig()
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: got error %v, want %q", tc.config, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// This file contains the policies to match the name (and identifier) disclosed
+// by the user against the name on a diploma.
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+// Values for the name_match_mode config option.
+const (
+	nameMatchStrict   = "strict"   // all initials and the normalized family name must match
+	nameMatchInitials = "initials" // the first initial and family name must match
+	nameMatchFuzzy    = "fuzzy"    // like initials, but the family name may differ slightly
+)
+
+// matchName checks the disclosed initials and family name against the diploma
+// using the configured name_match_mode. It returns the error code to send on a
+// mismatch, or "" when the names match.
+func matchName(c *Config, diploma *duo.Diploma, initials, familyname string) string {
+	if len(diploma.FirstName) == 0 || len(initials) == 0 {
+		// This is very unlikely.
+		return ErrorNoInitials
+	}
+
+	switch c.NameMatchMode {
+	case nameMatchStrict:
+		if !matchFamilyName(c, diploma, familyname, 0) {
+			return ErrorNameMatch
+		}
+		if onlyLetters(initials) != onlyLetters(firstNameInitials(diploma.FirstName)) {
+			return ErrorInitialsMatch
+		}
+	case nameMatchFuzzy:
+		if !matchFamilyName(c, diploma, familyname, c.NameMatchThreshold) {
+			return ErrorNameMatch
+		}
+		if diploma.FirstName[0] != initials[0] {
+			return ErrorInitialsMatch
+		}
+	default: // nameMatchInitials
+		if diploma.FamilyName != familyname &&
+			diploma.FullFamilyName() != familyname &&
+			!(c.NameMatchParts && matchFamilyNameParts(diploma, familyname, 0)) {
+			return ErrorNameMatch
+		}
+		if diploma.FirstName[0] != initials[0] {
+			return ErrorInitialsMatch
+		}
+	}
+	return ""
+}
+
+// Check whether the BSN on a diploma matches the disclosed identifier. Both
+// are normalized to the 9 digits of a BSN, as either side may leave out
+// leading zeros or add whitespace.
+func matchBSN(diplomaBSN, identifier string) bool {
+	return normalizeBSN(diplomaBSN) == normalizeBSN(identifier)
+}
+
+func normalizeBSN(bsn string) string {
+	bsn = strings.TrimSpace(bsn)
+	if len(bsn) < 9 {
+		bsn = strings.Repeat("0", 9-len(bsn)) + bsn
+	}
+	return bsn
+}
+
+// Check whether the normalized family name (with or without prefix) on the
+// diploma is within the given edit distance of the disclosed family name.
+func matchFamilyName(c *Config, diploma *duo.Diploma, familyname string, maxDistance int) bool {
+	familyname = normalize(familyname)
+	candidates := []string{diploma.FamilyName, diploma.FullFamilyName()}
+	for _, candidate := range candidates {
+		if levenshtein(normalize(candidate), familyname) <= maxDistance {
+			return true
+		}
+	}
+	return c.NameMatchParts && matchFamilyNameParts(diploma, familyname, maxDistance)
+}
+
+// Check whether the disclosed family name matches one of the parts of a
+// double family name on the diploma or the other way around, e.g. "de Vries"
+// or "Jansen" for "Jansen-de Vries". Names are normalized and each part may
+// differ by the given edit distance.
+func matchFamilyNameParts(diploma *duo.Diploma, familyname string, maxDistance int) bool {
+	familyname = normalize(familyname)
+	for _, candidate := range []string{diploma.FamilyName, diploma.FullFamilyName()} {
+		candidate = normalize(candidate)
+		for _, part := range familyNameParts(candidate) {
+			if levenshtein(part, familyname) <= maxDistance {
+				return true
+			}
+		}
+		for _, part := range familyNameParts(familyname) {
+			if levenshtein(part, candidate) <= maxDistance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Split a normalized double family name on hyphens, e.g. "jansen" and
+// "de vries" for "jansen-de vries". Returns nil for a single name.
+func familyNameParts(name string) []string {
+	parts := strings.Split(name, "-")
+	if len(parts) < 2 {
+		return nil
+	}
+	var result []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// Return the initials of the given first names, e.g. "JP" for "Jan Pieter".
+func firstNameInitials(firstnames string) string {
+	var initials []rune
+	for _, name := range strings.Fields(firstnames) {
+		initials = append(initials, []rune(name)[0])
+	}
+	return string(initials)
+}
+
+// Return only the letters of a normalized string, e.g. "JP" for "J. P.".
+func onlyLetters(s string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsLetter(r) {
+			return -1
+		}
+		return r
+	}, normalize(s))
+}
+
+// Return the Levenshtein (edit) distance between two strings.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		prev := row[0] // distance of ra[:i-1], rb[:j-1]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current := row[j]
+			row[j] = prev + cost // substitution
+			if current+1 < row[j] {
+				row[j] = current + 1 // deletion
+			}
+			if row[j-1]+1 < row[j] {
+				row[j] = row[j-1] + 1 // insertion
+			}
+			prev = current
+		}
+	}
+	return row[len(rb)]
+}
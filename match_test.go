@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+func TestMatchName(t *testing.T) {
+	jan := &duo.Diploma{FirstName: "Jan Pieter", FamilyName: "Vries", Prefix: "de"}
+	double := &duo.Diploma{FirstName: "Anna", FamilyName: "Jansen-de Vries"}
+	emptyPrefix := &duo.Diploma{FirstName: "Jan", FamilyName: "Vries", PrefixPresent: true}
+	single := &duo.Diploma{FirstName: "Anna", FamilyName: "Jansen"}
+	spaced := &duo.Diploma{FirstName: "Anna", FamilyName: "Jansen - de Vries"}
+	compound := &duo.Diploma{FirstName: "Anna", FamilyName: "Vries-Jansen", Prefix: "de"}
+	tests := []struct {
+		name       string
+		mode       string
+		parts      bool // name_match_parts
+		diploma    *duo.Diploma
+		initials   string
+		familyname string
+		want       string
+	}{
+		{"initials: exact", nameMatchInitials, false, jan, "J.P.", "Vries", ""},
+		{"initials: with prefix", nameMatchInitials, false, jan, "J.", "de Vries", ""},
+		{"initials: only the first initial", nameMatchInitials, false, jan, "J.X.", "Vries", ""},
+		{"initials: other initial", nameMatchInitials, false, jan, "P.", "Vries", ErrorInitialsMatch},
+		{"initials: case differs", nameMatchInitials, false, jan, "J.", "vries", ErrorNameMatch},
+		{"initials: typo", nameMatchInitials, false, jan, "J.", "Vreis", ErrorNameMatch},
+		{"initials: part without parts", nameMatchInitials, false, double, "A.", "Jansen", ErrorNameMatch},
+		{"initials: part", nameMatchInitials, true, double, "A.", "Jansen", ""},
+		{"initials: second part", nameMatchInitials, true, double, "A.", "de Vries", ""},
+		{"initials: part, case differs", nameMatchInitials, true, double, "A.", "DE VRIES", ""},
+		{"initials: part of disclosed name", nameMatchInitials, true, single, "A.", "Jansen-de Vries", ""},
+		{"initials: part of disclosed name without parts", nameMatchInitials, false, single, "A.", "Jansen-de Vries", ErrorNameMatch},
+		{"initials: part with spaces", nameMatchInitials, true, spaced, "A.", "de Vries", ""},
+		{"initials: part with prefix", nameMatchInitials, true, compound, "A.", "de Vries", ""},
+		{"initials: part without prefix", nameMatchInitials, true, compound, "A.", "Jansen", ""},
+		{"initials: partial part", nameMatchInitials, true, double, "A.", "Jans", ErrorNameMatch},
+		{"initials: other name", nameMatchInitials, true, double, "A.", "Pietersen", ErrorNameMatch},
+		{"initials: no initials", nameMatchInitials, false, jan, "", "Vries", ErrorNoInitials},
+		{"initials: empty prefix", nameMatchInitials, false, emptyPrefix, "J.", "Vries", ""},
+		{"initials: empty prefix with space", nameMatchInitials, false, emptyPrefix, "J.", " Vries", ErrorNameMatch},
+		{"strict: all initials", nameMatchStrict, false, jan, "J.P.", "Vries", ""},
+		{"strict: initials with spaces", nameMatchStrict, false, jan, "J. P.", "vries", ""},
+		{"strict: accents and case", nameMatchStrict, false, jan, "jp", "DE VRIËS", ""},
+		{"strict: missing initial", nameMatchStrict, false, jan, "J.", "Vries", ErrorInitialsMatch},
+		{"strict: extra initial", nameMatchStrict, false, jan, "J.P.K.", "Vries", ErrorInitialsMatch},
+		{"strict: typo", nameMatchStrict, false, jan, "J.P.", "Vreis", ErrorNameMatch},
+		{"strict: part", nameMatchStrict, true, double, "A.", "de vries", ""},
+		{"strict: part without parts", nameMatchStrict, false, double, "A.", "de vries", ErrorNameMatch},
+		{"strict: empty prefix", nameMatchStrict, false, emptyPrefix, "J.", "Vries", ""},
+		{"fuzzy: typo", nameMatchFuzzy, false, jan, "J.", "Vreis", ""},
+		{"fuzzy: empty prefix", nameMatchFuzzy, false, emptyPrefix, "J.", "Vreis", ""},
+		{"fuzzy: two edits", nameMatchFuzzy, false, jan, "J.", "Friez", ""},
+		{"fuzzy: three edits", nameMatchFuzzy, false, jan, "J.", "Fryez", ErrorNameMatch},
+		{"fuzzy: too different", nameMatchFuzzy, false, jan, "J.", "Jansen", ErrorNameMatch},
+		{"fuzzy: part with typo", nameMatchFuzzy, true, double, "A.", "Jansne", ""},
+		{"fuzzy: other initial", nameMatchFuzzy, false, jan, "K.", "Vries", ErrorInitialsMatch},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.NameMatchMode = tc.mode
+		c.NameMatchParts = tc.parts
+		if got := matchName(&c, tc.diploma, tc.initials, tc.familyname); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"vries", "vries", 0},
+		{"vries", "", 5},
+		{"vries", "vreis", 2},
+		{"vries", "fries", 1},
+		{"jansen", "janssen", 1},
+		{"müller", "muller", 1},
+	}
+	for _, tc := range tests {
+		if d := levenshtein(tc.a, tc.b); d != tc.distance {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tc.a, tc.b, d, tc.distance)
+		}
+		if d := levenshtein(tc.b, tc.a); d != tc.distance {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tc.b, tc.a, d, tc.distance)
+		}
+	}
+}
+
+func TestMatchBSN(t *testing.T) {
+	tests := []struct {
+		diploma, identifier string
+		match               bool
+	}{
+		{"123456782", "123456782", true},
+		{"123456782", " 123456782\n", true},
+		{"012345672", "12345672", true},
+		{"12345672", "012345672", true},
+		{" 12345672", "012345672 ", true},
+		{"123456782", "123456783", false},
+		{"012345672", "123456720", false},
+		{"123456782", "", false},
+	}
+	for _, tc := range tests {
+		if match := matchBSN(tc.diploma, tc.identifier); match != tc.match {
+			t.Errorf("%q, %q: got %v, want %v", tc.diploma, tc.identifier, match, tc.match)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+// This file contains the client that fetches PDFs passed to /api/issue as a
+// pdf_url, for integrators that store diplomas themselves. As the URL comes
+// from the client, the fetch is restricted to prevent server-side request
+// forgery: only HTTPS URLs on the hosts in pdf_url_hosts are fetched, only
+// public IP addresses are connected to, and responses are size limited.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Maximum size of a PDF fetched from a pdf_url, the same as for uploads.
+const maxPDFURLSize = 1024 * 1024
+
+// Maximum number of redirects followed, each to an allowed host.
+const maxPDFURLRedirects = 3
+
+var (
+	errPDFURLNotAllowed = errors.New("pdf_url is not an HTTPS URL on an allowed host")
+	errPDFURLTooBig     = errors.New("PDF at pdf_url is too big")
+)
+
+var pdfURLClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		// No proxy from the environment: the address checks below must
+		// apply to the host that is actually connected to.
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkPDFURLAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+}
+
+// Check whether the URL may be fetched: it must be HTTPS, on one of the hosts
+// in pdf_url_hosts, and without credentials.
+func checkPDFURL(c *Config, u *url.URL) error {
+	if u.Scheme != "https" || u.User != nil {
+		return errPDFURLNotAllowed
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range c.PDFURLHosts {
+		if host == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return errPDFURLNotAllowed
+}
+
+// Address ranges that net.IP has no predicate for: "this network" and the
+// shared address space used for carrier-grade NAT.
+var nonPublicNets = ipNets{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+type ipNets []*net.IPNet
+
+func (nets ipNets) Contains(ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Refuse to connect to addresses that aren't public, so an allowed host that
+// resolves to an internal address can't be used to reach internal services.
+// This runs after name resolution, for every connection including redirects.
+func checkPDFURLAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || nonPublicNets.Contains(ip) || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// Fetch the PDF at the given URL, which must pass checkPDFURL.
+func fetchPDF(c *Config, rawurl string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errPDFURLNotAllowed
+	}
+	if err := checkPDFURL(c, u); err != nil {
+		return nil, err
+	}
+	// Redirects are checked against the same config.
+	client := *pdfURLClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxPDFURLRedirects {
+			return errors.New("too many redirects")
+		}
+		return checkPDFURL(c, req.URL)
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("fetching pdf_url returned " + resp.Status)
+	}
+	// Read one byte more to detect whether the limit has been exceeded.
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPDFURLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPDFURLSize {
+		return nil, errPDFURLTooBig
+	}
+	return data, nil
+}
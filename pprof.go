@@ -0,0 +1,35 @@
+package main
+
+// This file contains the optional profiling listener, for attaching go tool
+// pprof to a running server. It is never served on the public listener.
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// The net/http/pprof handlers. Importing net/http/pprof registers them on
+// http.DefaultServeMux as well, which is why the public routes are on their
+// own mux.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serve the pprof handlers on addr, e.g. 127.0.0.1:6060.
+func servePprof(addr string) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           pprofHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Println("serving pprof from", addr)
+	log.Fatalln("cannot serve pprof:", server.ListenAndServe())
+}
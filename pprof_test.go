@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofAddrValidation(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"", true}, // disabled
+		{"127.0.0.1:6060", true},
+		{"localhost:6060", true},
+		{"[::1]:6060", true},
+		{"10.0.0.5:6060", true},
+		{":6060", false}, // all interfaces
+		{"6060", false},
+		{"127.0.0.1", false},
+		{"[::1]", false},
+		{"127.0.0.1:6060:1", false},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.PprofAddr = tc.addr
+		err := c.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%q: unexpected error %v", tc.addr, err)
+		} else if !tc.valid && (err == nil || !strings.Contains(err.Error(), "pprof_addr")) {
+			t.Errorf("%q: got %v, want a pprof_addr error", tc.addr, err)
+		}
+	}
+}
+
+// The pprof handlers, which net/http/pprof also registers on
+// http.DefaultServeMux, must only be served by the pprof listener.
+func TestPprofNotPublic(t *testing.T) {
+	oldStaticDir := serverStaticDir
+	defer func() { serverStaticDir = oldStaticDir }()
+	serverStaticDir = t.TempDir()
+	paths := []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/symbol"}
+	for _, basePath := range []string{"", "/duo"} {
+		c := defaultConfig()
+		c.BasePath = basePath
+		c.PprofAddr = "127.0.0.1:6060"
+		handler := newServerHandler(&c)
+		for _, path := range paths {
+			for _, prefix := range []string{"", basePath} {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", prefix+path, nil))
+				if w.Code != 404 {
+					t.Errorf("public listener with base path %q serves %s with %d", basePath, prefix+path, w.Code)
+				}
+			}
+		}
+	}
+	for _, path := range paths {
+		w := httptest.NewRecorder()
+		pprofHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Errorf("pprof listener serves %s with %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+// This file contains a small command-line interface to verify PDF files and
+// print their attributes (see main.go).
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+// Command to read attributes from PDF files and dump it's output. Used for
+// debugging and such.
+func cmdReadPDFs(paths []string, issuance bool) {
+	for i, path := range paths {
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Println("Processing:", path)
+		cmdReadSinglePDF(path, issuance)
+	}
+}
+
+// Command to read a single PDF file and dum it's output. The path "-" reads
+// from stdin, for use in pipelines. With issuance, the credential requests
+// that apiIssue would build are printed as JSON instead.
+func cmdReadSinglePDF(path string, issuance bool) {
+	var pdfData []byte
+	var err error
+	if path == "-" {
+		pdfData, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		pdfData, err = readFile(path)
+	}
+	if err != nil {
+		fmt.Println("could not read input PDF:", err)
+		return
+	}
+
+	diplomas, warnings, err := verifier.VerifyAndExtract(pdfData)
+	for _, warning := range warnings {
+		fmt.Println("warning:", warning)
+	}
+	if err != nil {
+		fmt.Println("could not extract attributes:", err)
+		return
+	}
+
+	if issuance {
+		credentials, err := credentialRequests(&config, diplomas)
+		if err != nil {
+			fmt.Println("could not build credentials:", err)
+			return
+		}
+		data, err := json.MarshalIndent(credentials, "", "\t")
+		if err != nil {
+			fmt.Println("could not encode credentials:", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	for _, diploma := range diplomas {
+		attributes := diploma.Attributes()
+		// Pretty-print attributes in the way they're extracted.
+		var keys []string
+		for key := range attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Println("extracted and verified attributes:")
+		for _, key := range keys {
+			fmt.Printf("  %-12s: %s\n", key, attributes[key])
+		}
+	}
+}
+
+// Command to print the object tree of a PDF file, to stdout or to the given
+// output file when it isn't empty. Used to diagnose PDFs that cannot be
+// verified.
+func cmdDumpTree(path, output string) error {
+	pdfData, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return duo.DumpTree(w, pdfData, maxDepth)
+}
@@ -0,0 +1,95 @@
+package main
+
+// This file contains the regress command, which runs the extractor over a
+// corpus of sample documents and compares the result with the expected output,
+// to notice when changes in DUO documents or pdf2htmlEX break extraction.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+// Run the extractor over all samples in dir and compare the attributes with
+// the golden file next to each sample. Samples are either signed PDFs (*.pdf),
+// which are verified as well, or HTML as produced by pdf2htmlEX (*.html),
+// which can be synthetic so no personal data needs to be stored. The golden
+// file of sample.pdf is sample.json, containing a JSON list with the attributes
+// of every diploma. Missing golden files are written when update is set.
+// Returns whether all samples matched.
+func cmdRegress(dir string, update bool) bool {
+	var samples []string
+	for _, pattern := range []string{"*.pdf", "*.html"} {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			fmt.Println("FAIL: cannot list samples:", err)
+			return false
+		}
+		samples = append(samples, paths...)
+	}
+	if len(samples) == 0 {
+		fmt.Println("FAIL: no samples found in", dir)
+		return false
+	}
+
+	ok := true
+	for _, path := range samples {
+		if err := regressSample(verifier, path, update); err != nil {
+			fmt.Printf("FAIL %s: %s\n", path, err)
+			ok = false
+			continue
+		}
+		fmt.Println("ok  ", path)
+	}
+	return ok
+}
+
+// Extract the sample at path with the given verifier and compare the
+// attributes with its golden file.
+func regressSample(v *duo.Verifier, path string, update bool) error {
+	data, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	var diplomas []duo.Diploma
+	if strings.HasSuffix(path, ".html") {
+		diplomas, _, err = v.ExtractHTML(data)
+	} else {
+		diplomas, _, err = v.VerifyAndExtract(data)
+	}
+	if err != nil {
+		return err
+	}
+	actual := make([]map[string]string, 0, len(diplomas))
+	for _, diploma := range diplomas {
+		actual = append(actual, diploma.Attributes())
+	}
+
+	goldenPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+	goldenData, err := readFile(goldenPath)
+	if os.IsNotExist(err) && update {
+		data, err := json.MarshalIndent(actual, "", "\t")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(goldenPath, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	var expected []map[string]string
+	if err := json.Unmarshal(goldenData, &expected); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", goldenPath, err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		actualData, _ := json.MarshalIndent(actual, "", "\t")
+		return fmt.Errorf("extracted attributes differ from %s, got:\n%s", goldenPath, actualData)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+var updateGoldenFiles = flag.Bool("update", false, "write missing golden files of the regression samples")
+
+// Run the synthetic samples in testdata/regress through the extractor, like
+// the regress command.
+func TestRegress(t *testing.T) {
+	samples, err := filepath.Glob("testdata/regress/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatal("no regression samples")
+	}
+	v := duo.New(x509.NewCertPool(), duo.Options{})
+	for _, path := range samples {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			if err := regressSample(v, path, *updateGoldenFiles); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
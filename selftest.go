@@ -0,0 +1,77 @@
+package main
+
+// This file contains the selftest command, which checks whether the
+// environment (pdf2htmlEX, certificates) is set up correctly, for example in a
+// freshly built container.
+
+import (
+	"crypto/x509"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+)
+
+// Sample diploma and certificate to test the pipeline with, see
+// selftest/README.markdown.
+//
+//go:embed selftest
+var selftestFiles embed.FS
+
+var errNoSampleDiploma = errors.New("no sample diploma bundled")
+
+// Run the self test, printing OK or the first failure. Returns whether the
+// test succeeded. A missing sample diploma counts as a failure, as the
+// pipeline can't have been tested without one.
+func cmdSelftest() bool {
+	if _, err := exec.LookPath("pdf2htmlEX"); err != nil {
+		fmt.Println("FAIL: cannot find pdf2htmlEX:", err)
+		return false
+	}
+
+	if _, err := duo.LoadCertPool(strings.Split(certDir, ",")...); err != nil {
+		fmt.Println("FAIL: cannot load certificates:", err)
+		return false
+	}
+
+	switch err := selftestDiploma(selftestFiles); err {
+	case nil:
+		fmt.Println("OK")
+		return true
+	case errNoSampleDiploma:
+		fmt.Println("SKIP: no sample diploma bundled, verification and extraction not tested")
+		return false
+	default:
+		fmt.Println("FAIL:", err)
+		return false
+	}
+}
+
+// Verify and extract the sample diploma in the given files, with the bundled
+// certificates.
+func selftestDiploma(files fs.FS) error {
+	pdfData, err := fs.ReadFile(files, "selftest/diploma.pdf")
+	if err != nil {
+		return errNoSampleDiploma
+	}
+	pool := x509.NewCertPool()
+	paths, _ := fs.Glob(files, "selftest/*.pem")
+	for _, path := range paths {
+		data, err := fs.ReadFile(files, path)
+		if err != nil || !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("cannot load bundled certificate: %s", path)
+		}
+	}
+	diplomas, _, err := duo.New(pool, verifierOptions(&config)).VerifyAndExtract(pdfData)
+	if err != nil {
+		return fmt.Errorf("cannot verify and extract sample diploma: %w", err)
+	}
+	if len(diplomas) == 0 {
+		return errors.New("no diplomas found in sample diploma")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSelftestDiploma(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		skip  bool // whether errNoSampleDiploma is expected
+	}{
+		{"no files", fstest.MapFS{}, true},
+		{"only a certificate", fstest.MapFS{"selftest/duo.pem": {Data: []byte("x")}}, true},
+		{"bad certificate", fstest.MapFS{
+			"selftest/diploma.pdf": {Data: []byte("%PDF-1.4\n%%EOF\n")},
+			"selftest/duo.pem":     {Data: []byte("not a certificate")},
+		}, false},
+		{"unsigned diploma", fstest.MapFS{
+			"selftest/diploma.pdf": {Data: []byte("%PDF-1.4\n%%EOF\n")},
+		}, false},
+	}
+	for _, tc := range tests {
+		err := selftestDiploma(tc.files)
+		if tc.skip && err != errNoSampleDiploma {
+			t.Errorf("%s: got %v, want %v", tc.name, err, errNoSampleDiploma)
+		} else if !tc.skip && (err == nil || err == errNoSampleDiploma) {
+			t.Errorf("%s: got %v, want a failure", tc.name, err)
+		}
+	}
+}
+
+// Put a fake pdf2htmlEX on PATH that writes the given HTML file as its output
+// (the last argument, in the --dest-dir directory).
+func fakePDF2HTML(t *testing.T, htmlPath string) {
+	htmlPath, err := filepath.Abs(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+if [ "$1" = --version ]; then echo "pdf2htmlEX version 0.14.6"; exit 0; fi
+while [ $# -gt 1 ]; do
+	if [ "$1" = --dest-dir ]; then dest=$2; fi
+	shift
+done
+cp "` + htmlPath + `" "$dest/$1"
+`
+	if err := os.WriteFile(filepath.Join(dir, "pdf2htmlEX"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+}
+
+// The bundled synthetic sample diploma passes the self test. Without
+// pdf2htmlEX installed, its expected output is used instead.
+func TestSelftestBundled(t *testing.T) {
+	if _, err := exec.LookPath("pdf2htmlEX"); err != nil {
+		fakePDF2HTML(t, "testdata/selftest.html")
+	}
+	if err := selftestDiploma(selftestFiles); err != nil {
+		t.Error(err)
+	}
+}
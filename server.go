@@ -4,19 +4,210 @@ package main
 // serves a few static files from a directory (HTML/CSS/JS).
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irma_duo_issuer/duo"
 	"github.com/privacybydesign/irmago"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// Maximum size of a (decompressed) request to the issue endpoint: a PDF of up
+// to 1MB plus the disclosure JWT and multipart overhead.
+const maxRequestSize = 2 * 1024 * 1024
+
+// Maximum number of parts in a form posted to the issue endpoint. It only
+// needs a few fields and the PDF.
+const maxFormParts = 10
+
+var errTooManyFormParts = errors.New("too many form parts")
+
+// Read the multipart body of the request and count its parts, returning
+// errTooManyFormParts when there are more than maxFormParts. The body is read
+// into memory (it's limited to maxRequestSize) and put back for the real
+// parsing. Errors reading the body, e.g. a *http.MaxBytesError, and malformed
+// forms are returned as well.
+func checkFormParts(r *http.Request, boundary string) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for n := 0; ; n++ {
+		_, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n >= maxFormParts {
+			return errTooManyFormParts
+		}
+	}
+}
+
+// Write a response body, compressing it when it's large and the client accepts
+// gzip encoding.
+func writeResponse(w http.ResponseWriter, r *http.Request, data []byte) {
+	if len(data) < 1024 || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	gz := gzip.NewWriter(w)
+	gz.Write(data)
+	gz.Close()
+}
+
 func sendErrorResponse(w http.ResponseWriter, httpCode int, errorCode string) {
+	recordError(w, errorCode)
 	w.WriteHeader(httpCode)
 	w.Write([]byte("error:" + errorCode))
 }
 
+// Store the error code in the audit record, if this request is audited.
+func recordError(w http.ResponseWriter, errorCode string) {
+	if aw, ok := w.(*auditResponseWriter); ok {
+		aw.record.Error = errorCode
+	}
+}
+
+// Disclosed attribute that didn't match the diploma, for each match error
+// code.
+var matchErrorFields = map[string]string{
+	ErrorNoInitials:       "initials",
+	ErrorInitialsMatch:    "initials",
+	ErrorNameMatch:        "familyname",
+	ErrorDateOfBirthMatch: "dateofbirth",
+	ErrorIdentifierMatch:  "identifier",
+}
+
+// Machine-readable details of a failed match, so the frontend can tell the
+// user what to fix. It must never contain values from the diploma.
+type matchErrorResponse struct {
+	Error   string `json:"error"`
+	Field   string `json:"field"`
+	Diploma int    `json:"diploma"` // index of the diploma in the PDF
+}
+
+// Whether the client accepts JSON responses, for clients other than the IRMA
+// app and the webapp.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Send a match error as JSON when the client accepts it, or as a plain error
+// response otherwise.
+func sendMatchError(w http.ResponseWriter, r *http.Request, diploma int, errorCode string) {
+	sendFieldMatchError(w, r, diploma, errorCode, matchErrorFields[errorCode])
+}
+
+// Like sendMatchError, for the given field, e.g. the label of a disclosure
+// group.
+func sendFieldMatchError(w http.ResponseWriter, r *http.Request, diploma int, errorCode, field string) {
+	if !acceptsJSON(r) {
+		sendErrorResponse(w, 400, errorCode)
+		return
+	}
+	data, err := json.Marshal(matchErrorResponse{
+		Error:   errorCode,
+		Field:   field,
+		Diploma: diploma,
+	})
+	if err != nil {
+		sendErrorResponse(w, 400, errorCode)
+		return
+	}
+	recordError(w, errorCode)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	w.Write(data)
+}
+
+// Attributes disclosed by the user to match against the diplomas.
+type disclosure struct {
+	Initials    string
+	FamilyName  string
+	DateOfBirth *string  // nil when optional_dateofbirth and not disclosed
+	Identifier  *string  // nil when not configured or not disclosed
+	Groups      []string // values of the disclosure_groups, in order
+}
+
+// Verifies the disclosure JWT and returns the disclosed attributes. It can be
+// replaced in tests, to disclose attributes without an IRMA API server.
+var parseDisclosureJwt = irma.ParseDisclosureJwt
+
+// Parse the disclosure JWT from the IRMA API server and get the attributes to
+// match. Returns the HTTP status and error code to send when the JWT is
+// invalid, has expired, or lacks one of the required attributes.
+func parseDisclosure(c *Config, attributesJwt string, pk *rsa.PublicKey) (*disclosure, int, string) {
+	disclosedAttributes, err := parseDisclosureJwt(attributesJwt, pk)
+	if err != nil {
+		if _, ok := err.(irma.ExpiredError); ok {
+			return nil, 400, ErrorAttributesExpired
+		}
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			// A well-formed JWT that doesn't verify with apiserver-pk.pem
+			// usually means the key doesn't belong to the API server, which
+			// the user can't do anything about.
+			log.Println("cannot verify disclosure JWT, is apiserver-pk.pem correct?", err)
+			return nil, 500, ErrorAttributes
+		}
+		log.Println("cannot parse attribute:", err)
+		return nil, 400, ErrorAttributes
+	}
+	initials := getAttribute(disclosedAttributes, c.InitialsAttributes)
+	familyname := getAttribute(disclosedAttributes, c.FamilyNameAttributes)
+	dateofbirth := getAttribute(disclosedAttributes, c.DateOfBirthAttributes)
+	if initials == nil || familyname == nil || dateofbirth == nil && !c.OptionalDateOfBirth {
+		return nil, 400, ErrorAttributesMissing
+	}
+	var groups []string
+	for _, group := range c.DisclosureGroups {
+		value := getAttribute(disclosedAttributes, group.Attributes)
+		if value == nil {
+			return nil, 400, ErrorAttributesMissing
+		}
+		groups = append(groups, *value)
+	}
+	return &disclosure{
+		Initials:    *initials,
+		FamilyName:  *familyname,
+		DateOfBirth: dateofbirth,
+		Identifier:  getAttribute(disclosedAttributes, c.IdentifierAttributes),
+		Groups:      groups,
+	}, 0, ""
+}
+
 func getAttribute(attributes map[irma.AttributeTypeIdentifier]irma.TranslatedString, identifiers []irma.AttributeTypeIdentifier) *string {
 	for _, identifier := range identifiers {
 		if value, ok := attributes[identifier]; ok {
@@ -30,33 +221,208 @@ func getAttribute(attributes map[irma.AttributeTypeIdentifier]irma.TranslatedStr
 	return nil
 }
 
-func requiredAttributes(initials, familyname, dob *string) irma.AttributeDisjunctionList {
+// Transforms that can be applied to issued attributes with the
+// attribute_transforms config option.
+var attributeTransforms = map[string]func(string) string{
+	"title": duo.TitleCase,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// Add the configured attribute variants, apply the configured transforms and
+// fill in defaults for empty attributes, in place. Variants are derived from
+// the values as extracted, before the transforms.
+func transformAttributes(c *Config, attributes map[string]string) map[string]string {
+	variants := make(map[string]string, len(c.AttributeVariants))
+	for name, variant := range c.AttributeVariants {
+		if value, ok := attributes[variant.From]; ok {
+			variants[name] = attributeTransforms[variant.Transform](value)
+		}
+	}
+	for attribute, transform := range c.AttributeTransforms {
+		if value, ok := attributes[attribute]; ok {
+			attributes[attribute] = attributeTransforms[transform](value)
+		}
+	}
+	for name, value := range variants {
+		attributes[name] = value
+	}
+
+	// Never send empty values, which credential schemes may reject: use the
+	// configured default or leave the attribute out.
+	for name, value := range attributes {
+		if strings.TrimSpace(value) == "" {
+			delete(attributes, name)
+		}
+	}
+	for name, value := range c.AttributeDefaults {
+		if _, ok := attributes[name]; !ok {
+			attributes[name] = value
+		}
+	}
+	return attributes
+}
+
+// Return the indices of the attribute sets that aren't the same as an earlier
+// one after normalization, e.g. when a diploma is listed twice in an extract.
+func dedupeAttributes(attributeSets []map[string]string) []int {
+	seen := make(map[string]bool)
+	var unique []int
+	for i, attributes := range attributeSets {
+		keys := make([]string, 0, len(attributes))
+		for key := range attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var id strings.Builder
+		for _, key := range keys {
+			id.WriteString(key + "=" + normalize(attributes[key]) + "\x00")
+		}
+		if seen[id.String()] {
+			continue
+		}
+		seen[id.String()] = true
+		unique = append(unique, i)
+	}
+	return unique
+}
+
+// Check whether credentials may be issued for a diploma of the given
+// institutes: a joint degree is allowed when one of them is.
+func anyInstituteAllowed(c *Config, institutes []string) bool {
+	if len(c.AllowedInstitutes) == 0 {
+		return true
+	}
+	for _, institute := range institutes {
+		if instituteAllowed(c, institute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether credentials may be issued for diplomas of the given institute.
+// All institutes are allowed when no allowlist is configured.
+func instituteAllowed(c *Config, institute string) bool {
+	if len(c.AllowedInstitutes) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedInstitutes {
+		if normalize(allowed) == normalize(institute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether credentials may be issued for the level of the given diploma:
+// its normalized degree (with normalize_degree), degree, profile or education
+// must be in allowed_levels. All levels are allowed when no allowlist is
+// configured.
+func levelAllowed(c *Config, diploma *duo.Diploma) bool {
+	if len(c.AllowedLevels) == 0 {
+		return true
+	}
+	for _, level := range []string{diploma.NormalizedDegree, diploma.Degree, diploma.Profile, diploma.Education} {
+		if level == "" {
+			continue
+		}
+		for _, allowed := range c.AllowedLevels {
+			if normalize(allowed) == normalize(level) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Build the disjunctions to disclose: the initials, family name, date of birth
+// (unless withoutDOB) and (when configured) identifier, followed by the
+// disclosure_groups. When given, the disclosed values are pinned, see
+// pinValue. groups may be nil or contain a value for every disclosure group.
+func requiredAttributes(c *Config, initials, familyname, dob, identifier *string, groups []string, withoutDOB bool) irma.AttributeDisjunctionList {
 	disjunctions := irma.AttributeDisjunctionList{
 		{
 			Label:      "Initials",
-			Attributes: config.InitialsAttributes,
+			Attributes: c.InitialsAttributes,
 		},
 		{
 			Label:      "Family name",
-			Attributes: config.FamilyNameAttributes,
-		},
-		{
-			Label:      "Date of birth",
-			Attributes: config.DateOfBirthAttributes,
+			Attributes: c.FamilyNameAttributes,
 		},
 	}
-	if initials != nil {
+	if initials != nil && pinValue(c, "initials") {
 		requireValue(disjunctions[0], initials)
 	}
-	if familyname != nil {
+	if familyname != nil && pinValue(c, "familyname") {
 		requireValue(disjunctions[1], familyname)
 	}
-	if dob != nil {
-		requireValue(disjunctions[2], dob)
+	if !withoutDOB {
+		disjunction := &irma.AttributeDisjunction{
+			Label:      "Date of birth",
+			Attributes: c.DateOfBirthAttributes,
+		}
+		if dob != nil && pinValue(c, "dateofbirth") {
+			requireValue(disjunction, dob)
+		}
+		disjunctions = append(disjunctions, disjunction)
+	}
+	if len(c.IdentifierAttributes) != 0 {
+		// Optional, for a stronger binding between the IRMA identity and the
+		// diploma.
+		disjunction := &irma.AttributeDisjunction{
+			Label:      "Identifier",
+			Attributes: c.IdentifierAttributes,
+		}
+		if identifier != nil && pinValue(c, "identifier") {
+			requireValue(disjunction, identifier)
+		}
+		disjunctions = append(disjunctions, disjunction)
+	}
+	for i, group := range c.DisclosureGroups {
+		disjunction := &irma.AttributeDisjunction{
+			Label:      group.Label,
+			Attributes: group.Attributes,
+		}
+		if groups != nil && pinValue(c, group.Label) {
+			requireValue(disjunction, &groups[i])
+		}
+		disjunctions = append(disjunctions, disjunction)
 	}
 	return disjunctions
 }
 
+// Check the disclosed values of the disclosure groups with require_match_to
+// against the diploma. Returns the label of the first group that doesn't
+// match, or "" when all match.
+func matchGroups(c *Config, diploma *duo.Diploma, groups []string) string {
+	var attributes map[string]string
+	for i, group := range c.DisclosureGroups {
+		if group.RequireMatchTo == "" {
+			continue
+		}
+		if attributes == nil {
+			attributes = diploma.Attributes()
+		}
+		if normalize(attributes[group.RequireMatchTo]) != normalize(groups[i]) {
+			return group.Label
+		}
+	}
+	return ""
+}
+
+// Whether the disjunction with the given name must be disclosed with the
+// previously disclosed value when issuing, unless configured otherwise in
+// unpinned_attributes.
+func pinValue(c *Config, name string) bool {
+	for _, unpinned := range c.UnpinnedAttributes {
+		if unpinned == name {
+			return false
+		}
+	}
+	return true
+}
+
 func requireValue(disjunction *irma.AttributeDisjunction, value *string) {
 	disjunction.Values = map[irma.AttributeTypeIdentifier]*string{}
 	for _, attr := range disjunction.Attributes {
@@ -64,40 +430,236 @@ func requireValue(disjunction *irma.AttributeDisjunction, value *string) {
 	}
 }
 
-func apiRequestAttrs(w http.ResponseWriter, r *http.Request) {
-	if config.CORSDomain != "" {
-		w.Header().Set("Access-Control-Allow-Origin", config.CORSDomain)
+// Return how many months credentials of the given type are valid: from
+// credential_validities, or credential_validity when the type isn't listed.
+func validityMonths(c *Config, credential string) int {
+	if months, ok := c.CredentialValidities[credential]; ok {
+		return months
 	}
+	return c.CredentialValidity
+}
 
-	request := &irma.DisclosureRequest{
-		Content: requiredAttributes(nil, nil, nil),
+// Return the credential type to issue a diploma as: from credential_types by
+// the degree as extracted (before normalize_degree and attribute_transforms),
+// or duo_credential_id when the degree isn't listed.
+func credentialType(c *Config, diploma *duo.Diploma) string {
+	if credential, ok := c.CredentialTypes[diploma.Degree]; ok {
+		return credential
 	}
-	jwt := irma.NewServiceProviderJwt("Privacy by Design Foundation", request)
+	return c.DUOCrendentialID
+}
 
-	// TODO: cache, or load on startup
-	sk, err := readPrivateKey(configDir + "/sk.pem")
+// credentialValidity returns the expiry date of a credential issued at the
+// given time that should be valid for the given number of months.
+//
+// IRMA credentials can only expire at an epoch boundary (one week, counted
+// from the Unix epoch), so the expiry date is rounded down to the last epoch
+// boundary before now+months. This means a credential may be valid for up to
+// one epoch less than requested, but never longer.
+func credentialValidity(now time.Time, months int) irma.Timestamp {
+	return irma.Timestamp(irma.FloorToEpochBoundary(now.AddDate(0, months, 0)))
+}
+
+// Returned by validityStart when a credential counted from the achievement
+// date would already have expired.
+var errCredentialExpired = errors.New("credential would already have expired")
+
+// Return the time from which the validity of a credential with the given
+// achievement date (DD-MM-YYYY) is counted: the achievement date with
+// validity_from_achieved, or now otherwise. Falls back to now when the
+// achievement date cannot be parsed. Returns errCredentialExpired when the
+// credential would already have expired, as IRMA cannot issue expired
+// credentials.
+func validityStart(c *Config, now time.Time, achieved string, months int) (time.Time, error) {
+	if !c.ValidityFromAchieved {
+		return now, nil
+	}
+	start, err := time.ParseInLocation("02-01-2006", achieved, now.Location())
+	if err != nil {
+		log.Printf("cannot parse achievement date %q, counting validity from now", achieved)
+		return now, nil
+	}
+	if !time.Time(credentialValidity(start, months)).After(now) {
+		return time.Time{}, errCredentialExpired
+	}
+	return start, nil
+}
+
+// Build the credentials to issue for the given diplomas, with the configured
+// credential type and validity of each, collapsing duplicate diplomas.
+func credentialRequests(c *Config, diplomas []duo.Diploma) ([]*irma.CredentialRequest, error) {
+	var attributeSets []map[string]string
+	for _, diploma := range diplomas {
+		attributeSets = append(attributeSets, transformAttributes(c, diploma.Attributes()))
+	}
+	unique := dedupeAttributes(attributeSets)
+	if len(unique) != len(attributeSets) {
+		log.Printf("collapsed %d duplicate diplomas", len(attributeSets)-len(unique))
+	}
+	var credentials []*irma.CredentialRequest
+	for _, i := range unique {
+		attributes := attributeSets[i]
+		credential := credentialType(c, &diplomas[i])
+		credid := irma.NewCredentialTypeIdentifier(credential)
+		months := validityMonths(c, credential)
+		start, err := validityStart(c, clock(), attributes["achieved"], months)
+		if err != nil {
+			return nil, err
+		}
+		validity := credentialValidity(start, months)
+		credentials = append(credentials, &irma.CredentialRequest{
+			Validity:         &validity,
+			CredentialTypeID: &credid,
+			Attributes:       attributes,
+		})
+	}
+	return credentials, nil
+}
+
+// Ephemeral signing key, only set in development mode.
+var devKey *rsa.PrivateKey
+
+// Generate an ephemeral signing key for development mode and log its public
+// key, so a development IRMA server can be configured with it.
+func generateDevKey() error {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	pk, err := encodePublicKey(&sk.PublicKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("WARNING: development mode, signing with an ephemeral key with public key:\n%s", pk)
+	devKey = sk
+	return nil
+}
+
+// Encode a public key in PEM format, as expected by the IRMA server.
+func encodePublicKey(pk *rsa.PublicKey) ([]byte, error) {
+	pkData, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkData}), nil
+}
+
+// Return the public key belonging to the signing key, so it doesn't have to be
+// copied by hand to the IRMA server configuration. The kid query parameter
+// selects another key from signing_keys, e.g. the next one during a rotation.
+func apiPublicKey(w http.ResponseWriter, r *http.Request, state *serverState) {
+	c := state.config
+	keyID := r.URL.Query().Get("kid")
+	if keyID == "" {
+		keyID = c.JWTKeyID
+	}
+	sk, err := signingKey(c, keyID)
+	if err == errUnknownKey {
+		sendErrorResponse(w, 404, ErrorUnknownKey)
+		return
+	}
 	if err != nil {
 		log.Println("cannot open private key:", err)
-		sendErrorResponse(w, 500, "signing")
+		sendErrorResponse(w, 500, ErrorSigning)
+		return
+	}
+	pk, err := encodePublicKey(&sk.PublicKey)
+	if err != nil {
+		log.Println("cannot encode public key:", err)
+		sendErrorResponse(w, 500, ErrorSigning)
 		return
 	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(pk)
+}
 
-	text, err := jwt.Sign("duo", sk)
+func apiRequestAttrs(w http.ResponseWriter, r *http.Request, state *serverState) {
+	c := state.config
+	// With optional_dateofbirth, the frontend can ask again without the date
+	// of birth for users whose credentials lack it.
+	withoutDOB := c.OptionalDateOfBirth && r.URL.Query().Get("without") == "dateofbirth"
+	request := &irma.DisclosureRequest{
+		Content: requiredAttributes(c, nil, nil, nil, nil, nil, withoutDOB),
+	}
+	if c.SessionBinding {
+		// Put the nonce in the disclosure request, so the disclosure JWT
+		// proves it was made for this session.
+		nonce, err := sessions.start()
+		if err != nil {
+			log.Println("cannot start session:", err)
+			sendErrorResponse(w, 503, ErrorSession)
+			return
+		}
+		request.Context = big.NewInt(1)
+		request.Nonce = sessionNonce(nonce)
+		w.Header().Set("X-Session-Nonce", nonce)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Session-Nonce")
+	}
+	text, err := signer.SignDisclosureRequest(c, request)
 	if err != nil {
 		log.Println("cannot create disclosure JWT:", err)
-		sendErrorResponse(w, 500, "signing")
+		sendErrorResponse(w, 500, ErrorSigning)
+		return
+	}
+	if c.IRMAServerURL != "" {
+		sendSession(w, r, c, text)
 		return
 	}
 	w.Write([]byte(text))
 }
 
-func apiIssue(w http.ResponseWriter, r *http.Request) {
-	if config.CORSDomain != "" {
-		w.Header().Set("Access-Control-Allow-Origin", config.CORSDomain)
+func apiIssue(w http.ResponseWriter, r *http.Request, state *serverState) {
+	c := state.config
+	// Assume failure until the credentials are issued, so that panics are
+	// recorded as well.
+	record := &auditRecord{
+		Time:  clock(),
+		Error: "internal",
 	}
+	defer auditLog.write(record)
+	w = &auditResponseWriter{ResponseWriter: w, record: record}
 
 	if r.Method != http.MethodPost {
-		sendErrorResponse(w, 405, "invalid-method")
+		sendErrorResponse(w, 405, ErrorInvalidMethod)
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		sendErrorResponse(w, 415, ErrorBadContentType)
+		return
+	}
+
+	// Clients may compress the upload to save bandwidth. Limit the
+	// decompressed size, so a small compressed body can't expand to
+	// something huge.
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			sendErrorResponse(w, 400, ErrorBadEncoding)
+			return
+		}
+		defer body.Close()
+		r.Body = http.MaxBytesReader(w, body, maxRequestSize)
+		r.Header.Del("Content-Encoding")
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	}
+
+	// Refuse forms with many (tiny) parts before parsing them, as each part
+	// costs memory and CPU while parsing.
+	var tooBig *http.MaxBytesError
+	switch err := checkFormParts(r, params["boundary"]); {
+	case err == nil:
+	case err == errTooManyFormParts:
+		sendErrorResponse(w, 400, ErrorTooManyParts)
+		return
+	case errors.As(err, &tooBig):
+		sendErrorResponse(w, 413, ErrorFileTooBig)
+		return
+	default:
+		// A malformed form, or a body that can't be read or decompressed.
+		sendErrorResponse(w, 400, ErrorBadEncoding)
 		return
 	}
 
@@ -105,111 +667,531 @@ func apiIssue(w http.ResponseWriter, r *http.Request) {
 	pk, err := readPublicKey(configDir + "/apiserver-pk.pem")
 	if err != nil {
 		log.Println("cannot open public key of API server:", err)
-		sendErrorResponse(w, 500, "attributes")
+		sendErrorResponse(w, 500, ErrorAttributes)
 		return
 	}
 
 	attributesJwt := r.FormValue("attributes")
-	disclosedAttributes, err := irma.ParseDisclosureJwt(attributesJwt, pk)
-	if err != nil {
-		if _, ok := err.(irma.ExpiredError); ok {
-			sendErrorResponse(w, 400, "attributes-expired")
-		} else {
-			log.Println("cannot parse attribute:", err)
-			sendErrorResponse(w, 400, "attributes")
+	if c.IRMAServerURL != "" && attributesJwt == "" {
+		// The frontend only knows the session token, the result must be
+		// fetched from the IRMA server.
+		attributesJwt, err = sessionResultJwt(c, r.FormValue("token"))
+		if err != nil {
+			log.Println("cannot fetch disclosure result from IRMA server:", err)
+			sendErrorResponse(w, 502, ErrorIRMAServer)
+			return
 		}
+	}
+	disclosed, status, errorCode := parseDisclosure(c, attributesJwt, pk)
+	if errorCode != "" {
+		sendErrorResponse(w, status, errorCode)
+		return
+	}
+	if c.SessionBinding && !sessions.finish(r.FormValue("nonce"), attributesJwt) {
+		sendErrorResponse(w, 400, ErrorSession)
 		return
 	}
-	disclosedInitials := getAttribute(disclosedAttributes, config.InitialsAttributes)
-	disclosedFamilyname := getAttribute(disclosedAttributes, config.FamilyNameAttributes)
-	disclosedDateOfBirth := getAttribute(disclosedAttributes, config.DateOfBirthAttributes)
 
 	// Accept files of up to 1MB. The sample PDFs I've used are all 520-550kB so
 	// this should be enough.
 	err = r.ParseMultipartForm(1024 * 1024) // 1MB
 	if err != nil {
-		sendErrorResponse(w, 413, "file-too-big")
+		sendErrorResponse(w, 413, ErrorFileTooBig)
 		return
 	}
-	file, _, err := r.FormFile("pdf")
-	if err != nil {
-		sendErrorResponse(w, 400, "no-pdf-file")
-		return
+	var data []byte
+	if pdfURL := r.FormValue("pdf_url"); pdfURL != "" && len(c.PDFURLHosts) != 0 {
+		data, err = fetchPDF(c, pdfURL)
+		switch {
+		case errors.Is(err, errPDFURLNotAllowed):
+			sendErrorResponse(w, 400, ErrorPDFURLNotAllowed)
+			return
+		case errors.Is(err, errPDFURLTooBig):
+			sendErrorResponse(w, 413, ErrorFileTooBig)
+			return
+		case err != nil:
+			log.Println("cannot fetch pdf_url:", err)
+			sendErrorResponse(w, 502, ErrorPDFURLFetch)
+			return
+		}
+	} else {
+		file, _, err := r.FormFile("pdf")
+		if err != nil {
+			sendErrorResponse(w, 400, ErrorNoPDFFile)
+			return
+		}
+		defer file.Close()
+		data, err = ioutil.ReadAll(file)
+		if err != nil {
+			sendErrorResponse(w, 500, ErrorReadFile)
+			return
+		}
 	}
-	defer file.Close()
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		sendErrorResponse(w, 500, "readfile")
+	record.PDFHash = hashPDF(data)
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		sendErrorResponse(w, 400, ErrorNotAPDF)
 		return
 	}
 
-	attributeSets, err := verifyAndExtract(data)
+	result, err := verifyAndExtract(state, data)
+	if result != nil {
+		for _, warning := range result.Warnings {
+			log.Println("extract:", warning)
+		}
+	}
+	if err == errBusy {
+		w.Header().Set("Retry-After", "10")
+		sendErrorResponse(w, 503, ErrorBusy)
+		return
+	}
+	if errors.Is(err, duo.ErrEncryptedPDF) {
+		sendErrorResponse(w, 400, ErrorEncryptedPDF)
+		return
+	}
+	if errors.Is(err, duo.ErrTruncatedPDF) {
+		sendErrorResponse(w, 400, ErrorTruncatedPDF)
+		return
+	}
+	var certErr duo.CertificateError
+	if errors.As(err, &certErr) {
+		log.Println("cannot verify signing certificate:", err)
+		sendErrorResponse(w, 400, ErrorUntrustedSignature)
+		return
+	}
+	if errors.Is(err, duo.ErrWeakSignature) {
+		log.Println("refused weak signature:", err)
+		sendErrorResponse(w, 400, ErrorWeakSignature)
+		return
+	}
+	if errors.Is(err, duo.ErrExtractorUnavailable) {
+		log.Println("cannot run PDF extractor:", err)
+		w.Header().Set("Retry-After", "60")
+		sendErrorResponse(w, 500, ErrorExtractorUnavailable)
+		return
+	}
 	if err != nil {
 		log.Println("failed to extract attributes from PDF:", err)
-		sendErrorResponse(w, 400, "extract")
+		sendErrorResponse(w, 400, ErrorExtract)
+		return
+	}
+	diplomas := result.Diplomas
+	if len(diplomas) == 0 {
+		// A valid DUO document, but not an extract from the diploma register.
+		sendErrorResponse(w, 400, ErrorNoDiplomaFound)
 		return
 	}
 
-	for _, attributes := range attributeSets {
-		if len(attributes["firstname"]) == 0 || len(*disclosedInitials) == 0 {
-			// This is very unlikely.
-			sendErrorResponse(w, 400, "no-initials")
+	for _, diploma := range diplomas {
+		record.Institutes = append(record.Institutes, diploma.Institute)
+	}
+	for i, diploma := range diplomas {
+		if errorCode := matchName(c, &diploma, disclosed.Initials, disclosed.FamilyName); errorCode != "" {
+			sendMatchError(w, r, i, errorCode)
+			return
+		}
+		if disclosed.DateOfBirth != nil && diploma.DateOfBirth != *disclosed.DateOfBirth {
+			sendMatchError(w, r, i, ErrorDateOfBirthMatch)
 			return
 		}
-		if attributes["familyname"] != *disclosedFamilyname &&
-			attributes["prefix"]+" "+attributes["familyname"] != *disclosedFamilyname {
-			sendErrorResponse(w, 400, "name-match")
+		if diploma.BSN != "" && disclosed.Identifier != nil && !matchBSN(diploma.BSN, *disclosed.Identifier) {
+			sendMatchError(w, r, i, ErrorIdentifierMatch)
+			return
+		}
+		if label := matchGroups(c, &diploma, disclosed.Groups); label != "" {
+			sendFieldMatchError(w, r, i, ErrorAttributeMatch, label)
+			return
 		}
-		if attributes["firstname"][0] != (*disclosedInitials)[0] {
-			sendErrorResponse(w, 400, "initials-match")
+		if !anyInstituteAllowed(c, diploma.Institutes) {
+			sendErrorResponse(w, 400, ErrorInstituteNotAllowed)
 			return
 		}
-		if attributes["dateofbirth"] != *disclosedDateOfBirth {
-			sendErrorResponse(w, 400, "dateofbirth-match")
+		if !levelAllowed(c, &diploma) {
+			sendErrorResponse(w, 400, ErrorLevelNotAllowed)
 			return
 		}
 	}
 
-	validity := irma.Timestamp(irma.FloorToEpochBoundary(time.Now().AddDate(1, 0, 0)))
-	credid := irma.NewCredentialTypeIdentifier(config.DUOCrendentialID)
-	var credentials []*irma.CredentialRequest
-	for _, attributes := range attributeSets {
-		credential := &irma.CredentialRequest{
-			Validity:         &validity,
-			CredentialTypeID: &credid,
-			Attributes:       attributes,
+	credentials, err := credentialRequests(c, diplomas)
+	if err == errCredentialExpired {
+		sendErrorResponse(w, 400, ErrorCredentialExpired)
+		return
+	}
+	for _, credential := range credentials {
+		record.CredentialTypes = append(record.CredentialTypes, credential.CredentialTypeID.String())
+	}
+	req := &irma.IssuanceRequest{
+		Credentials: credentials,
+		Disclose:    requiredAttributes(c, &disclosed.Initials, &disclosed.FamilyName, disclosed.DateOfBirth, disclosed.Identifier, disclosed.Groups, disclosed.DateOfBirth == nil),
+	}
+	text, err := signer.SignIssuanceRequest(c, req)
+	if err != nil {
+		log.Println("cannot sign signature request:", err)
+		sendErrorResponse(w, 500, ErrorSigning)
+		return
+	}
+
+	if acceptsJSON(r) {
+		if sendIssueResponse(w, r, c, text, result.Signature, credentials) {
+			record.Error = ""
+		}
+		return
+	}
+	if c.IRMAServerURL != "" {
+		if sendSession(w, r, c, text) {
+			record.Error = ""
 		}
-		credentials = append(credentials, credential)
+		return
 	}
+	record.Error = ""
+	writeResponse(w, r, []byte(text))
+}
 
-	// TODO: cache, or load on startup
-	sk, err := readPrivateKey(configDir + "/sk.pem")
+// Response of /api/issue for clients that accept JSON, e.g. server-to-server
+// integrations, describing what was verified and issued. It must never
+// contain values from the diploma.
+type issueResponse struct {
+	JWT         string          `json:"jwt,omitempty"`     // signed issuance request (legacy mode)
+	Session     json.RawMessage `json:"session,omitempty"` // session pointer (with irma_server_url)
+	Credentials []string        `json:"credentials"`       // type of each credential
+	Signer      string          `json:"signer,omitempty"`  // subject of the signing certificate
+	SigningTime *time.Time      `json:"signing_time,omitempty"`
+	Attributes  [][]string      `json:"attributes"` // names of the attributes of each credential
+}
+
+// Send the signed issuance request (or the session pointer of the IRMA
+// server) in a JSON envelope with metadata. Returns whether it was sent.
+func sendIssueResponse(w http.ResponseWriter, r *http.Request, c *Config, requestJwt string, signature *duo.Signature, credentials []*irma.CredentialRequest) bool {
+	response := issueResponse{
+		Credentials: make([]string, 0, len(credentials)),
+		Attributes:  make([][]string, 0, len(credentials)),
+	}
+	if c.IRMAServerURL != "" {
+		session, err := startSession(c, requestJwt)
+		if err != nil {
+			log.Println("cannot start session at IRMA server:", err)
+			sendErrorResponse(w, 502, ErrorIRMAServer)
+			return false
+		}
+		response.Session = session
+	} else {
+		response.JWT = requestJwt
+	}
+	if signature != nil {
+		if signature.Signer != nil {
+			response.Signer = signature.Signer.Subject.String()
+		}
+		response.SigningTime = &signature.SigningTime
+	}
+	for _, credential := range credentials {
+		response.Credentials = append(response.Credentials, credential.CredentialTypeID.String())
+		names := make([]string, 0, len(credential.Attributes))
+		for name := range credential.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		response.Attributes = append(response.Attributes, names)
+	}
+	data, err := json.Marshal(response)
 	if err != nil {
-		log.Println("cannot open private key:", err)
-		sendErrorResponse(w, 500, "signing")
+		sendErrorResponse(w, 500, ErrorInternal)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse(w, r, data)
+	return true
+}
+
+// Start a session at the IRMA server with the signed request and send the
+// session pointer to the client. Returns whether the session was started.
+func sendSession(w http.ResponseWriter, r *http.Request, c *Config, requestJwt string) bool {
+	session, err := startSession(c, requestJwt)
+	if err != nil {
+		log.Println("cannot start session at IRMA server:", err)
+		sendErrorResponse(w, 502, ErrorIRMAServer)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse(w, r, session)
+	return true
+}
+
+// The config and verifier used by the API handlers, which may be replaced
+// while serving. A reload builds a new state and swaps it in as a whole, so
+// a request sees either the old or the new state, never a mix.
+type serverState struct {
+	config   *Config
+	verifier *duo.Verifier
+}
+
+// The current state. API handlers load it once at the start of a request (see
+// withState) and use that snapshot until it is finished, so a reload doesn't
+// wait for requests in flight, e.g. while running pdf2htmlEX.
+var currentState atomic.Pointer[serverState]
+
+// Slots for running extractions, limiting the number of concurrent pdf2htmlEX
+// processes as each of them is heavy. Nil when there is no limit. Like the
+// timeouts, the limit is only read at startup.
+var extractionSlots chan struct{}
+
+// Wait for a free extraction slot, for at most extraction_wait seconds.
+// Returns false when no slot became free in time.
+func acquireExtractionSlot(c *Config) bool {
+	if extractionSlots == nil {
+		return true
+	}
+	timer := time.NewTimer(time.Duration(c.ExtractionWait) * time.Second)
+	defer timer.Stop()
+	select {
+	case extractionSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Free the slot taken by acquireExtractionSlot.
+func releaseExtractionSlot() {
+	if extractionSlots != nil {
+		<-extractionSlots
+	}
+}
+
+var errBusy = errors.New("no extraction slot available")
+
+// Verify and extract a PDF in an extraction slot. Returns errBusy when no slot
+// became free in time.
+func verifyAndExtract(state *serverState, data []byte) (*duo.Result, error) {
+	if !acquireExtractionSlot(state.config) {
+		return nil, errBusy
+	}
+	defer releaseExtractionSlot()
+	return state.verifier.VerifyAndExtractResult(data)
+}
+
+// An API handler, called with the state at the start of the request.
+type stateHandler func(w http.ResponseWriter, r *http.Request, state *serverState)
+
+// withState wraps a handler to call it with the current state.
+func withState(handler stateHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, currentState.Load())
+	}
+}
+
+// withCORS wraps a handler to send CORS headers for requests from allowed
+// origins: any origin when cors_domain is "*", otherwise cors_domain and the
+// origins in cors_origins. The matching origin is echoed back, so credentials
+// can be allowed as well. Preflight requests from allowed origins are
+// answered here, so they can be cached for cors_max_age_seconds.
+func withCORS(handler stateHandler) stateHandler {
+	return func(w http.ResponseWriter, r *http.Request, state *serverState) {
+		c := state.config
+		allowed := false
+		if c.CORSDomain == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			allowed = true
+		} else if origin := r.Header.Get("Origin"); origin != "" && originAllowed(c, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if c.CORSCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			allowed = true
+		}
+		w.Header().Add("Vary", "Origin")
+		if allowed && r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.CORSMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(w, r, state)
+	}
+}
+
+func originAllowed(c *Config, origin string) bool {
+	if c.CORSDomain != "" && origin == c.CORSDomain {
+		return true
+	}
+	for _, allowed := range c.CORSOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// withHTTPS wraps a handler to refuse requests that reached the proxy over
+// plain HTTP, according to the configured proxy header, so signed requests are
+// never sent in the clear when the proxy is misconfigured. GET requests are
+// redirected to HTTPS when configured.
+func withHTTPS(handler stateHandler) stateHandler {
+	return func(w http.ResponseWriter, r *http.Request, state *serverState) {
+		c := state.config
+		if c.HTTPSHeader == "" || strings.EqualFold(r.Header.Get(c.HTTPSHeader), "https") {
+			handler(w, r, state)
+			return
+		}
+		if c.HTTPSRedirect && r.Method == http.MethodGet {
+			target := *r.URL
+			target.Scheme = "https"
+			target.Host = r.Host
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+		sendErrorResponse(w, 403, ErrorHTTPSRequired)
+	}
+}
+
+// withRecover wraps a handler to recover from panics, so a bug in a handler
+// results in a clean error response and a log message with a request ID
+// instead of a dropped connection.
+func withRecover(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				requestID := r.Header.Get("X-Request-ID")
+				if requestID == "" {
+					id := make([]byte, 8)
+					rand.Read(id)
+					requestID = hex.EncodeToString(id)
+				}
+				log.Printf("panic in request %s (%s %s): %v\n%s", requestID, r.Method, r.URL.Path, err, debug.Stack())
+				sendErrorResponse(w, 500, ErrorInternal)
+			}
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Reload the config file and the certificates. They are only swapped in when
+// both have been loaded successfully, otherwise the old state is kept.
+func reloadState() error {
+	newConfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	newVerifier, err := newVerifier(newConfig)
+	if err != nil {
+		return err
+	}
+
+	currentState.Store(&serverState{newConfig, newVerifier})
+	return nil
+}
+
+func apiAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, 405, ErrorInvalidMethod)
 		return
 	}
 
-	req := &irma.IssuanceRequest{
-		Credentials: credentials,
-		Disclose:    requiredAttributes(disclosedInitials, disclosedFamilyname, disclosedDateOfBirth),
+	secret := currentState.Load().config.AdminSecret
+	auth := []byte(r.Header.Get("Authorization"))
+	if secret == "" || subtle.ConstantTimeCompare(auth, []byte("Bearer "+secret)) != 1 {
+		sendErrorResponse(w, 403, ErrorUnauthorized)
+		return
 	}
-	jwt := irma.NewIdentityProviderJwt("Privacy by Design Foundation", req)
-	text, err := jwt.Sign("duo", sk)
+
+	err := reloadState()
 	if err != nil {
-		log.Println("cannot sign signature request:", err)
-		sendErrorResponse(w, 500, "signing")
+		log.Println("cannot reload config:", err)
+		sendErrorResponse(w, 500, ErrorReload)
 		return
 	}
+	log.Println("reloaded config and certificates")
+	w.Write([]byte("ok"))
+}
 
-	w.Write([]byte(text))
+// Reload the config and certificates on SIGHUP.
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := reloadState()
+		if err != nil {
+			log.Println("cannot reload config:", err)
+			continue
+		}
+		log.Println("reloaded config and certificates")
+	}
+}
+
+// Build the handler of the public routes, with the routes and static files
+// of the given (startup) config.
+func newServerHandler(c *Config) http.Handler {
+	// All routes are below the base path, e.g. "/duo" when the reverse proxy
+	// serves the issuer at https://example.com/duo/.
+	// The public routes are on their own mux, as net/http/pprof registers
+	// its handlers on http.DefaultServeMux.
+	base := c.BasePath
+	mux := http.NewServeMux()
+	static := withStaticHeaders(http.FileServer(http.Dir(serverStaticDir)), c.StaticMaxAge)
+	mux.Handle(base+"/", http.StripPrefix(base, static))
+	mux.HandleFunc(base+"/api/request-attrs", withNoStore(withState(withHTTPS(withCORS(apiRequestAttrs)))))
+	mux.HandleFunc(base+"/api/issue", withNoStore(withState(withHTTPS(withCORS(apiIssue)))))
+	mux.HandleFunc(base+"/api/pubkey", withNoStore(withState(apiPublicKey)))
+	mux.HandleFunc(base+"/api/errors", withNoStore(apiErrors))
+	if c.AdminSecret != "" {
+		mux.HandleFunc(base+"/admin/reload", withNoStore(apiAdminReload))
+	}
+	return withRecover(mux)
 }
 
 func cmdServe(addr string) {
-	static := http.FileServer(http.Dir(serverStaticDir))
-	http.Handle("/", static)
-	http.HandleFunc("/api/request-attrs", apiRequestAttrs)
-	http.HandleFunc("/api/issue", apiIssue)
-	log.Println("serving from", addr)
-	http.ListenAndServe(addr, nil)
+	currentState.Store(&serverState{&config, verifier})
+	handler := newServerHandler(&config)
+	if config.PprofAddr != "" {
+		go servePprof(config.PprofAddr)
+	}
+	go handleReloadSignal()
+	if config.MaxExtractions != 0 {
+		extractionSlots = make(chan struct{}, config.MaxExtractions)
+	}
+	if config.AuditLog != "" {
+		var err error
+		auditLog, err = openAuditLog(config.AuditLog, []byte(config.AuditKey))
+		if err != nil {
+			log.Fatalln("cannot open audit log:", err)
+		}
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(config.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeout) * time.Second,
+	}
+	shutdown := make(chan struct{})
+	go handleShutdownSignal(server, shutdown)
+
+	var err error
+	if config.AutocertHostname != "" {
+		// Obtain a certificate from Let's Encrypt.
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.AutocertHostname),
+			Cache:      autocert.DirCache(config.AutocertCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		log.Println("serving from", addr, "over HTTPS (autocert for "+config.AutocertHostname+")")
+		err = server.ListenAndServeTLS("", "")
+	} else if config.TLSCert != "" {
+		log.Println("serving from", addr, "over HTTPS")
+		err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		// Plaintext, for use behind a TLS-terminating proxy.
+		log.Println("serving from", addr)
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		// Wait until the requests in flight are finished.
+		<-shutdown
+		return
+	}
+	log.Fatalln("cannot serve:", err)
 }
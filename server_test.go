@@ -0,0 +1,1134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irma_duo_issuer/duo"
+	"github.com/privacybydesign/irmago"
+)
+
+// Write a self-signed certificate for the given name to dir, as a pinned
+// DUO certificate.
+func writeTestCert(t *testing.T, dir, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Extractor that blocks until release is closed, to keep requests in flight.
+type blockingExtractor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e blockingExtractor) Extract(pdfData []byte) ([]duo.Diploma, []duo.Warning, error) {
+	e.started <- struct{}{}
+	<-e.release
+	return nil, nil, nil
+}
+
+// Signer that records the requests it signs, and returns a fixed JWT.
+type recordingSigner struct {
+	disclosure *irma.DisclosureRequest
+	issuance   *irma.IssuanceRequest
+}
+
+func (s *recordingSigner) SignDisclosureRequest(c *Config, request *irma.DisclosureRequest) (string, error) {
+	s.disclosure = request
+	return "disclosure-jwt", nil
+}
+
+func (s *recordingSigner) SignIssuanceRequest(c *Config, request *irma.IssuanceRequest) (string, error) {
+	s.issuance = request
+	return "issuance-jwt", nil
+}
+
+// Replace the signer for a test.
+func withSigner(t *testing.T, s Signer) {
+	oldSigner := signer
+	t.Cleanup(func() { signer = oldSigner })
+	signer = s
+}
+
+// Disclose the given attributes, with their values in Dutch, for every
+// disclosure JWT. The default attributes are set in the config.
+func withDisclosedAttributes(t *testing.T, c *Config, attributes map[string]string) {
+	c.InitialsAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.initials")}
+	c.FamilyNameAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.familyname")}
+	c.DateOfBirthAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.dateofbirth")}
+	disclosed := make(map[irma.AttributeTypeIdentifier]irma.TranslatedString)
+	for id, value := range attributes {
+		disclosed[irma.NewAttributeTypeIdentifier(id)] = irma.TranslatedString{"nl": value}
+	}
+	oldParse := parseDisclosureJwt
+	t.Cleanup(func() { parseDisclosureJwt = oldParse })
+	parseDisclosureJwt = func(jwt string, pk *rsa.PublicKey) (map[irma.AttributeTypeIdentifier]irma.TranslatedString, error) {
+		return disclosed, nil
+	}
+}
+
+// Write apiserver-pk.pem to dir, returning the private key.
+func writeAPIServerKey(t *testing.T, dir string) *rsa.PrivateKey {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, "apiserver-pk.pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+// Post the given form fields and PDF, if any, to apiIssue.
+func postIssue(t *testing.T, state *serverState, fields map[string]string, pdf []byte) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pdf != nil {
+		part, err := form.CreateFormFile("pdf", "diploma.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(pdf)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/issue", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	apiIssue(w, r, state)
+	return w
+}
+
+// Swap the config directory, certificate directory and state for a test.
+func withTestState(t *testing.T, state *serverState) {
+	oldConfigDir, oldCertDir, oldState := configDir, certDir, currentState.Load()
+	t.Cleanup(func() {
+		configDir, certDir = oldConfigDir, oldCertDir
+		currentState.Store(oldState)
+	})
+	currentState.Store(state)
+}
+
+// A reload must not wait for requests in flight, which keep using the state
+// they started with, while new requests use the new state.
+func TestReloadWhileServing(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	writeTestCert(t, dirs[0], "old")
+	writeTestCert(t, dirs[1], "new")
+	oldConfig := defaultConfig()
+	extractor := blockingExtractor{make(chan struct{}), make(chan struct{})}
+	oldVerifier := duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: extractor})
+	withTestState(t, &serverState{&oldConfig, oldVerifier})
+	configDir = t.TempDir()
+	if err := ioutil.WriteFile(configDir+"/config.json", []byte(`{"requestor_name": "Reloaded"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := withState(withHTTPS(withCORS(func(w http.ResponseWriter, r *http.Request, state *serverState) {
+		if r.URL.Path == "/extract" {
+			if _, err := verifyAndExtract(state, []byte("%PDF-")); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Write([]byte(state.config.RequestorName))
+	})))
+	request := func(path string) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", path, nil))
+		return w.Body.String()
+	}
+
+	const inFlight = 4
+	var wg sync.WaitGroup
+	for i := 0; i < inFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if name := request("/extract"); name != oldConfig.RequestorName {
+				t.Errorf("request in flight finished with requestor %q", name)
+			}
+		}()
+	}
+	for i := 0; i < inFlight; i++ {
+		<-extractor.started
+	}
+
+	// Rotate the certificates while the requests are in flight, with other
+	// requests reading the state concurrently.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			certDir = dirs[i%2]
+			if err := reloadState(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	timeout := time.After(10 * time.Second)
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-timeout:
+			t.Fatal("reload waits for the requests in flight")
+		default:
+			request("/")
+		}
+	}
+
+	if name := request("/"); name != "Reloaded" {
+		t.Errorf("new request uses requestor %q", name)
+	}
+	if currentState.Load().verifier == oldVerifier {
+		t.Error("verifier was not replaced")
+	}
+	close(extractor.release)
+	wg.Wait()
+}
+
+// Replace the clock with a fixed time for a test.
+func withClock(t *testing.T, now time.Time) {
+	oldClock := clock
+	t.Cleanup(func() { clock = oldClock })
+	clock = func() time.Time { return now }
+}
+
+// Each credential must be issued as its own type, with the validity of that
+// type.
+func TestCredentialRequestsTypes(t *testing.T) {
+	now := time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+	withClock(t, now)
+	c := defaultConfig()
+	c.DUOCrendentialID = "pbdf.pbdf.diploma"
+	c.CredentialTypes = map[string]string{"WO Master": "pbdf.pbdf.diplomaMaster"}
+	c.CredentialValidities = map[string]int{"pbdf.pbdf.diplomaMaster": 60}
+	diplomas := []duo.Diploma{
+		{FamilyName: "Jansen", Education: "M Informatica", Degree: "WO Master"},
+		{FamilyName: "Jansen", Education: "VWO"},
+	}
+
+	credentials, err := credentialRequests(&c, diplomas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 2 {
+		t.Fatalf("got %d credentials, want 2", len(credentials))
+	}
+	tests := []struct {
+		credential string
+		months     int
+	}{
+		{"pbdf.pbdf.diplomaMaster", 60},
+		{"pbdf.pbdf.diploma", 12},
+	}
+	for i, tc := range tests {
+		credential := credentials[i]
+		if id := credential.CredentialTypeID.String(); id != tc.credential {
+			t.Errorf("credential %d: got type %s, want %s", i, id, tc.credential)
+		}
+		if want := credentialValidity(now, tc.months); time.Time(*credential.Validity) != time.Time(want) {
+			t.Errorf("credential %d: got validity %v, want %v", i, time.Time(*credential.Validity), time.Time(want))
+		}
+	}
+	if time.Time(*credentials[0].Validity) == time.Time(*credentials[1].Validity) {
+		t.Error("both credential types have the same validity")
+	}
+}
+
+func TestCredentialValidity(t *testing.T) {
+	const epoch = irma.ExpiryFactor * time.Second
+	// An epoch boundary, on a day that exists in every month.
+	boundary := time.Unix(1599696000, 0).UTC() // 2020-09-10
+	tests := []struct {
+		name   string
+		now    time.Time
+		months int
+		exact  bool // whether the requested expiry is an epoch boundary
+	}{
+		{"mid-month", time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC), 12, false},
+		{"end of month", time.Date(2020, 1, 31, 23, 59, 59, 0, time.UTC), 1, false},
+		{"leap day", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), 12, false},
+		{"long validity", time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC), 600, false},
+		{"boundary", boundary.AddDate(0, -6, 0), 6, true},
+		{"just after boundary", boundary.AddDate(0, -6, 0).Add(time.Second), 6, false},
+	}
+	for _, tc := range tests {
+		requested := tc.now.AddDate(0, tc.months, 0)
+		expiry := time.Time(credentialValidity(tc.now, tc.months))
+		if expiry.Unix()%irma.ExpiryFactor != 0 {
+			t.Errorf("%s: expiry %v is not an epoch boundary", tc.name, expiry)
+		}
+		if expiry.After(requested) || !expiry.After(requested.Add(-epoch)) {
+			t.Errorf("%s: expiry %v is not within an epoch before %v", tc.name, expiry, requested)
+		}
+		if tc.exact != expiry.Equal(requested) {
+			t.Errorf("%s: got expiry %v for requested %v", tc.name, expiry, requested)
+		}
+	}
+}
+
+func TestValidityMonths(t *testing.T) {
+	c := defaultConfig()
+	c.CredentialValidity = 12
+	c.CredentialValidities = map[string]int{"pbdf.pbdf.diplomaMaster": 60}
+	tests := []struct {
+		credential string
+		months     int
+	}{
+		{"pbdf.pbdf.diplomaMaster", 60},
+		{"pbdf.pbdf.diploma", 12},
+		{"", 12},
+	}
+	for _, tc := range tests {
+		if months := validityMonths(&c, tc.credential); months != tc.months {
+			t.Errorf("%q: got %d months, want %d", tc.credential, months, tc.months)
+		}
+	}
+	c.CredentialValidities = nil
+	if months := validityMonths(&c, "pbdf.pbdf.diplomaMaster"); months != 12 {
+		t.Errorf("without credential_validities: got %d months, want 12", months)
+	}
+}
+
+// Describe disjunctions as "label: attribute" or, when pinned to a value,
+// "label: attribute=value".
+func describeDisjunctions(disjunctions irma.AttributeDisjunctionList) []string {
+	var descriptions []string
+	for _, disjunction := range disjunctions {
+		for _, attr := range disjunction.Attributes {
+			description := disjunction.Label + ": " + attr.String()
+			if value, ok := disjunction.Values[attr]; ok {
+				description += "=" + *value
+			}
+			descriptions = append(descriptions, description)
+		}
+	}
+	return descriptions
+}
+
+// The disclosure request only asks for the attributes, while the issuance
+// request pins them to the values disclosed before, unless unpinned.
+func TestRequiredAttributes(t *testing.T) {
+	c := defaultConfig()
+	c.InitialsAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.initials")}
+	c.FamilyNameAttributes = []irma.AttributeTypeIdentifier{
+		irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.familyname"),
+		irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.familyname"),
+	}
+	c.DateOfBirthAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.dateofbirth")}
+	initials, familyname, dob, identifier := "J.", "Jansen", "03-03-1990", "123456782"
+	tests := []struct {
+		name        string
+		identifiers bool // with identifier_attributes
+		groups      bool // with a disclosure group
+		unpinned    []string
+		disclosed   bool // for the issuance request
+		withoutDOB  bool
+		want        []string
+	}{
+		{"disclosure", false, false, nil, false, false, []string{
+			"Initials: pbdf.pbdf.idin.initials",
+			"Family name: pbdf.pbdf.idin.familyname",
+			"Family name: pbdf.gemeente.personalData.familyname",
+			"Date of birth: pbdf.pbdf.idin.dateofbirth",
+		}},
+		{"issuance", false, false, nil, true, false, []string{
+			"Initials: pbdf.pbdf.idin.initials=J.",
+			"Family name: pbdf.pbdf.idin.familyname=Jansen",
+			"Family name: pbdf.gemeente.personalData.familyname=Jansen",
+			"Date of birth: pbdf.pbdf.idin.dateofbirth=03-03-1990",
+		}},
+		{"issuance without date of birth", false, false, nil, true, true, []string{
+			"Initials: pbdf.pbdf.idin.initials=J.",
+			"Family name: pbdf.pbdf.idin.familyname=Jansen",
+			"Family name: pbdf.gemeente.personalData.familyname=Jansen",
+		}},
+		{"issuance, unpinned", true, false, []string{"familyname", "identifier"}, true, false, []string{
+			"Initials: pbdf.pbdf.idin.initials=J.",
+			"Family name: pbdf.pbdf.idin.familyname",
+			"Family name: pbdf.gemeente.personalData.familyname",
+			"Date of birth: pbdf.pbdf.idin.dateofbirth=03-03-1990",
+			"Identifier: pbdf.gemeente.personalData.bsn",
+		}},
+		{"disclosure with identifier and group", true, true, nil, false, false, []string{
+			"Initials: pbdf.pbdf.idin.initials",
+			"Family name: pbdf.pbdf.idin.familyname",
+			"Family name: pbdf.gemeente.personalData.familyname",
+			"Date of birth: pbdf.pbdf.idin.dateofbirth",
+			"Identifier: pbdf.gemeente.personalData.bsn",
+			"Student: pbdf.pbdf.studentcard.university",
+		}},
+		{"issuance with identifier and group", true, true, nil, true, false, []string{
+			"Initials: pbdf.pbdf.idin.initials=J.",
+			"Family name: pbdf.pbdf.idin.familyname=Jansen",
+			"Family name: pbdf.gemeente.personalData.familyname=Jansen",
+			"Date of birth: pbdf.pbdf.idin.dateofbirth=03-03-1990",
+			"Identifier: pbdf.gemeente.personalData.bsn=123456782",
+			"Student: pbdf.pbdf.studentcard.university=Radboud Universiteit",
+		}},
+		{"issuance, unpinned group", true, true, []string{"Student"}, true, false, []string{
+			"Initials: pbdf.pbdf.idin.initials=J.",
+			"Family name: pbdf.pbdf.idin.familyname=Jansen",
+			"Family name: pbdf.gemeente.personalData.familyname=Jansen",
+			"Date of birth: pbdf.pbdf.idin.dateofbirth=03-03-1990",
+			"Identifier: pbdf.gemeente.personalData.bsn=123456782",
+			"Student: pbdf.pbdf.studentcard.university",
+		}},
+	}
+	for _, tc := range tests {
+		c.IdentifierAttributes = nil
+		if tc.identifiers {
+			c.IdentifierAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.bsn")}
+		}
+		c.DisclosureGroups = nil
+		if tc.groups {
+			c.DisclosureGroups = []DisclosureGroup{{
+				Label:      "Student",
+				Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.studentcard.university")},
+			}}
+		}
+		c.UnpinnedAttributes = tc.unpinned
+		var disjunctions irma.AttributeDisjunctionList
+		if tc.disclosed {
+			var groups []string
+			if tc.groups {
+				groups = []string{"Radboud Universiteit"}
+			}
+			disjunctions = requiredAttributes(&c, &initials, &familyname, &dob, &identifier, groups, tc.withoutDOB)
+		} else {
+			disjunctions = requiredAttributes(&c, nil, nil, nil, nil, nil, tc.withoutDOB)
+		}
+		if got := describeDisjunctions(disjunctions); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got disjunctions\n%s\nwant\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	small := []byte("issuance-jwt")
+	large := bytes.Repeat([]byte("a"), 2048)
+	tests := []struct {
+		name           string
+		data           []byte
+		acceptEncoding string
+		compressed     bool
+	}{
+		{"small", small, "gzip", false},
+		{"large", large, "", false},
+		{"large without gzip", large, "deflate, br", false},
+		{"large with gzip", large, "gzip", true},
+		{"large with gzip in list", large, "br, gzip;q=0.8", true},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", "/api/issue", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		w := httptest.NewRecorder()
+		writeResponse(w, r, tc.data)
+		compressed := w.Header().Get("Content-Encoding") == "gzip"
+		if compressed != tc.compressed {
+			t.Errorf("%s: compressed is %v, want %v", tc.name, compressed, tc.compressed)
+			continue
+		}
+		body := w.Body.Bytes()
+		if compressed {
+			if w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("%s: missing Vary header", tc.name)
+			}
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+				continue
+			}
+			body, err = ioutil.ReadAll(gz)
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+				continue
+			}
+		}
+		if !bytes.Equal(body, tc.data) {
+			t.Errorf("%s: body differs", tc.name)
+		}
+	}
+}
+
+func TestValidityStart(t *testing.T) {
+	now := time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+	achieved := time.Date(2016, 8, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		fromAchieved bool
+		achieved     string
+		months       int
+		start        time.Time
+		err          error
+	}{
+		{"from now", false, "31-08-2016", 60, now, nil},
+		{"from achieved", true, "31-08-2016", 60, achieved, nil},
+		{"unparseable date", true, "augustus 2016", 60, now, nil},
+		{"missing date", true, "", 60, now, nil},
+		{"already expired", true, "31-08-2016", 24, time.Time{}, errCredentialExpired},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.ValidityFromAchieved = tc.fromAchieved
+		start, err := validityStart(&c, now, tc.achieved, tc.months)
+		if !start.Equal(tc.start) || err != tc.err {
+			t.Errorf("%s: got %v, %v, want %v, %v", tc.name, start, err, tc.start, tc.err)
+		}
+	}
+}
+
+// Empty attributes are left out, unless they have a default, and unknown
+// attributes can't be given a default or transform.
+func TestTransformAttributes(t *testing.T) {
+	c := defaultConfig()
+	c.AttributeDefaults = map[string]string{"profile": "-", "city_normalized": "Onbekend"}
+	c.AttributeTransforms = map[string]string{"familyname": "upper"}
+	c.AttributeVariants = map[string]AttributeVariant{"city_normalized": {From: "city", Transform: "title"}}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	got := transformAttributes(&c, map[string]string{
+		"familyname": "Jansen",
+		"prefix":     " ",
+		"profile":    "",
+		"city":       "DEN HAAG",
+	})
+	want := map[string]string{
+		"familyname":      "JANSEN",
+		"profile":         "-",
+		"city":            "DEN HAAG",
+		"city_normalized": "Den Haag",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := transformAttributes(&c, map[string]string{"familyname": "Jansen"}); got["city_normalized"] != "Onbekend" {
+		t.Errorf("variant without source: got %v", got)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		defaults   map[string]string
+		transforms map[string]string
+	}{
+		{"default for an unknown attribute", map[string]string{"profiel": "-"}, nil},
+		{"transform of an unknown attribute", nil, map[string]string{"stad": "title"}},
+		{"transform of a variant", nil, map[string]string{"city_normalized": "upper"}},
+	} {
+		c.AttributeDefaults, c.AttributeTransforms = tc.defaults, tc.transforms
+		if err := c.validate(); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+}
+
+// Serve the public routes for the given config, issuing testDiploma with
+// recordingSigner.
+func serveTestHandler(t *testing.T, c *Config) *httptest.Server {
+	v := duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: fixedExtractor{testDiploma}})
+	withTestState(t, &serverState{c, v})
+	withSigner(t, &recordingSigner{})
+	oldStaticDir := serverStaticDir
+	t.Cleanup(func() { serverStaticDir = oldStaticDir })
+	serverStaticDir = t.TempDir()
+	server := httptest.NewServer(newServerHandler(c))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Send a request to the test server with the given headers, without following
+// redirects, and return the response with its body.
+func doTestRequest(t *testing.T, method, url string, header http.Header) (*http.Response, string) {
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header = header
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// Only allowed origins get CORS headers, with their own origin echoed back.
+func TestCORSOrigins(t *testing.T) {
+	tests := []struct {
+		name        string
+		domain      string
+		origins     []string
+		credentials bool
+		origin      string
+		allowOrigin string // empty when no CORS headers may be sent
+	}{
+		{"listed origin", "", []string{"https://a.example", "https://b.example"}, true, "https://b.example", "https://b.example"},
+		{"cors_domain", "https://a.example", nil, false, "https://a.example", "https://a.example"},
+		{"unlisted origin", "", []string{"https://a.example"}, true, "https://evil.example", ""},
+		{"origin prefix", "", []string{"https://a.example"}, true, "https://a.example.evil.example", ""},
+		{"no origin", "", []string{"https://a.example"}, true, "", ""},
+		{"any origin", "*", nil, false, "https://evil.example", "*"},
+		{"no CORS", "", nil, false, "https://a.example", ""},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.CORSDomain, c.CORSOrigins, c.CORSCredentials = tc.domain, tc.origins, tc.credentials
+		server := serveTestHandler(t, &c)
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		resp, _ := doTestRequest(t, "GET", server.URL+"/api/request-attrs", header)
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: got %s", tc.name, resp.Status)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", tc.name, got, tc.allowOrigin)
+		}
+		wantCredentials := ""
+		if tc.credentials && tc.allowOrigin != "" {
+			wantCredentials = "true"
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != wantCredentials {
+			t.Errorf("%s: got Access-Control-Allow-Credentials %q, want %q", tc.name, got, wantCredentials)
+		}
+		if resp.Header.Get("Vary") != "Origin" {
+			t.Errorf("%s: got Vary %q", tc.name, resp.Header.Get("Vary"))
+		}
+	}
+}
+
+// Preflight requests from allowed origins are answered with the configured
+// cache lifetime; others fall through to the handler.
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxAge int
+		origin string
+		status int
+	}{
+		{"default max age", 600, "https://a.example", http.StatusNoContent},
+		{"configured max age", 3600, "https://a.example", http.StatusNoContent},
+		{"no caching", 0, "https://a.example", http.StatusNoContent},
+		{"unlisted origin", 3600, "https://evil.example", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.CORSOrigins = []string{"https://a.example"}
+		c.CORSMaxAge = tc.maxAge
+		server := serveTestHandler(t, &c)
+		resp, _ := doTestRequest(t, "OPTIONS", server.URL+"/api/issue", http.Header{
+			"Origin":                         {tc.origin},
+			"Access-Control-Request-Method":  {"POST"},
+			"Access-Control-Request-Headers": {"Content-Type"},
+		})
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %s, want %d", tc.name, resp.Status, tc.status)
+			continue
+		}
+		if tc.status != http.StatusNoContent {
+			if got := resp.Header.Get("Access-Control-Max-Age"); got != "" {
+				t.Errorf("%s: got Access-Control-Max-Age %q for a disallowed origin", tc.name, got)
+			}
+			continue
+		}
+		if got, want := resp.Header.Get("Access-Control-Max-Age"), strconv.Itoa(tc.maxAge); got != want {
+			t.Errorf("%s: got Access-Control-Max-Age %q, want %q", tc.name, got, want)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+			t.Errorf("%s: got Access-Control-Allow-Methods %q", tc.name, got)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+			t.Errorf("%s: got Access-Control-Allow-Headers %q", tc.name, got)
+		}
+	}
+}
+
+// Requests that did not arrive over HTTPS according to https_header are
+// redirected or refused.
+func TestHTTPSHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		redirect bool
+		method   string
+		proto    string
+		status   int
+		body     string
+	}{
+		{"https", "X-Forwarded-Proto", false, "GET", "https", 200, ""},
+		{"https uppercase", "X-Forwarded-Proto", false, "GET", "HTTPS", 200, ""},
+		{"http", "X-Forwarded-Proto", false, "GET", "http", 403, "error:" + ErrorHTTPSRequired},
+		{"missing header", "X-Forwarded-Proto", false, "GET", "", 403, "error:" + ErrorHTTPSRequired},
+		{"http redirect", "X-Forwarded-Proto", true, "GET", "http", 301, ""},
+		{"http POST redirect", "X-Forwarded-Proto", true, "POST", "http", 403, "error:" + ErrorHTTPSRequired},
+		{"no https_header", "", false, "GET", "http", 200, ""},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.HTTPSHeader, c.HTTPSRedirect = tc.header, tc.redirect
+		server := serveTestHandler(t, &c)
+		header := http.Header{}
+		if tc.proto != "" {
+			header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		resp, body := doTestRequest(t, tc.method, server.URL+"/api/request-attrs?foo=bar", header)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %s, want %d", tc.name, resp.Status, tc.status)
+			continue
+		}
+		if tc.body != "" && body != tc.body {
+			t.Errorf("%s: got body %q, want %q", tc.name, body, tc.body)
+		}
+		if tc.status == 301 {
+			want := "https://" + strings.TrimPrefix(server.URL, "http://") + "/api/request-attrs?foo=bar"
+			if got := resp.Header.Get("Location"); got != want {
+				t.Errorf("%s: got Location %q, want %q", tc.name, got, want)
+			}
+		}
+	}
+}
+
+// A panicking handler results in an internal error, logged with the request
+// ID.
+func TestRecover(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	handler := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler bug")
+	}))
+	r := httptest.NewRequest("GET", "/api/request-attrs", nil)
+	r.Header.Set("X-Request-ID", "test-request")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != 500 {
+		t.Errorf("got status %d, want 500", w.Code)
+	}
+	if got, want := w.Body.String(), "error:"+ErrorInternal; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if !strings.Contains(logged.String(), "panic in request test-request (GET /api/request-attrs): handler bug") {
+		t.Errorf("panic not logged: %q", logged.String())
+	}
+}
+
+// With base_path set, all routes are served below it and not at the root.
+func TestBasePath(t *testing.T) {
+	c := defaultConfig()
+	c.BasePath = "/duo"
+	server := serveTestHandler(t, &c)
+	if err := ioutil.WriteFile(filepath.Join(serverStaticDir, "common.js"), []byte("common"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/duo/api/request-attrs", 200, "disclosure-jwt"},
+		{"/duo/api/errors", 200, ""},
+		{"/duo/common.js", 200, "common"},
+		{"/api/request-attrs", 404, ""},
+		{"/api/errors", 404, ""},
+		{"/common.js", 404, ""},
+		{"/duoapi/request-attrs", 404, ""},
+	}
+	for _, tc := range tests {
+		resp, body := doTestRequest(t, "GET", server.URL+tc.path, http.Header{})
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %s, want %d", tc.path, resp.Status, tc.status)
+			continue
+		}
+		if tc.body != "" && body != tc.body {
+			t.Errorf("%s: got body %q, want %q", tc.path, body, tc.body)
+		}
+	}
+}
+
+// Static files are sent with the content type of their extension, even when
+// the system MIME database doesn't know it, and may be cached for
+// static_max_age_seconds. API responses are never cached.
+func TestStaticHeaders(t *testing.T) {
+	// The start of an empty WebAssembly module.
+	wasm := []byte("\x00asm\x01\x00\x00\x00")
+	tests := []struct {
+		maxAge       int
+		cacheControl string
+	}{
+		{0, "no-cache"},
+		{3600, "public, max-age=3600"},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.StaticMaxAge = tc.maxAge
+		server := serveTestHandler(t, &c)
+		files := map[string][]byte{
+			"irma.wasm":                wasm,
+			"common.js":                []byte("var common;"),
+			"Style.CSS":                []byte("body {}"),
+			".well-known/security.txt": []byte("Contact: mailto:security@example.com"),
+		}
+		for name, data := range files {
+			name = filepath.Join(serverStaticDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		requests := []struct {
+			path         string
+			contentType  string
+			cacheControl string
+		}{
+			{"/irma.wasm", "application/wasm", tc.cacheControl},
+			{"/common.js", "text/javascript; charset=utf-8", tc.cacheControl},
+			{"/Style.CSS", "text/css; charset=utf-8", tc.cacheControl},
+			// Without a known extension, the file server sniffs the type.
+			{"/.well-known/security.txt", "text/plain; charset=utf-8", tc.cacheControl},
+			{"/api/request-attrs", "", "no-store"},
+			{"/api/errors", "", "no-store"},
+		}
+		for _, request := range requests {
+			resp, body := doTestRequest(t, "GET", server.URL+request.path, http.Header{})
+			if resp.StatusCode != 200 {
+				t.Errorf("%d, %s: got %s", tc.maxAge, request.path, resp.Status)
+				continue
+			}
+			if data, ok := files[request.path[1:]]; ok && body != string(data) {
+				t.Errorf("%d, %s: got body %q, want %q", tc.maxAge, request.path, body, data)
+			}
+			if request.contentType != "" && resp.Header.Get("Content-Type") != request.contentType {
+				t.Errorf("%d, %s: got Content-Type %q, want %q", tc.maxAge, request.path, resp.Header.Get("Content-Type"), request.contentType)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != request.cacheControl {
+				t.Errorf("%d, %s: got Cache-Control %q, want %q", tc.maxAge, request.path, got, request.cacheControl)
+			}
+		}
+	}
+}
+
+// Extractor that blocks until released, recording how many extractions run at
+// the same time.
+type countingExtractor struct {
+	mu      sync.Mutex
+	active  int
+	max     int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *countingExtractor) Extract(pdfData []byte) ([]duo.Diploma, []duo.Warning, error) {
+	e.mu.Lock()
+	e.active++
+	if e.active > e.max {
+		e.max = e.active
+	}
+	e.mu.Unlock()
+	e.started <- struct{}{}
+	<-e.release
+	e.mu.Lock()
+	e.active--
+	e.mu.Unlock()
+	return []duo.Diploma{testDiploma}, nil, nil
+}
+
+// No more than max_extractions extractions run at the same time, the others
+// wait for a free slot or give up after extraction_wait seconds.
+func TestMaxExtractions(t *testing.T) {
+	const maxExtractions = 2
+	oldSlots := extractionSlots
+	defer func() { extractionSlots = oldSlots }()
+	extractionSlots = make(chan struct{}, maxExtractions)
+
+	extractor := &countingExtractor{started: make(chan struct{}), release: make(chan struct{})}
+	c := defaultConfig()
+	c.MaxExtractions = maxExtractions
+	c.ExtractionWait = 10
+	state := &serverState{&c, duo.New(x509.NewCertPool(), duo.Options{SkipVerification: true, Extractor: extractor})}
+
+	const requests = 5
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			_, err := verifyAndExtract(state, []byte("%PDF-1.7"))
+			errs <- err
+		}()
+	}
+	for i := 0; i < maxExtractions; i++ {
+		<-extractor.started
+	}
+
+	// All slots are taken, so a request that doesn't wait is refused.
+	noWait := c
+	noWait.ExtractionWait = 0
+	if _, err := verifyAndExtract(&serverState{&noWait, state.verifier}, []byte("%PDF-1.7")); err != errBusy {
+		t.Errorf("got %v with all slots taken, want errBusy", err)
+	}
+
+	// Release the extractions one by one, letting the waiting ones take the
+	// free slots.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case extractor.release <- struct{}{}:
+			case <-extractor.started:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("extraction %d: %v", i, err)
+		}
+	}
+	if extractor.max > maxExtractions {
+		t.Errorf("got %d concurrent extractions, want at most %d", extractor.max, maxExtractions)
+	}
+	if len(extractionSlots) != 0 {
+		t.Errorf("%d extraction slots not released", len(extractionSlots))
+	}
+}
+
+// Claims of a disclosure JWT from the IRMA API server.
+type disclosureClaims struct {
+	Expires    int64                            `json:"exp"`
+	Attributes map[string]irma.TranslatedString `json:"attributes"`
+}
+
+// Expiry is checked separately, as irma.ParseDisclosureJwt does.
+func (c *disclosureClaims) Valid() error {
+	return nil
+}
+
+// Parse disclosure JWTs like irma.ParseDisclosureJwt: verify them with the
+// given key using jwt-go, then check the expiry.
+func withDisclosureJwtParser(t *testing.T) {
+	oldParse := parseDisclosureJwt
+	t.Cleanup(func() { parseDisclosureJwt = oldParse })
+	parseDisclosureJwt = func(text string, pk *rsa.PublicKey) (map[irma.AttributeTypeIdentifier]irma.TranslatedString, error) {
+		claims := &disclosureClaims{}
+		_, err := jwt.ParseWithClaims(text, claims, func(token *jwt.Token) (interface{}, error) {
+			return pk, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if time.Unix(claims.Expires, 0).Before(time.Now()) {
+			return nil, irma.ExpiredError{}
+		}
+		attributes := make(map[irma.AttributeTypeIdentifier]irma.TranslatedString)
+		for id, value := range claims.Attributes {
+			attributes[irma.NewAttributeTypeIdentifier(id)] = value
+		}
+		return attributes, nil
+	}
+}
+
+// Sign a disclosure JWT with the given attributes, as the IRMA API server
+// does.
+func signDisclosureJwt(t *testing.T, key *rsa.PrivateKey, expires time.Time, attributes map[string]string) string {
+	claims := &disclosureClaims{Expires: expires.Unix(), Attributes: make(map[string]irma.TranslatedString)}
+	for id, value := range attributes {
+		claims.Attributes[id] = irma.TranslatedString{"nl": value}
+	}
+	text, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+// Disclosure JWTs that can't be parsed are bad requests, but JWTs that don't
+// verify with apiserver-pk.pem point to a server misconfiguration.
+func TestParseDisclosureErrors(t *testing.T) {
+	withDisclosureJwtParser(t)
+	c := defaultConfig()
+	c.InitialsAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.initials")}
+	c.FamilyNameAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.familyname")}
+	c.DateOfBirthAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.dateofbirth")}
+	apiServerKey := writeAPIServerKey(t, t.TempDir())
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := map[string]string{
+		"pbdf.pbdf.idin.initials":    "J.",
+		"pbdf.pbdf.idin.familyname":  "Jansen",
+		"pbdf.pbdf.idin.dateofbirth": "03-03-1990",
+	}
+	expires := time.Now().Add(time.Hour)
+	valid := signDisclosureJwt(t, apiServerKey, expires, attributes)
+
+	tests := []struct {
+		name   string
+		jwt    string
+		status int
+		error  string
+	}{
+		{"valid", valid, 0, ""},
+		{"wrong key", signDisclosureJwt(t, otherKey, expires, attributes), 500, ErrorAttributes},
+		{"empty", "", 400, ErrorAttributes},
+		{"not a JWT", "disclosure-jwt", 400, ErrorAttributes},
+		{"malformed segments", "a.b.c", 400, ErrorAttributes},
+		{"malformed payload", valid[:strings.Index(valid, ".")] + ".e30K!." + valid[strings.LastIndex(valid, ".")+1:], 400, ErrorAttributes},
+	}
+	for _, tc := range tests {
+		disclosed, status, errorCode := parseDisclosure(&c, tc.jwt, &apiServerKey.PublicKey)
+		if status != tc.status || errorCode != tc.error {
+			t.Errorf("%s: got %d %q, want %d %q", tc.name, status, errorCode, tc.status, tc.error)
+			continue
+		}
+		if errorCode == "" && (disclosed.Initials != "J." || disclosed.FamilyName != "Jansen") {
+			t.Errorf("%s: got %+v", tc.name, disclosed)
+		}
+	}
+}
+
+// Expired disclosures and disclosures without one of the required attributes
+// are refused, while optional attributes may be left out.
+func TestParseDisclosureAttributes(t *testing.T) {
+	withDisclosureJwtParser(t)
+	apiServerKey := writeAPIServerKey(t, t.TempDir())
+	expires := time.Now().Add(time.Hour)
+	required := map[string]string{
+		"pbdf.pbdf.idin.initials":          "J.",
+		"pbdf.pbdf.idin.familyname":        "Jansen",
+		"pbdf.pbdf.idin.dateofbirth":       "03-03-1990",
+		"pbdf.pbdf.studentcard.university": "Radboud Universiteit",
+	}
+	// The required attributes, with the given attributes added or, when
+	// their value is empty, removed.
+	with := func(changes map[string]string) map[string]string {
+		attributes := make(map[string]string)
+		for id, value := range required {
+			attributes[id] = value
+		}
+		for id, value := range changes {
+			if value == "" {
+				delete(attributes, id)
+			} else {
+				attributes[id] = value
+			}
+		}
+		return attributes
+	}
+	tests := []struct {
+		name        string
+		expires     time.Time
+		attributes  map[string]string
+		optionalDOB bool
+		error       string
+		identifier  string // "" when not disclosed
+		dob         string // "" when not disclosed
+		groups      []string
+	}{
+		{"valid", expires, required, false, "", "", "03-03-1990", []string{"Radboud Universiteit"}},
+		{"expired", time.Now().Add(-time.Minute), required, false, ErrorAttributesExpired, "", "", nil},
+		{"no initials", expires, with(map[string]string{"pbdf.pbdf.idin.initials": ""}), false, ErrorAttributesMissing, "", "", nil},
+		{"no family name", expires, with(map[string]string{"pbdf.pbdf.idin.familyname": ""}), false, ErrorAttributesMissing, "", "", nil},
+		{"family name from second attribute", expires, with(map[string]string{"pbdf.pbdf.idin.familyname": "", "pbdf.gemeente.personalData.familyname": "Jansen"}), false, "", "", "03-03-1990", []string{"Radboud Universiteit"}},
+		{"no date of birth", expires, with(map[string]string{"pbdf.pbdf.idin.dateofbirth": ""}), false, ErrorAttributesMissing, "", "", nil},
+		{"no date of birth, optional", expires, with(map[string]string{"pbdf.pbdf.idin.dateofbirth": ""}), true, "", "", "", []string{"Radboud Universiteit"}},
+		{"identifier", expires, with(map[string]string{"pbdf.gemeente.personalData.bsn": "123456782"}), false, "", "123456782", "03-03-1990", []string{"Radboud Universiteit"}},
+		{"no group", expires, with(map[string]string{"pbdf.pbdf.studentcard.university": ""}), false, ErrorAttributesMissing, "", "", nil},
+	}
+	for _, tc := range tests {
+		c := defaultConfig()
+		c.InitialsAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.initials")}
+		c.FamilyNameAttributes = []irma.AttributeTypeIdentifier{
+			irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.familyname"),
+			irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.familyname"),
+		}
+		c.DateOfBirthAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.idin.dateofbirth")}
+		c.IdentifierAttributes = []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.gemeente.personalData.bsn")}
+		c.DisclosureGroups = []DisclosureGroup{{
+			Label:      "Student",
+			Attributes: []irma.AttributeTypeIdentifier{irma.NewAttributeTypeIdentifier("pbdf.pbdf.studentcard.university")},
+		}}
+		c.OptionalDateOfBirth = tc.optionalDOB
+
+		disclosed, status, errorCode := parseDisclosure(&c, signDisclosureJwt(t, apiServerKey, tc.expires, tc.attributes), &apiServerKey.PublicKey)
+		if errorCode != tc.error || tc.error != "" && status != 400 {
+			t.Errorf("%s: got %d %q, want 400 %q", tc.name, status, errorCode, tc.error)
+			continue
+		}
+		if errorCode != "" {
+			continue
+		}
+		if disclosed.Initials != "J." || disclosed.FamilyName != "Jansen" {
+			t.Errorf("%s: got initials %q and family name %q", tc.name, disclosed.Initials, disclosed.FamilyName)
+		}
+		if disclosed.DateOfBirth == nil && tc.dob != "" || disclosed.DateOfBirth != nil && *disclosed.DateOfBirth != tc.dob {
+			t.Errorf("%s: got date of birth %v, want %q", tc.name, disclosed.DateOfBirth, tc.dob)
+		}
+		if disclosed.Identifier == nil && tc.identifier != "" || disclosed.Identifier != nil && *disclosed.Identifier != tc.identifier {
+			t.Errorf("%s: got identifier %v, want %q", tc.name, disclosed.Identifier, tc.identifier)
+		}
+		if !reflect.DeepEqual(disclosed.Groups, tc.groups) {
+			t.Errorf("%s: got groups %q, want %q", tc.name, disclosed.Groups, tc.groups)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// How long a session nonce can be used after it has been handed out by
+// apiRequestAttrs.
+const sessionLifetime = 10 * time.Minute
+
+// How long a used disclosure JWT is remembered, to reject it when it's used
+// again. This should be longer than disclosure JWTs are valid.
+const replayWindow = 24 * time.Hour
+
+// Maximum number of sessions in progress, so the store can't grow without
+// bounds when apiRequestAttrs is flooded.
+const maxSessions = 100000
+
+var errTooManySessions = errors.New("too many sessions in progress")
+
+// In-memory store of session nonces and used disclosure JWTs, for the
+// session_binding option. A session starts when apiRequestAttrs hands out a
+// nonce and ends when apiIssue consumes it together with the disclosure JWT.
+// Each nonce and each disclosure JWT can be used only once. The store is lost
+// on restart, so sessions in progress must then be restarted as well.
+type sessionStore struct {
+	lock   sync.Mutex
+	nonces map[string]time.Time // nonce -> expiry
+	used   map[string]time.Time // hash of disclosure JWT -> expiry
+}
+
+var sessions = &sessionStore{
+	nonces: make(map[string]time.Time),
+	used:   make(map[string]time.Time),
+}
+
+// Start a new session, returning its nonce.
+func (s *sessionStore) start() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(data)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(clock())
+	if len(s.nonces) >= maxSessions {
+		return "", errTooManySessions
+	}
+	s.nonces[nonce] = clock().Add(sessionLifetime)
+	return nonce, nil
+}
+
+// End the session with the given nonce, using the given disclosure JWT.
+// Returns false when the nonce is unknown or expired, when the disclosure JWT
+// was made for another nonce, or when it has been used before.
+func (s *sessionStore) finish(nonce, disclosureJwt string) bool {
+	expected := sessionNonce(nonce)
+	if disclosed := disclosedNonce(disclosureJwt); expected == nil || disclosed == nil || disclosed.Cmp(expected) != 0 {
+		return false
+	}
+	hash := sha256.Sum256([]byte(disclosureJwt))
+	key := hex.EncodeToString(hash[:])
+	now := clock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire(now)
+	if _, ok := s.nonces[nonce]; !ok {
+		return false
+	}
+	if _, ok := s.used[key]; ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	s.used[key] = now.Add(replayWindow)
+	return true
+}
+
+// Remove expired entries. Must be called with the lock held.
+func (s *sessionStore) expire(now time.Time) {
+	for nonce, expiry := range s.nonces {
+		if now.After(expiry) {
+			delete(s.nonces, nonce)
+		}
+	}
+	for key, expiry := range s.used {
+		if now.After(expiry) {
+			delete(s.used, key)
+		}
+	}
+}
+
+// The nonce as put in the disclosure request, or nil when it isn't a nonce
+// handed out by start.
+func sessionNonce(nonce string) *big.Int {
+	if len(nonce) != 32 {
+		return nil
+	}
+	n, ok := new(big.Int).SetString(nonce, 16)
+	if !ok {
+		return nil
+	}
+	return n
+}
+
+// Get the nonce the attributes were disclosed with from the claims of a
+// disclosure JWT, or nil when it has none. The JWT must have been verified
+// already by parseDisclosureJwt.
+func disclosedNonce(disclosureJwt string) *big.Int {
+	parser := &jwt.Parser{UseJSONNumber: true}
+	claims := jwt.MapClaims{}
+	if _, _, err := parser.ParseUnverified(disclosureJwt, claims); err != nil {
+		return nil
+	}
+	var text string
+	switch nonce := claims["nonce"].(type) {
+	case json.Number:
+		text = string(nonce)
+	case string:
+		text = nonce
+	default:
+		return nil
+	}
+	n, ok := new(big.Int).SetString(text, 10)
+	if !ok {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rsa"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Make a disclosure JWT with the given nonce claim, signed by the API server
+// key. A nil nonce leaves the claim out.
+func disclosureJwtWithNonce(t *testing.T, sk *rsa.PrivateKey, nonce interface{}) string {
+	claims := jwt.MapClaims{"sub": "disclosure_result", "status": "VALID"}
+	if nonce != nil {
+		claims["nonce"] = nonce
+	}
+	text, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+// The nonce handed out by apiRequestAttrs must be in the disclosure request,
+// and apiIssue must only accept disclosures made with that nonce.
+func TestSessionNonce(t *testing.T) {
+	c := defaultConfig()
+	c.SessionBinding = true
+	withDisclosedAttributes(t, &c, map[string]string{
+		"pbdf.pbdf.idin.initials":    "J.",
+		"pbdf.pbdf.idin.familyname":  "Jansen",
+		"pbdf.pbdf.idin.dateofbirth": "01-01-1990",
+	})
+	state := &serverState{&c, nil}
+	withTestState(t, state)
+	configDir = t.TempDir()
+	sk := writeAPIServerKey(t, configDir)
+	recorder := &recordingSigner{}
+	withSigner(t, recorder)
+
+	w := httptest.NewRecorder()
+	apiRequestAttrs(w, httptest.NewRequest("GET", "/api/request-attrs", nil), state)
+	nonce := w.Header().Get("X-Session-Nonce")
+	if nonce == "" {
+		t.Fatal("no session nonce")
+	}
+	want, _ := new(big.Int).SetString(nonce, 16)
+	if recorder.disclosure == nil || recorder.disclosure.Nonce == nil || recorder.disclosure.Nonce.Cmp(want) != 0 {
+		t.Fatalf("disclosure request doesn't have nonce %s", want)
+	}
+	other := new(big.Int).Add(want, big.NewInt(1))
+
+	tests := []struct {
+		name    string
+		nonce   interface{}
+		session bool // whether the session must be accepted
+	}{
+		{"no nonce", nil, false},
+		{"mismatched nonce", other.String(), false},
+		{"malformed nonce", "abc", false},
+		{"matching nonce", want.String(), true},
+		{"used nonce", want.String(), false},
+	}
+	for _, tc := range tests {
+		fields := map[string]string{
+			"attributes": disclosureJwtWithNonce(t, sk, tc.nonce),
+			"nonce":      nonce,
+		}
+		w := postIssue(t, state, fields, nil)
+		rejected := w.Code == 400 && strings.HasSuffix(w.Body.String(), "error:"+ErrorSession)
+		if rejected == tc.session {
+			t.Errorf("%s: got %d %s", tc.name, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+
+	"github.com/privacybydesign/irmago"
+)
+
+// Signer turns session requests into JWTs for the IRMA app, with the signing
+// key and requestor name of the given config. It can be replaced by a fake,
+// e.g. to inspect the requests built by the API handlers without needing a
+// private key.
+type Signer interface {
+	SignDisclosureRequest(c *Config, request *irma.DisclosureRequest) (string, error)
+	SignIssuanceRequest(c *Config, request *irma.IssuanceRequest) (string, error)
+}
+
+// The signer used by the API handlers.
+var signer Signer = rsaSigner{}
+
+// Signer that signs JWTs with the RSA key from the config directory, or the
+// ephemeral key in development mode.
+type rsaSigner struct{}
+
+func (rsaSigner) SignDisclosureRequest(c *Config, request *irma.DisclosureRequest) (string, error) {
+	sk, err := signingKey(c, c.JWTKeyID)
+	if err != nil {
+		return "", err
+	}
+	jwt := irma.NewServiceProviderJwt(c.RequestorName, request)
+	return jwt.Sign(c.JWTKeyID, sk)
+}
+
+func (rsaSigner) SignIssuanceRequest(c *Config, request *irma.IssuanceRequest) (string, error) {
+	sk, err := signingKey(c, c.JWTKeyID)
+	if err != nil {
+		return "", err
+	}
+	jwt := irma.NewIdentityProviderJwt(c.RequestorName, request)
+	return jwt.Sign(c.JWTKeyID, sk)
+}
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// Return the key with the given key ID. JWTs are signed with the key of
+// jwt_key_id, the other keys in signing_keys are only kept so their public
+// keys can still be retrieved while the IRMA server is switched over. Without
+// signing_keys, sk.pem is used.
+func signingKey(c *Config, keyID string) (*rsa.PrivateKey, error) {
+	if devKey != nil {
+		return devKey, nil
+	}
+	path := "sk.pem"
+	if c.SigningKeys != nil {
+		var ok bool
+		if path, ok = c.SigningKeys[keyID]; !ok {
+			return nil, errUnknownKey
+		}
+	}
+	// TODO: cache, or load on startup
+	return readPrivateKey(configDir + "/" + path)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/privacybydesign/irmago"
+)
+
+// Write an RSA private key to the config dir, returning the key.
+func writeSigningKey(t *testing.T, name string) *rsa.PrivateKey {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sk)})
+	if err := ioutil.WriteFile(filepath.Join(configDir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+// With signing_keys, both requests are signed with the key of jwt_key_id,
+// which is named in the JWT header, and not with the previous key.
+func TestSignActiveKey(t *testing.T) {
+	oldConfigDir := configDir
+	t.Cleanup(func() { configDir = oldConfigDir })
+	configDir = t.TempDir()
+	oldKey := writeSigningKey(t, "duo-2019.pem")
+	activeKey := writeSigningKey(t, "duo-2020.pem")
+	c := defaultConfig()
+	c.JWTKeyID = "duo-2020"
+	c.SigningKeys = map[string]string{"duo-2019": "duo-2019.pem", "duo-2020": "duo-2020.pem"}
+
+	disclosure, err := rsaSigner{}.SignDisclosureRequest(&c, &irma.DisclosureRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuance, err := rsaSigner{}.SignIssuanceRequest(&c, &irma.IssuanceRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range map[string]string{"disclosure": disclosure, "issuance": issuance} {
+		token, err := jwt.Parse(text, func(token *jwt.Token) (interface{}, error) {
+			return &activeKey.PublicKey, nil
+		})
+		if err != nil {
+			t.Errorf("%s: not signed with the active key: %v", name, err)
+			continue
+		}
+		if token.Header["kid"] != "duo-2020" {
+			t.Errorf("%s: got kid %v, want duo-2020", name, token.Header["kid"])
+		}
+		if _, err := jwt.Parse(text, func(token *jwt.Token) (interface{}, error) {
+			return &oldKey.PublicKey, nil
+		}); err == nil {
+			t.Errorf("%s: signed with the previous key", name)
+		}
+	}
+
+	// A jwt_key_id missing from signing_keys doesn't fall back to sk.pem.
+	c.JWTKeyID = "duo-2021"
+	if _, err := (rsaSigner{}).SignIssuanceRequest(&c, &irma.IssuanceRequest{}); err != errUnknownKey {
+		t.Errorf("got %v for an unknown jwt_key_id, want errUnknownKey", err)
+	}
+}
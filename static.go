@@ -0,0 +1,54 @@
+package main
+
+// This file contains the headers for static files and API responses, so the
+// frontend works and updates regardless of the MIME types known to the system.
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Content types of web assets, set explicitly as the system MIME database may
+// lack some of them (notably .wasm, which browsers refuse to compile with
+// another type).
+var staticTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".json":  "application/json",
+	".wasm":  "application/wasm",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+// withStaticHeaders wraps the static file handler to set the content type of
+// web assets and the Cache-Control header: cacheable for maxAge seconds, or
+// revalidated on every use when maxAge is 0.
+func withStaticHeaders(handler http.Handler, maxAge int) http.Handler {
+	cacheControl := "no-cache"
+	if maxAge > 0 {
+		cacheControl = "public, max-age=" + strconv.Itoa(maxAge)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType, ok := staticTypes[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// withNoStore wraps an API handler so its responses are never cached, as they
+// contain signed requests or depend on the config.
+func withNoStore(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		handler(w, r)
+	}
+}
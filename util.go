@@ -7,8 +7,18 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
 )
 
+// Returns the current time for credential validity, sessions, audit records
+// and signing time checks. It can be replaced by a fixed clock to test
+// time-dependent behaviour. Durations (e.g. timeouts) use the real clock.
+var clock = time.Now
+
 // Utility function to read the entire contents of a file.
 func readFile(path string) ([]byte, error) {
 	file, err := os.Open(path)
@@ -56,3 +66,17 @@ func readPublicKey(path string) (*rsa.PublicKey, error) {
 		return nil, errors.New("cannot determine public key type")
 	}
 }
+
+// Utility function to normalize a name for comparison: case, accents and
+// whitespace are ignored, so "Rijksuniversiteit  Groningen" matches
+// "rijksuniversiteit groningen" and "Pâté" matches "pate".
+func normalize(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(s)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue // combining mark (accent)
+		}
+		b.WriteRune(r)
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
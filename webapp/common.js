@@ -2,11 +2,20 @@
 
 var API = 'https://metrics.privacybydesign.foundation/duo/api/';
 
+// Set when the server has optional_dateofbirth, to let users without a date
+// of birth attribute disclose their name only.
+var OPTIONAL_DATEOFBIRTH = false;
+
 var disclosureJWT;
+var sessionToken; // token of the disclosure session at the IRMA server
+var sessionNonce;
 
 function init() {
     $('#btn-disclosure')
-        .on('click', requestAttributes);
+        .on('click', function() { requestAttributes(false); });
+    $('#btn-disclosure-name')
+        .toggleClass('hidden', !OPTIONAL_DATEOFBIRTH)
+        .on('click', function() { requestAttributes(true); });
     $('#input-pdf')
         .on('click', clearStatus)
         .on('change', updateUI);
@@ -16,7 +25,7 @@ function init() {
 
 function updateUI(e) {
     var hasPDF = Boolean($('#input-pdf').val());
-    var hasName = Boolean(disclosureJWT);
+    var hasName = Boolean(disclosureJWT || sessionToken);
     var stage;
     if (!hasPDF) {
         stage = 1;
@@ -25,7 +34,7 @@ function updateUI(e) {
     } else {
         stage = 3;
     }
-    $('#btn-disclosure')
+    $('#btn-disclosure, #btn-disclosure-name')
         .prop('disabled', stage < 2);
     $('#btn-issue')
         .prop('disabled', stage < 3);
@@ -37,14 +46,30 @@ function updateUI(e) {
     }
 }
 
-function requestAttributes() {
+// Request the attributes to disclose, without the date of birth when
+// withoutDOB is set (see OPTIONAL_DATEOFBIRTH).
+function requestAttributes(withoutDOB) {
     clearStatus();
     console.log('requesting attributes...');
     $.ajax({
-        url: API + 'request-attrs',
-    }).done(function(jwt) {
-        console.log('JWT:', jwt);
-        IRMA.verify(jwt,
+        url: API + 'request-attrs' + (withoutDOB ? '?without=dateofbirth' : ''),
+    }).done(function(data, status, xhr) {
+        sessionNonce = xhr.getResponseHeader('X-Session-Nonce');
+        if (isSession(data)) {
+            // With irma_server_url, the session runs at the IRMA server and
+            // the issuer fetches the result itself using the session token.
+            console.log('session:', data);
+            irma.handleSession(data.sessionPtr, {language: 'nl'})
+                .then(function() { // success
+                    sessionToken = data.token;
+                    updateUI();
+                }, function(errormsg) {
+                    console.error('error during disclosure:', errormsg);
+                });
+            return;
+        }
+        console.log('JWT:', data);
+        IRMA.verify(data,
             function(jwt2) { // success
                 console.log('disclosure JWT:', jwt2);
                 disclosureJWT = jwt2;
@@ -59,11 +84,24 @@ function requestAttributes() {
     });
 }
 
+// Whether the API returned a session pointer of the IRMA server instead of a
+// signed JWT.
+function isSession(data) {
+    return typeof data === 'object' && data !== null && 'sessionPtr' in data;
+}
+
 function startIssue(e) {
     e.target.disabled = true;
     var fd = new FormData();
     fd.append('pdf', $('#input-pdf').prop('files')[0]);
-    fd.append('attributes', disclosureJWT);
+    if (sessionToken) {
+        fd.append('token', sessionToken);
+    } else {
+        fd.append('attributes', disclosureJWT);
+    }
+    if (sessionNonce) {
+        fd.append('nonce', sessionNonce);
+    }
     setStatus('info', MESSAGES['uploading']);
     $.ajax({
         url: API + 'issue',
@@ -71,9 +109,20 @@ function startIssue(e) {
         data: fd,
         processData: false,
         contentType: false,
-    }).done(function(jwt) {
+    }).done(function(data) {
         setStatus('info', MESSAGES['issuing']);
-        IRMA.issue(jwt,
+        if (isSession(data)) {
+            irma.handleSession(data.sessionPtr, {language: 'nl'})
+                .then(function() { // success
+                    setStatus('success', MESSAGES['finished']);
+                    e.target.disabled = false;
+                }, function(errormsg) {
+                    setStatus('danger', MESSAGES['issue-error'], errormsg);
+                    e.target.disabled = false;
+                });
+            return;
+        }
+        IRMA.issue(data,
             function() { // success
                 setStatus('success', MESSAGES['finished']);
                 e.target.disabled = false;
@@ -88,8 +137,9 @@ function startIssue(e) {
         e.target.disabled = false;
         console.error(xhr, xhr.responseText);
         setStatus('danger', MESSAGES['upload-error'], MESSAGES[xhr.responseText]);
-        if (xhr.responseText == 'error:attributes-expired') {
+        if (xhr.responseText == 'error:attributes-expired' || xhr.responseText == 'error:session') {
             disclosureJWT = undefined;
+            sessionToken = undefined;
             updateUI();
         }
     });
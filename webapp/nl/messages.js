@@ -4,12 +4,31 @@ var MESSAGES = {
   'uploading': 'Uploaden...',
   'upload-error': 'Uploaden mislukt.',
   'error:file-too-big': 'Diploma bestand is te groot. Is dit wel het juiste bestand?',
+  'error:irma-server': 'De IRMA server is niet bereikbaar. Probeer het later opnieuw.',
   'error:signing': 'Interne fout in de server.',
+  'error:bad-encoding': 'Het bestand kon niet goed worden verstuurd.',
+  'error:extractor-unavailable': 'Het diploma kan tijdelijk niet gelezen worden. Probeer het later opnieuw.',
+  'error:pdf-url-not-allowed': 'Het diploma kan niet van dit adres worden opgehaald.',
+  'error:pdf-url-fetch': 'Het diploma kon niet worden opgehaald. Probeer het later opnieuw.',
+  'error:busy': 'De server is op dit moment erg druk. Probeer het over een minuut opnieuw.',
+  'error:not-a-pdf': 'Dit bestand is geen PDF. Upload het uittreksel uit het diplomaregister als PDF.',
+  'error:encrypted-pdf': 'Dit bestand is beveiligd met een wachtwoord. Upload het uittreksel zoals je het van DUO hebt gekregen.',
+  'error:weak-signature': 'De handtekening van dit bestand is verouderd. Download een nieuw uittreksel uit het diplomaregister.',
+  'error:untrusted-signature': 'De handtekening van dit bestand kan niet worden gecontroleerd. Is dit wel een uittreksel van DUO?',
+  'error:truncated-pdf': 'Dit bestand is onvolledig. Download het uittreksel opnieuw en probeer het nog eens.',
   'error:extract': 'Kan het bestand niet lezen als diploma. Is dit wel het juiste bestand?',
+  'error:no-diploma-found': 'Er staat geen diploma in dit bestand. Upload het uittreksel uit het diplomaregister.',
   'error:name-match': 'Het vrijgegeven naam attribuut komt niet overeen met wat er op het diploma staat.',
   'error:initials-match': 'Het vrijgegeven voornaam attribuut komt niet overeen met wat er op het diploma staat.',
   'error:dateofbirth-match': 'Het vrijgegeven geboortedatum attribuut komt niet overeen met wat er op het diploma staat.',
+  'error:identifier-match': 'Het vrijgegeven identificerende attribuut komt niet overeen met wat er op het diploma staat.',
+  'error:attribute-match': 'Een van de vrijgegeven attributen komt niet overeen met wat er op het diploma staat.',
+  'error:institute-not-allowed': 'Voor diploma\'s van deze instelling kunnen geen attributen worden uitgegeven.',
+  'error:level-not-allowed': 'Voor diploma\'s van dit niveau kunnen geen attributen worden uitgegeven.',
+  'error:credential-expired': 'Dit diploma is te lang geleden behaald: de attributen zouden al verlopen zijn.',
   'error:attributes': 'Er is een probleem met de vrijgegeven attributen.',
+  'error:attributes-missing': 'Niet alle benodigde attributen zijn vrijgegeven.',
+  'error:session': 'De sessie is verlopen of al gebruikt - geef de attributen opnieuw vrij.',
   'error:attributes-expired': 'De vrijgegeven attributen zijn verlopen - geef de attributen opnieuw vrij.',
   'issuing': 'Attributen worden uitgegeven...',
   'issue-cancel': 'Uitgifte geannuleerd',